@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+const (
+	xsins        = "http://www.w3.org/2001/XMLSchema-instance"
+	s3ns         = "http://s3.amazonaws.com/doc/2006-03-01/"
+	allusers     = "http://acs.amazonaws.com/groups/global/AllUsers"
+	authusers    = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+	logdelivery  = "http://acs.amazonaws.com/groups/s3/LogDelivery"
+	grantcanon   = "CanonicalUser"
+	grantgroup   = "Group"
+	grantbyemail = "AmazonCustomerByEmail"
+)
+
+var cannedacls = []string{
+	"private", "public-read", "public-read-write", "authenticated-read",
+	"aws-exec-read", "bucket-owner-read", "bucket-owner-full-control", "log-delivery-write",
+}
+
+var aclperms = []string{"READ", "WRITE", "READ_ACP", "WRITE_ACP", "FULL_CONTROL"}
+
+type aclgrantee struct {
+	Type         string `xml:"type,attr"`
+	ID           string `xml:",omitempty" json:",omitempty"`
+	DisplayName  string `xml:",omitempty" json:",omitempty"`
+	URI          string `xml:",omitempty" json:",omitempty"`
+	EmailAddress string `xml:",omitempty" json:",omitempty"`
+}
+
+type aclgrant struct {
+	Grantee    aclgrantee
+	Permission string
+}
+
+// xsi:type can not be expressed with struct tags on both decode and encode
+func (g aclgrantee) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Attr = []xml.Attr{
+		{Name: xml.Name{Local: "xmlns:xsi"}, Value: xsins},
+		{Name: xml.Name{Local: "xsi:type"}, Value: g.Type},
+	}
+	type body struct {
+		ID           string `xml:",omitempty"`
+		DisplayName  string `xml:",omitempty"`
+		URI          string `xml:",omitempty"`
+		EmailAddress string `xml:",omitempty"`
+	}
+	return e.EncodeElement(body{g.ID, g.DisplayName, g.URI, g.EmailAddress}, start)
+}
+
+func (g aclgrantee) String() string {
+	switch g.Type {
+	case grantgroup:
+		return "uri=" + g.URI
+	case grantbyemail:
+		return "email=" + g.EmailAddress
+	}
+	if g.DisplayName != "" {
+		return fmt.Sprintf("id=%s (%s)", g.ID, g.DisplayName)
+	}
+	return "id=" + g.ID
+}
+
+func (g aclgrantee) match(o aclgrantee) bool {
+	switch {
+	case g.URI != "":
+		return g.URI == o.URI
+	case g.EmailAddress != "":
+		return g.EmailAddress == o.EmailAddress
+	case g.ID != "":
+		return g.ID == o.ID
+	}
+	return false
+}
+
+func parsegrantee(s string) (aclgrantee, error) {
+	switch strings.ToLower(s) {
+	case "all-users", "allusers", "everyone":
+		return aclgrantee{Type: grantgroup, URI: allusers}, nil
+	case "authenticated-users", "authenticatedusers":
+		return aclgrantee{Type: grantgroup, URI: authusers}, nil
+	case "log-delivery", "logdelivery":
+		return aclgrantee{Type: grantgroup, URI: logdelivery}, nil
+	}
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return aclgrantee{}, fmt.Errorf("invalid grantee: %s", s)
+	}
+	switch strings.ToLower(kv[0]) {
+	case "id":
+		return aclgrantee{Type: grantcanon, ID: kv[1]}, nil
+	case "email", "emailaddress":
+		return aclgrantee{Type: grantbyemail, EmailAddress: kv[1]}, nil
+	case "uri":
+		return aclgrantee{Type: grantgroup, URI: kv[1]}, nil
+	}
+	return aclgrantee{}, fmt.Errorf("invalid grantee type: %s", s)
+}
+
+// PERMISSION:GRANTEE, permission may be omitted when allowempty
+func parsegrant(s string, allowempty bool) (aclgrant, error) {
+	var perm string
+	if kv := strings.SplitN(s, ":", 2); len(kv) == 2 {
+		for _, p := range aclperms {
+			if strings.ToUpper(kv[0]) == p {
+				perm = p
+				s = kv[1]
+				break
+			}
+		}
+	}
+	if perm == "" && !allowempty {
+		return aclgrant{}, fmt.Errorf("missing permission(%s): %s", strings.Join(aclperms, ","), s)
+	}
+	g, err := parsegrantee(s)
+	return aclgrant{Grantee: g, Permission: perm}, err
+}
+
+func getaclpol(bkt *s3.Bucket, key string) (*aclpol, error) {
+	rsp, err := s3raw(bkt, "GET", key, url.Values{"acl": {""}}, http.Header{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	var acl aclpol
+	if err = xml.NewDecoder(rsp.Body).Decode(&acl); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+func putaclpol(bkt *s3.Bucket, key string, acl *aclpol) error {
+	acl.Xmlns = s3ns
+	doc, err := xml.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "application/xml")
+	rsp, err := s3raw(bkt, "PUT", key, url.Values{"acl": {""}}, hdr, doc)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func putcannedacl(bkt *s3.Bucket, key string, canned string) error {
+	hdr := http.Header{}
+	hdr.Set("x-amz-acl", canned)
+	rsp, err := s3raw(bkt, "PUT", key, url.Values{"acl": {""}}, hdr, nil)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func (acl *aclpol) addgrant(g aclgrant) bool {
+	for _, v := range acl.AccessControlList.Grant {
+		if v.Permission == g.Permission && v.Grantee.match(g.Grantee) {
+			return false
+		}
+	}
+	acl.AccessControlList.Grant = append(acl.AccessControlList.Grant, g)
+	return true
+}
+
+func (acl *aclpol) delgrant(g aclgrant) bool {
+	grants := acl.AccessControlList.Grant[:0]
+	for _, v := range acl.AccessControlList.Grant {
+		if (g.Permission == "" || v.Permission == g.Permission) && g.Grantee.match(v.Grantee) {
+			continue
+		}
+		grants = append(grants, v)
+	}
+	changed := len(grants) != len(acl.AccessControlList.Grant)
+	acl.AccessControlList.Grant = grants
+	return changed
+}
+
+func aclshow(us string, acl *aclpol) {
+	fmt.Println(us)
+	if acl.Owner.DisplayName != "" {
+		fmt.Printf("  Owner: %s (%s)\n", acl.Owner.ID, acl.Owner.DisplayName)
+	} else {
+		fmt.Printf("  Owner: %s\n", acl.Owner.ID)
+	}
+	for _, g := range acl.AccessControlList.Grant {
+		fmt.Printf("  %-12s %s\n", g.Permission, g.Grantee)
+	}
+}
+
+func getacl(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	out := newoutput()
+	fail := newfailures()
+	for _, arg := range c.Args() {
+		urls, err := expandurls(arg, c.Bool("recursive"))
+		if err != nil {
+			fail.add(arg, err)
+			continue
+		}
+		for _, us := range urls {
+			bkt, key, err := url2bktpath(s3cl, us)
+			if err != nil {
+				return usageerr("invalid url: %s %v", us, err)
+			}
+			acl, err := getaclpol(bkt, key)
+			fail.add(us, err)
+			if err != nil {
+				continue
+			}
+			rec := record{Bucket: bkt.Name, Key: key, URL: us, Owner: acl.Owner.ID, Acl: acl}
+			out.emit(rec, func() { aclshow(us, acl) })
+		}
+	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("getacl")
+}
+
+func setacl(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	canned := c.String("acl")
+	if canned != "" {
+		valid := false
+		for _, v := range cannedacls {
+			valid = valid || v == canned
+		}
+		if !valid {
+			return usageerr("invalid canned acl %s, choose from %s", canned, strings.Join(cannedacls, ","))
+		}
+	}
+	grants := []aclgrant{}
+	for _, s := range c.StringSlice("grant") {
+		g, err := parsegrant(s, false)
+		if err != nil {
+			return usageerr("grant: %v", err)
+		}
+		grants = append(grants, g)
+	}
+	revokes := []aclgrant{}
+	for _, s := range c.StringSlice("revoke") {
+		g, err := parsegrant(s, true)
+		if err != nil {
+			return usageerr("revoke: %v", err)
+		}
+		revokes = append(revokes, g)
+	}
+	if canned == "" && len(grants) == 0 && len(revokes) == 0 {
+		return usageerr("specify --acl, --grant or --revoke")
+	}
+	fail := newfailures()
+	for _, arg := range c.Args() {
+		urls, err := expandurls(arg, c.Bool("recursive"))
+		if err != nil {
+			fail.add(arg, err)
+			continue
+		}
+		for _, us := range urls {
+			bkt, key, err := url2bktpath(s3cl, us)
+			if err != nil {
+				return usageerr("invalid url: %s %v", us, err)
+			}
+			if canned != "" {
+				log.Println("setacl", us, canned)
+				if !c.Bool("dry-run") {
+					if err = putcannedacl(bkt, key, canned); err != nil {
+						fail.add(us, err)
+						continue
+					}
+				}
+			}
+			if len(grants) == 0 && len(revokes) == 0 {
+				fail.success()
+				continue
+			}
+			acl, err := getaclpol(bkt, key)
+			if err != nil {
+				fail.add(us, err)
+				continue
+			}
+			changed := false
+			for _, g := range revokes {
+				changed = acl.delgrant(g) || changed
+			}
+			for _, g := range grants {
+				changed = acl.addgrant(g) || changed
+			}
+			if c.Bool("dry-run") {
+				aclshow(us, acl)
+				continue
+			}
+			if !changed {
+				log.Println("acl not changed", us)
+				fail.success()
+				continue
+			}
+			fail.add(us, putaclpol(bkt, key, acl))
+		}
+	}
+	return fail.result("setacl")
+}
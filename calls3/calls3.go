@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/smartystreets/go-aws-auth"
+	"github.com/wtnb75/go-s3cmd/sigv4"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 func dumphdr(r http.Header) {
@@ -45,7 +47,24 @@ func apprun(c *cli.Context) {
 			hdra := strings.SplitN(hdr, ":", 2)
 			req.Header.Add(hdra[0], strings.TrimSpace(hdra[1]))
 		}
-		awsauth.SignS3(req, cred)
+		if c.Duration("presign") != 0 {
+			if c.String("signature") == "v4" {
+				sigv4.New(cred.AccessKeyID, cred.SecretAccessKey, "", c.String("region")).Presign(req, c.Duration("presign"))
+			} else {
+				awsauth.SignS3Url(req, time.Now().Add(c.Duration("presign")), cred)
+			}
+			fmt.Println(req.URL.String())
+			continue
+		}
+		if c.String("signature") == "v4" {
+			payload := sigv4.EmptySHA256
+			if rd != nil {
+				payload = sigv4.UnsignedPayload
+			}
+			sigv4.New(cred.AccessKeyID, cred.SecretAccessKey, "", c.String("region")).Sign(req, payload)
+		} else {
+			awsauth.SignS3(req, cred)
+		}
 		if c.Bool("dump-header") {
 			dumphdr(req.Header)
 		}
@@ -93,6 +112,21 @@ func main() {
 			Usage:  "Access Secret Key",
 			EnvVar: "AWS_SECRET_ACCESS_KEY,AWS_SECRET_KEY",
 		},
+		cli.StringFlag{
+			Name:  "signature",
+			Usage: "signature version [v2|v4]",
+			Value: "v2",
+		},
+		cli.StringFlag{
+			Name:   "region",
+			Usage:  "region name for v4 signature",
+			Value:  "us-east-1",
+			EnvVar: "AWS_REGION",
+		},
+		cli.DurationFlag{
+			Name:  "presign",
+			Usage: "print presigned url valid for this duration instead of request",
+		},
 		cli.StringSliceFlag{
 			Name:  "header,H",
 			Value: &cli.StringSlice{},
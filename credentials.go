@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+	"github.com/wtnb75/go-s3cmd/sigv4"
+)
+
+var credflags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "session_token",
+		Usage:  "session token of temporary credentials",
+		EnvVar: "AWS_SESSION_TOKEN,AWS_SECURITY_TOKEN",
+	},
+	cli.StringFlag{
+		Name:   "role_arn",
+		Usage:  "assume role with sts",
+		EnvVar: "AWS_ROLE_ARN",
+	},
+	cli.StringFlag{
+		Name:  "external_id",
+		Usage: "external id of assume role",
+	},
+	cli.StringFlag{
+		Name:   "role_session_name",
+		Usage:  "session name of assume role",
+		EnvVar: "AWS_ROLE_SESSION_NAME",
+	},
+	cli.DurationFlag{
+		Name:  "role_duration",
+		Usage: "lifetime of assumed role credentials (default: 1h)",
+	},
+	cli.StringFlag{
+		Name:  "mfa_serial",
+		Usage: "mfa device serial number or arn of assume role",
+	},
+	cli.StringFlag{
+		Name:  "mfa_token",
+		Usage: "mfa code (default: prompt)",
+	},
+	cli.StringFlag{
+		Name:   "web_identity_token_file",
+		Usage:  "assume role with web identity token in file",
+		EnvVar: "AWS_WEB_IDENTITY_TOKEN_FILE",
+	},
+	cli.StringFlag{
+		Name:   "sts_endpoint",
+		Usage:  "sts endpoint url",
+		EnvVar: "AWS_ENDPOINT_URL_STS",
+	},
+}
+
+const defaultsts = "https://sts.amazonaws.com/"
+
+// sts AssumeRole, or AssumeRoleWithWebIdentity when tokenfile is set.
+// with mfaserial, role is assumed by mfa session of GetSessionToken
+type rolecfg struct {
+	arn        string
+	externalid string
+	session    string
+	duration   time.Duration
+	mfaserial  string
+	tokenfile  string
+	// profile having credentials to assume role
+	source   string
+	endpoint string
+}
+
+// mfa code from --mfa_token, used once
+var mfatoken string
+
+func credsetup(c *cli.Context, prof *profile) error {
+	if v := c.GlobalString("session_token"); v != "" {
+		prof.token = v
+	}
+	for _, f := range []struct {
+		name string
+		val  *string
+	}{
+		{"role_arn", &prof.role.arn},
+		{"external_id", &prof.role.externalid},
+		{"role_session_name", &prof.role.session},
+		{"mfa_serial", &prof.role.mfaserial},
+		{"web_identity_token_file", &prof.role.tokenfile},
+		{"sts_endpoint", &prof.role.endpoint},
+	} {
+		if v := c.GlobalString(f.name); v != "" {
+			*f.val = v
+		}
+	}
+	if d := c.GlobalDuration("role_duration"); d != 0 {
+		prof.role.duration = d
+	}
+	mfatoken = c.GlobalString("mfa_token")
+	return checkrole(prof.role)
+}
+
+func checkrole(role rolecfg) error {
+	if role.arn == "" && (role.tokenfile != "" || role.mfaserial != "" || role.externalid != "") {
+		return usageerr("role arn is required")
+	}
+	if role.duration < 0 {
+		return usageerr("invalid role duration: %s", role.duration)
+	}
+	return nil
+}
+
+// static credentials. goamz refreshes expired token from environment, so never expire
+func newauth(akey, skey, token string) aws.Auth {
+	return *aws.NewAuth(akey, skey, token, time.Now().AddDate(100, 0, 0))
+}
+
+func mfacode(serial string) (string, error) {
+	if mfatoken != "" {
+		code := mfatoken
+		mfatoken = ""
+		return code, nil
+	}
+	fmt.Fprintf(os.Stderr, "MFA code for %s: ", serial)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("read mfa code: %v", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// region in signature: global endpoint is us-east-1, sts.REGION.amazonaws.com
+func stsregion(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "us-east-1"
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) == 4 && parts[0] == "sts" && parts[2] == "amazonaws" {
+		return parts[1]
+	}
+	return "us-east-1"
+}
+
+type stscreds struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+func assumerole(role rolecfg, base aws.Auth) (stscreds, error) {
+	session := role.session
+	if session == "" {
+		session = fmt.Sprintf("s3cmd-%d", time.Now().Unix())
+	}
+	duration := role.duration
+	if duration == 0 {
+		duration = time.Hour
+	}
+	form := url.Values{
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {role.arn},
+		"RoleSessionName": {session},
+		"DurationSeconds": {strconv.Itoa(int(duration / time.Second))},
+	}
+	if role.tokenfile != "" {
+		// token file is rotated, read on each refresh
+		token, err := ioutil.ReadFile(role.tokenfile)
+		if err != nil {
+			return stscreds{}, err
+		}
+		form.Set("Action", "AssumeRoleWithWebIdentity")
+		form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+		return stsrequest(role.endpoint, form, nil)
+	}
+	form.Set("Action", "AssumeRole")
+	if role.externalid != "" {
+		form.Set("ExternalId", role.externalid)
+	}
+	return stsrequest(role.endpoint, form, &base)
+}
+
+// mfa authenticated session of base. it assumes role without code
+func sessiontoken(role rolecfg, base aws.Auth, code string) (stscreds, error) {
+	form := url.Values{
+		"Version":      {"2011-06-15"},
+		"Action":       {"GetSessionToken"},
+		"SerialNumber": {role.mfaserial},
+		"TokenCode":    {code},
+	}
+	return stsrequest(role.endpoint, form, &base)
+}
+
+// sts action of form, signed by base if not nil
+func stsrequest(endpoint string, form url.Values, base *aws.Auth) (stscreds, error) {
+	if endpoint == "" {
+		endpoint = defaultsts
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return stscreds{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if base != nil {
+		signer := sigv4.New(base.AccessKey, base.SecretKey, base.Token(), stsregion(endpoint))
+		signer.Service = "sts"
+		signer.Sign(req, sigv4.PayloadHash(body))
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return stscreds{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		var res struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.NewDecoder(rsp.Body).Decode(&res)
+		if res.Message == "" {
+			res.Message = rsp.Status
+		}
+		return stscreds{}, &s3.Error{StatusCode: rsp.StatusCode, Code: res.Code, Message: "sts: " + res.Message}
+	}
+	var res struct {
+		Role    stscreds `xml:"AssumeRoleResult>Credentials"`
+		Web     stscreds `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+		Session stscreds `xml:"GetSessionTokenResult>Credentials"`
+	}
+	if err := xml.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return stscreds{}, fmt.Errorf("sts response: %v", err)
+	}
+	for _, creds := range []stscreds{res.Role, res.Web, res.Session} {
+		if creds.AccessKeyId != "" {
+			return creds, nil
+		}
+	}
+	return stscreds{}, fmt.Errorf("sts response: no credentials")
+}
+
+// assumed role credentials of a client
+type rolesession struct {
+	role rolecfg
+	base aws.Auth
+	cl   *s3.S3
+	// mfa session assuming role, code is asked only once
+	mfa *stscreds
+	// fields below are guarded by sessions
+	exp time.Time
+	// refresh in progress
+	busy bool
+	// credentials not swapped in yet
+	pending *stscreds
+}
+
+// refresh credentials expiring within this
+const refreshmargin = 5 * time.Minute
+
+var sessions struct {
+	sync.Mutex
+	list []*rolesession
+}
+
+// cl.Auth is replaced by refresh while workers sign requests with it.
+// requests hold read lock (see authed), refresh holds write lock
+var authlock sync.RWMutex
+
+// run fn reading client credentials. fn must not call retry or authed
+func authed(fn func() error) error {
+	authlock.RLock()
+	defer authlock.RUnlock()
+	return fn()
+}
+
+// new credentials of role, through mfa session if mfa serial is set
+func (rs *rolesession) credentials() (stscreds, error) {
+	base := rs.base
+	if rs.role.mfaserial != "" && rs.role.tokenfile == "" {
+		if rs.mfa == nil {
+			code, err := mfacode(rs.role.mfaserial)
+			if err != nil {
+				return stscreds{}, err
+			}
+			creds, err := sessiontoken(rs.role, rs.base, code)
+			if err != nil {
+				return stscreds{}, err
+			}
+			rs.mfa = &creds
+		} else if time.Until(rs.mfa.Expiration) < refreshmargin {
+			// no prompt while workers are running
+			return stscreds{}, fmt.Errorf("mfa session of %s expired at %s, run again with new mfa code", rs.role.mfaserial, rs.mfa.Expiration)
+		}
+		base = *aws.NewAuth(rs.mfa.AccessKeyId, rs.mfa.SecretAccessKey, rs.mfa.SessionToken, rs.mfa.Expiration)
+	}
+	return assumerole(rs.role, base)
+}
+
+// fetch credentials by sts without locks, then swap them into the client.
+// swap waits for requests in flight only after current credentials expired
+func (rs *rolesession) refresh() error {
+	sessions.Lock()
+	creds, exp := rs.pending, rs.exp
+	sessions.Unlock()
+	if creds == nil {
+		res, err := rs.credentials()
+		if err != nil {
+			return err
+		}
+		creds = &res
+	}
+	if time.Now().Before(exp) {
+		if !authlock.TryLock() {
+			sessions.Lock()
+			rs.pending = creds
+			sessions.Unlock()
+			return nil
+		}
+	} else {
+		authlock.Lock()
+	}
+	rs.cl.Auth = *aws.NewAuth(creds.AccessKeyId, creds.SecretAccessKey, creds.SessionToken, creds.Expiration)
+	authlock.Unlock()
+	sessions.Lock()
+	rs.exp, rs.pending = creds.Expiration, nil
+	sessions.Unlock()
+	log.Println("assumed", rs.role.arn, "until", creds.Expiration)
+	return nil
+}
+
+func assumesetup(cl *s3.S3, role rolecfg) error {
+	rs := &rolesession{role: role, base: cl.Auth, cl: cl}
+	if err := rs.refresh(); err != nil {
+		return err
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	sessions.list = append(sessions.list, rs)
+	return nil
+}
+
+// before each request. one worker refreshes each session, others go on with current credentials
+func refreshcreds() {
+	sessions.Lock()
+	due := []*rolesession{}
+	for _, rs := range sessions.list {
+		if !rs.busy && (rs.pending != nil || time.Until(rs.exp) < refreshmargin) {
+			rs.busy = true
+			due = append(due, rs)
+		}
+	}
+	sessions.Unlock()
+	for _, rs := range due {
+		if err := rs.refresh(); err != nil {
+			log.Println("refresh credentials", rs.role.arn, err)
+		}
+		sessions.Lock()
+		rs.busy = false
+		sessions.Unlock()
+	}
+}
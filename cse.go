@@ -0,0 +1,612 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+var cseflags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "encrypt-key",
+		Usage:  "client side encryption with master key file, 32 bytes raw or base64",
+		EnvVar: "S3CMD_ENCRYPT_KEY",
+	},
+	cli.StringFlag{
+		Name:   "encrypt-passphrase",
+		Usage:  "client side encryption with key derived from passphrase",
+		EnvVar: "S3CMD_ENCRYPT_PASSPHRASE",
+	},
+}
+
+// client side envelope encryption. content is sealed by a random data key
+// in segments of csesegment bytes with AES-GCM, nonce is iv xor segment number.
+// data key is wrapped by master key or passphrase derived key, bound to content size.
+const (
+	csescheme   = "AES256-GCM-65536"
+	csesegment  = 64 * 1024
+	cseoverhead = 16
+	kdfiter     = 600000
+)
+
+// metadata of encrypted object
+const (
+	metacse     = "s3cmd-cse"
+	metacsekey  = "s3cmd-cse-key"
+	metacseiv   = "s3cmd-cse-iv"
+	metacsesize = "s3cmd-cse-size"
+	metacsekdf  = "s3cmd-cse-kdf"
+	// keyed digest of content md5, instead of x-amz-meta-md5
+	metacsemac = "s3cmd-cse-mac"
+)
+
+var cseopt struct {
+	master     []byte
+	passphrase string
+	// kdf of uploads in this run
+	kdf  string
+	mu   sync.Mutex
+	keks map[string][]byte
+}
+
+func csesetup(c *cli.Context) error {
+	cseopt.master, cseopt.passphrase, cseopt.kdf = nil, "", ""
+	cseopt.keks = map[string][]byte{}
+	fn, pass := c.GlobalString("encrypt-key"), c.GlobalString("encrypt-passphrase")
+	switch {
+	case fn != "" && pass != "":
+		return usageerr("encrypt-key and encrypt-passphrase are exclusive")
+	case fn != "":
+		key, err := readkeyfile(fn)
+		if err != nil {
+			return usageerr("encrypt-key: %v", err)
+		}
+		cseopt.master = key
+	case pass != "":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		cseopt.passphrase = pass
+		cseopt.kdf = fmt.Sprintf("pbkdf2-sha256:%d:%s", kdfiter, base64.StdEncoding.EncodeToString(salt))
+	}
+	return nil
+}
+
+func encrypting() bool {
+	return cseopt.master != nil || cseopt.passphrase != ""
+}
+
+// s3 storage, encrypted if enabled
+func s3store(bkt *s3.Bucket) storage {
+	st := &s3storage{bkt: bkt}
+	if encrypting() {
+		return &cryptstorage{st}
+	}
+	return st
+}
+
+// key encryption key of kdf parameters, master key if empty
+func csekek(kdf string) ([]byte, error) {
+	if kdf == "" {
+		if cseopt.master == nil {
+			return nil, errors.New("encrypted with master key, use --encrypt-key")
+		}
+		return cseopt.master, nil
+	}
+	if cseopt.passphrase == "" {
+		return nil, errors.New("encrypted with passphrase, use --encrypt-passphrase")
+	}
+	cseopt.mu.Lock()
+	defer cseopt.mu.Unlock()
+	if kek, ok := cseopt.keks[kdf]; ok {
+		return kek, nil
+	}
+	parts := strings.Split(kdf, ":")
+	if len(parts) != 3 || parts[0] != "pbkdf2-sha256" {
+		return nil, fmt.Errorf("unsupported kdf %s", kdf)
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return nil, fmt.Errorf("invalid kdf %s", kdf)
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kdf %s", kdf)
+	}
+	kek, err := pbkdf2.Key(sha256.New, cseopt.passphrase, salt, iter, 32)
+	if err != nil {
+		return nil, err
+	}
+	cseopt.keks[kdf] = kek
+	return kek, nil
+}
+
+func newgcm(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+func wrapaad(size int64) []byte {
+	return []byte(fmt.Sprintf("%s %d", csescheme, size))
+}
+
+// md5 of content would let the provider confirm guessed content.
+// keyed by data key, only holders of master key can compare
+func csemac(dk []byte, sum string) string {
+	mk := hmac.New(sha256.New, dk)
+	mk.Write([]byte(metacsemac))
+	h := hmac.New(sha256.New, mk.Sum(nil))
+	h.Write([]byte(sum))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sum is md5 of content of encrypted object with hdr
+func csematch(hdr http.Header, sum string) bool {
+	mac := hdr.Get("x-amz-meta-" + metacsemac)
+	if mac == "" || sum == "" {
+		return false
+	}
+	dk, _, _, err := unwrapkey(hdr)
+	if err != nil {
+		log.Println("md5 of encrypted object", err)
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(csemac(dk, sum)))
+}
+
+// new data key of content size, wrapped into meta. md5 in meta is replaced by keyed digest
+func newdatakey(size int64, meta map[string][]string) (cipher.AEAD, []byte, error) {
+	kek, err := csekek(cseopt.kdf)
+	if err != nil {
+		return nil, nil, err
+	}
+	dk := make([]byte, 32)
+	iv := make([]byte, 12)
+	nonce := make([]byte, 12)
+	for _, b := range [][]byte{dk, iv, nonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	wrap, err := newgcm(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped := wrap.Seal(nonce, nonce, dk, wrapaad(size))
+	meta[metacse] = []string{csescheme}
+	meta[metacsekey] = []string{base64.StdEncoding.EncodeToString(wrapped)}
+	meta[metacseiv] = []string{base64.StdEncoding.EncodeToString(iv)}
+	meta[metacsesize] = []string{strconv.FormatInt(size, 10)}
+	if cseopt.kdf != "" {
+		meta[metacsekdf] = []string{cseopt.kdf}
+	}
+	if sum := meta[metamd5]; len(sum) != 0 {
+		meta[metacsemac] = []string{csemac(dk, sum[0])}
+		delete(meta, metamd5)
+	}
+	aead, err := newgcm(dk)
+	return aead, iv, err
+}
+
+// data key in metadata. nil if not encrypted
+func opendatakey(hdr http.Header) (cipher.AEAD, []byte, int64, error) {
+	dk, iv, size, err := unwrapkey(hdr)
+	if dk == nil || err != nil {
+		return nil, nil, size, err
+	}
+	aead, err := newgcm(dk)
+	return aead, iv, size, err
+}
+
+// raw data key, iv and content size in metadata. nil if not encrypted
+func unwrapkey(hdr http.Header) ([]byte, []byte, int64, error) {
+	meta := func(k string) string { return hdr.Get("x-amz-meta-" + k) }
+	if meta(metacse) == "" {
+		return nil, nil, 0, nil
+	}
+	if meta(metacse) != csescheme {
+		return nil, nil, 0, fmt.Errorf("unsupported encryption %s", meta(metacse))
+	}
+	size, err := strconv.ParseInt(meta(metacsesize), 10, 64)
+	if err != nil || size < 0 {
+		return nil, nil, 0, errors.New("invalid encrypted size")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(meta(metacsekey))
+	if err != nil || len(wrapped) < 12 {
+		return nil, nil, 0, errors.New("invalid wrapped key")
+	}
+	iv, err := base64.StdEncoding.DecodeString(meta(metacseiv))
+	if err != nil || len(iv) != 12 {
+		return nil, nil, 0, errors.New("invalid iv")
+	}
+	kek, err := csekek(meta(metacsekdf))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	wrap, err := newgcm(kek)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	dk, err := wrap.Open(nil, wrapped[:12], wrapped[12:], wrapaad(size))
+	if err != nil {
+		return nil, nil, 0, errors.New("cannot unwrap data key, wrong key or passphrase")
+	}
+	return dk, iv, size, nil
+}
+
+// ciphertext size of content size
+func cipherlen(size int64) int64 {
+	nseg := (size + csesegment - 1) / csesegment
+	if nseg == 0 {
+		nseg = 1
+	}
+	return size + nseg*cseoverhead
+}
+
+func csenonce(iv []byte, seg int64) []byte {
+	nonce := append([]byte{}, iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(seg >> (8 * uint(i)))
+	}
+	return nonce
+}
+
+// seals size bytes of src from segment first. seekable if src is
+type encreader struct {
+	aead  cipher.AEAD
+	iv    []byte
+	src   io.Reader
+	first int64
+	size  int64
+	pos   int64
+	next  int64
+	seg   int64
+	buf   []byte
+	plain []byte
+}
+
+func newencreader(aead cipher.AEAD, iv []byte, src io.Reader, first, size int64) io.Reader {
+	r := &encreader{aead: aead, iv: iv, src: src, first: first, size: size, seg: -1}
+	if _, ok := src.(io.Seeker); ok {
+		return r
+	}
+	return struct{ io.Reader }{r}
+}
+
+func (r *encreader) fill(seg int64) error {
+	if seg != r.next {
+		rs, ok := r.src.(io.Seeker)
+		if !ok {
+			return errors.New("encrypt: source is not seekable")
+		}
+		if _, err := rs.Seek(seg*csesegment, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	n := r.size - seg*csesegment
+	if n > csesegment {
+		n = csesegment
+	}
+	if r.plain == nil {
+		r.plain = make([]byte, csesegment)
+	}
+	if _, err := io.ReadFull(r.src, r.plain[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.buf = r.aead.Seal(r.buf[:0], csenonce(r.iv, r.first+seg), r.plain[:n], nil)
+	r.seg, r.next = seg, seg+1
+	return nil
+}
+
+func (r *encreader) Read(p []byte) (int, error) {
+	if r.pos >= cipherlen(r.size) {
+		return 0, io.EOF
+	}
+	seg := r.pos / (csesegment + cseoverhead)
+	if seg != r.seg {
+		if err := r.fill(seg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.pos-seg*(csesegment+cseoverhead):])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *encreader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += cipherlen(r.size)
+	}
+	if offset < 0 {
+		return 0, errors.New("encrypt: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// opens segments of src from segment seg, skip and remain are plaintext bytes
+type decreader struct {
+	aead   cipher.AEAD
+	iv     []byte
+	src    io.ReadCloser
+	seg    int64
+	size   int64
+	skip   int64
+	remain int64
+	buf    []byte
+	ct     []byte
+}
+
+func (r *decreader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.remain <= 0 {
+			return 0, io.EOF
+		}
+		n := r.size - r.seg*csesegment
+		if n > csesegment {
+			n = csesegment
+		}
+		if r.ct == nil {
+			r.ct = make([]byte, csesegment+cseoverhead)
+		}
+		ct := r.ct[:n+cseoverhead]
+		if _, err := io.ReadFull(r.src, ct); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		plain, err := r.aead.Open(ct[:0], csenonce(r.iv, r.seg), ct, nil)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt segment %d: %v", r.seg, err)
+		}
+		r.seg++
+		r.buf = plain[r.skip:]
+		r.skip = 0
+		if int64(len(r.buf)) > r.remain {
+			r.buf = r.buf[:r.remain]
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.remain -= int64(n)
+	return n, nil
+}
+
+func (r *decreader) Close() error {
+	return r.src.Close()
+}
+
+// storage with client side encryption. objects without encryption metadata are read as is
+type cryptstorage struct {
+	storage
+}
+
+func copymeta(meta map[string][]string) map[string][]string {
+	res := map[string][]string{}
+	for k, v := range meta {
+		res[k] = v
+	}
+	return res
+}
+
+// content size of encrypted object. content is compared with keyed digest, see metamatch
+func plaininfo(info objinfo) (objinfo, error) {
+	_, _, size, err := opendatakey(info.header)
+	if err != nil || info.header.Get("x-amz-meta-"+metacse) == "" {
+		return info, err
+	}
+	info.size = size
+	if sum := info.header.Get("x-amz-meta-" + metamd5); sum != "" {
+		// written by older version
+		info.etag = sum
+	} else if etagparts(info.etag) == 0 {
+		// etag of ciphertext, never match md5 of content
+		info.etag += "-1"
+	}
+	return info, nil
+}
+
+func (st *cryptstorage) walk(dir string, fn func(rel string, info objinfo) error) error {
+	// listing has size and etag of ciphertext
+	return st.storage.walk(dir, func(rel string, info objinfo) error {
+		full, err := st.stat(info.key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", st.url(info.key), err)
+		}
+		return fn(rel, full)
+	})
+}
+
+func (st *cryptstorage) stat(key string) (objinfo, error) {
+	info, err := st.storage.stat(key)
+	if err != nil {
+		return info, err
+	}
+	return plaininfo(info)
+}
+
+func (st *cryptstorage) open(key string, offset, length int64) (io.ReadCloser, error) {
+	info, err := st.storage.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, iv, size, err := opendatakey(info.header)
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil {
+		return st.storage.open(key, offset, length)
+	}
+	if info.size != cipherlen(size) {
+		return nil, fmt.Errorf("encrypted size %d != %d", info.size, cipherlen(size))
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+	first := offset / csesegment
+	cstart := first * (csesegment + cseoverhead)
+	cend := (offset + length + csesegment - 1) / csesegment * (csesegment + cseoverhead)
+	if cend > info.size {
+		cend = info.size
+	}
+	rd, err := st.storage.open(key, cstart, cend-cstart)
+	if err != nil {
+		return nil, err
+	}
+	return &decreader{aead: aead, iv: iv, src: rd, seg: first, size: size,
+		skip: offset - first*csesegment, remain: length}, nil
+}
+
+func readermd5(rs io.ReadSeeker) (string, error) {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	hs := md5.New()
+	if _, err := io.Copy(hs, rs); err != nil {
+		return "", err
+	}
+	if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hs.Sum(nil)), nil
+}
+
+func (st *cryptstorage) write(key string, rd io.Reader, size int64, ctyp string, opts putopts) error {
+	if size < 0 {
+		return errors.New("size is required to encrypt")
+	}
+	opts.Meta = copymeta(opts.Meta)
+	if rs, ok := rd.(io.ReadSeeker); ok && opts.Meta[metamd5] == nil {
+		// etag of ciphertext is not md5 of content, stored as keyed digest
+		sum, err := readermd5(rs)
+		if err != nil {
+			return err
+		}
+		opts.Meta[metamd5] = []string{sum}
+	}
+	aead, iv, err := newdatakey(size, opts.Meta)
+	if err != nil {
+		return err
+	}
+	return st.storage.write(key, newencreader(aead, iv, rd, 0, size), cipherlen(size), ctyp, opts)
+}
+
+// encrypted object of info between encrypting storages is copied as ciphertext,
+// keeps data key and keyed digest of source. raw storages of dst and src
+func cipherstorages(dst, src storage, info objinfo) (storage, storage, bool) {
+	cd, dok := dst.(*cryptstorage)
+	cs, sok := src.(*cryptstorage)
+	if !dok || !sok || info.header.Get("x-amz-meta-"+metacse) == "" {
+		return dst, src, false
+	}
+	return cd.storage, cs.storage, true
+}
+
+func (st *cryptstorage) copy(dstkey string, src storage, srckey string, size, partsz int64) error {
+	cs, ok := src.(*cryptstorage)
+	if !ok {
+		return errcross
+	}
+	info, err := cs.storage.stat(srckey)
+	if err != nil {
+		return err
+	}
+	return st.storage.copy(dstkey, cs.storage, srckey, info.size, partsz)
+}
+
+// parts must be aligned to segments
+type cryptmulti struct {
+	multiupload
+	aead cipher.AEAD
+	iv   []byte
+	size int64
+}
+
+func (st *cryptstorage) initmulti(key, ctyp string, size int64, opts putopts) (multiupload, error) {
+	opts.Meta = copymeta(opts.Meta)
+	aead, iv, err := newdatakey(size, opts.Meta)
+	if err != nil {
+		return nil, err
+	}
+	mu, err := st.storage.initmulti(key, ctyp, cipherlen(size), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptmulti{multiupload: mu, aead: aead, iv: iv, size: size}, nil
+}
+
+func (m *cryptmulti) put(n int, offset int64, rd io.Reader, size int64) error {
+	if offset%csesegment != 0 || (offset+size != m.size && size%csesegment != 0) {
+		return fmt.Errorf("part %d is not aligned to encryption segment %d", n, csesegment)
+	}
+	first := offset / csesegment
+	return m.multiupload.put(n, first*(csesegment+cseoverhead), newencreader(m.aead, m.iv, rd, first, size), cipherlen(size))
+}
+
+func (m *cryptmulti) copy(n int, offset int64, src storage, srckey string, size int64) error {
+	return errcross
+}
+
+// part size aligned to segments
+func csealign(partsz int64) int64 {
+	return (partsz + csesegment - 1) / csesegment * csesegment
+}
+
+// decrypting reader of version vid of s3 url, rng is http Range of content
+func cryptreader(us, vid, rng string) (io.ReadCloser, error) {
+	bkt, key, err := url2bktpath(s3cl, us)
+	if err != nil {
+		return nil, err
+	}
+	offset, length := int64(0), int64(-1)
+	if rng != "" {
+		spec := strings.TrimPrefix(rng, "bytes=")
+		idx := strings.Index(spec, "-")
+		if idx <= 0 {
+			return nil, usageerr("unsupported range with encryption: %s", rng)
+		}
+		if offset, err = strconv.ParseInt(spec[:idx], 10, 64); err != nil {
+			return nil, usageerr("unsupported range with encryption: %s", rng)
+		}
+		if last := spec[idx+1:]; last != "" {
+			end, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || end < offset {
+				return nil, usageerr("unsupported range with encryption: %s", rng)
+			}
+			length = end - offset + 1
+		}
+	}
+	return versionstore(s3store(bkt), vid).open(key, offset, length)
+}
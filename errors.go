@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitPartial  = 3
+	exitNotFound = 4
+	exitAuth     = 5
+	exitTimeout  = 6
+)
+
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usageerr(format string, args ...interface{}) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+func onusageerr(c *cli.Context, err error, isSubcommand bool) error {
+	return usageError{err.Error()}
+}
+
+// exitError carries exit code decided by failures summary
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e exitError) Error() string {
+	return e.msg
+}
+
+func notfound(err error) bool {
+	var s3err *s3.Error
+	if errors.As(err, &s3err) {
+		switch s3err.Code {
+		case "NoSuchKey", "NoSuchBucket", "NoSuchUpload", "NoSuchVersion":
+			return true
+		}
+		return s3err.StatusCode == 404
+	}
+	return os.IsNotExist(err)
+}
+
+func autherror(err error) bool {
+	var s3err *s3.Error
+	if errors.As(err, &s3err) {
+		switch s3err.Code {
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken",
+			"InvalidToken", "TokenRefreshRequired", "AllAccessDisabled":
+			return true
+		case "InvalidObjectState":
+			return false
+		}
+		return s3err.StatusCode == 401 || s3err.StatusCode == 403
+	}
+	return os.IsPermission(err)
+}
+
+func exitcode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ee exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	var ue usageError
+	if errors.As(err, &ue) {
+		return exitUsage
+	}
+	if autherror(err) {
+		return exitAuth
+	}
+	if notfound(err) {
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+// failures aggregates per-object errors of a command
+type failures struct {
+	mu   sync.Mutex
+	errs map[string]error
+	ok   int
+}
+
+func newfailures() *failures {
+	return &failures{errs: map[string]error{}}
+}
+
+func (f *failures) add(name string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		f.ok += 1
+		return
+	}
+	log.Println("failed", name, err)
+	f.errs[name] = err
+}
+
+func (f *failures) success() {
+	f.add("", nil)
+}
+
+func (f *failures) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.errs)
+}
+
+// print summary and decide exit code
+func (f *failures) result(op string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errs) == 0 {
+		return nil
+	}
+	names := []string{}
+	for k, _ := range f.errs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "%s: %d of %d failed\n", op, len(f.errs), len(f.errs)+f.ok)
+	code := exitNotFound
+	for _, k := range names {
+		fmt.Fprintf(os.Stderr, "  %s: %v\n", k, f.errs[k])
+		switch c := exitcode(f.errs[k]); {
+		case c == exitAuth:
+			code = exitAuth
+		case c == exitTimeout && code == exitNotFound:
+			code = exitTimeout
+		case c != exitNotFound && c != exitTimeout && (code == exitNotFound || code == exitTimeout):
+			code = exitFailure
+		}
+	}
+	if code == exitFailure && f.ok != 0 {
+		code = exitPartial
+	}
+	return exitError{code: code, msg: fmt.Sprintf("%s: %d of %d failed", op, len(f.errs), len(f.errs)+f.ok)}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AdRoll/goamz/s3"
+)
+
+const mib = 1024 * 1024
+
+// user metadata key holding md5 of whole content (x-amz-meta-md5)
+const metamd5 = "md5"
+
+// "md5hex-N" -> N, 0 if not multipart
+func etagparts(etag string) int {
+	idx := strings.LastIndex(etag, "-")
+	if idx == -1 {
+		return 0
+	}
+	n, err := strconv.Atoi(etag[idx+1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// multipart etags of file split by each of partszs, in one read of the file
+func filemultimd5(fn string, partszs []int64) ([]string, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	type split struct {
+		partsz int64
+		hs     hash.Hash
+		cnt    int64
+		sums   []byte
+		nparts int
+	}
+	splits := []*split{}
+	for _, p := range partszs {
+		splits = append(splits, &split{partsz: p, hs: md5.New()})
+	}
+	buf := make([]byte, mib)
+	for {
+		n, err := fp.Read(buf)
+		for _, sp := range splits {
+			for data := buf[:n]; len(data) != 0; {
+				l := sp.partsz - sp.cnt
+				if l > int64(len(data)) {
+					l = int64(len(data))
+				}
+				sp.hs.Write(data[:l])
+				sp.cnt += l
+				data = data[l:]
+				if sp.cnt == sp.partsz {
+					sp.sums = sp.hs.Sum(sp.sums)
+					sp.nparts += 1
+					sp.hs.Reset()
+					sp.cnt = 0
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	res := []string{}
+	for _, sp := range splits {
+		if sp.cnt > 0 || sp.nparts == 0 {
+			sp.sums = sp.hs.Sum(sp.sums)
+			sp.nparts += 1
+		}
+		total := md5.Sum(sp.sums)
+		res = append(res, fmt.Sprintf("%s-%d", hex.EncodeToString(total[:]), sp.nparts))
+	}
+	return res, nil
+}
+
+// etag of completed multipart upload, md5 of part md5s
+func multietag(parts []s3.Part) string {
+	var sums []byte
+	for _, p := range parts {
+		sum, err := hex.DecodeString(strings.Trim(p.ETag, "\""))
+		if err != nil {
+			return ""
+		}
+		sums = append(sums, sum...)
+	}
+	total := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(total[:]), len(parts))
+}
+
+// part sizes which split size bytes into nparts parts. hint first
+func partsizes(size int64, nparts int, hint int64) []int64 {
+	res := []int64{}
+	add := func(p int64) {
+		if p <= 0 || (size+p-1)/p != int64(nparts) {
+			return
+		}
+		for _, v := range res {
+			if v == p {
+				return
+			}
+		}
+		res = append(res, p)
+	}
+	add(hint)
+	for _, v := range []int64{8, 16, 5, 15, 32, 64, 100, 128, 256, 512, 1024} {
+		add(v * mib)
+	}
+	p := (size + int64(nparts) - 1) / int64(nparts)
+	add((p + mib - 1) / mib * mib)
+	add(p)
+	return res
+}
+
+func headmd5(st storage, key string) string {
+	info, err := st.stat(key)
+	if err != nil {
+		log.Println("head", st.url(key), err)
+		return ""
+	}
+	return info.header.Get("x-amz-meta-" + metamd5)
+}
+
+// keyed digest of encrypted object, see csemac
+func headmac(st storage, key string) string {
+	if _, ok := st.(*cryptstorage); !ok {
+		return ""
+	}
+	info, err := st.stat(key)
+	if err != nil {
+		log.Println("head", st.url(key), err)
+		return ""
+	}
+	return info.header.Get("x-amz-meta-" + metacsemac)
+}
+
+// content md5 sum matches metadata of key, md5 or keyed digest of encrypted object.
+// known is false if metadata has neither
+func metamatch(st storage, key string, sum func() (string, error)) (match, known bool) {
+	info, err := st.stat(key)
+	if err != nil {
+		log.Println("head", st.url(key), err)
+		return false, false
+	}
+	md5sum := info.header.Get("x-amz-meta-" + metamd5)
+	if md5sum == "" && info.header.Get("x-amz-meta-"+metacsemac) == "" {
+		return false, false
+	}
+	s, err := sum()
+	if err != nil {
+		log.Println("md5", st.url(key), err)
+		return false, true
+	}
+	if md5sum != "" {
+		return s == md5sum, true
+	}
+	return csematch(info.header, s), true
+}
+
+// compare local file with remote entry
+func localmatch(fn string, local, remote entry, partsz int64) bool {
+	nparts := etagparts(remote.cksum)
+	if nparts == 0 {
+		sum, err := filemd5(fn)
+		return err == nil && sum == remote.cksum
+	}
+	if remote.st != nil {
+		if match, known := metamatch(remote.st, remote.key, func() (string, error) { return filemd5(fn) }); known {
+			return match
+		}
+	}
+	sizes := partsizes(local.size, nparts, partsz)
+	if len(sizes) == 0 {
+		return false
+	}
+	sums, err := filemultimd5(fn, sizes)
+	if err != nil {
+		log.Println("md5", fn, err)
+		return false
+	}
+	for _, sum := range sums {
+		if sum == remote.cksum {
+			return true
+		}
+	}
+	return false
+}
+
+func remotematch(s, d entry) bool {
+	if s.cksum == d.cksum {
+		return true
+	}
+	if s.st != nil && d.st != nil {
+		// both encrypted, same digest with same data key (copied as ciphertext)
+		if smac, dmac := headmac(s.st, s.key), headmac(d.st, d.key); smac != "" && dmac != "" {
+			return smac == dmac
+		}
+	}
+	if etagparts(s.cksum) == 0 && etagparts(d.cksum) == 0 {
+		return false
+	}
+	smd5, dmd5 := s.cksum, d.cksum
+	if etagparts(smd5) != 0 && s.st != nil {
+		smd5 = headmd5(s.st, s.key)
+	}
+	if etagparts(dmd5) != 0 && d.st != nil {
+		dmd5 = headmd5(d.st, d.key)
+	}
+	// one side is encrypted
+	for _, v := range []struct {
+		e   entry
+		sum string
+	}{{s, dmd5}, {d, smd5}} {
+		if v.sum != "" && etagparts(v.sum) == 0 && v.e.st != nil {
+			if _, ok := v.e.st.(*cryptstorage); ok {
+				match, _ := metamatch(v.e.st, v.e.key, func() (string, error) { return v.sum, nil })
+				return match
+			}
+		}
+	}
+	return smd5 != "" && smd5 == dmd5
+}
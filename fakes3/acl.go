@@ -0,0 +1,103 @@
+package fakes3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	allusers    = "http://acs.amazonaws.com/groups/global/AllUsers"
+	authusers   = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+	logdelivery = "http://acs.amazonaws.com/groups/s3/LogDelivery"
+)
+
+func grantxml(uri, perm string) string {
+	if uri == "" {
+		return fmt.Sprintf(`<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>%s</ID><DisplayName>%s</DisplayName></Grantee><Permission>%s</Permission></Grant>`,
+			OwnerID, OwnerName, perm)
+	}
+	return fmt.Sprintf(`<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="Group"><URI>%s</URI></Grantee><Permission>%s</Permission></Grant>`,
+		uri, perm)
+}
+
+// canned acl to AccessControlPolicy document. unknown name as private
+func cannedacl(canned string) []byte {
+	grants := grantxml("", "FULL_CONTROL")
+	switch canned {
+	case "public-read":
+		grants += grantxml(allusers, "READ")
+	case "public-read-write":
+		grants += grantxml(allusers, "READ") + grantxml(allusers, "WRITE")
+	case "authenticated-read":
+		grants += grantxml(authusers, "READ")
+	case "log-delivery-write":
+		grants += grantxml(logdelivery, "WRITE") + grantxml(logdelivery, "READ_ACP")
+	}
+	return []byte(fmt.Sprintf(`<AccessControlPolicy xmlns="%s"><Owner><ID>%s</ID><DisplayName>%s</DisplayName></Owner><AccessControlList>%s</AccessControlList></AccessControlPolicy>`,
+		s3ns, OwnerID, OwnerName, grants))
+}
+
+var cannedacls = map[string]bool{
+	"private": true, "public-read": true, "public-read-write": true, "authenticated-read": true,
+	"bucket-owner-read": true, "bucket-owner-full-control": true, "log-delivery-write": true,
+}
+
+func (s *Server) aclop(w http.ResponseWriter, r *http.Request, acl *[]byte) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(xml.Header))
+		w.Write(*acl)
+	case "PUT":
+		if canned := r.Header.Get("x-amz-acl"); canned != "" {
+			if !cannedacls[canned] {
+				writeerr(w, r, http.StatusBadRequest, "InvalidArgument", "invalid canned acl")
+				return
+			}
+			*acl = cannedacl(canned)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeerr(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		var pol struct {
+			XMLName xml.Name `xml:"AccessControlPolicy"`
+			Grants  []struct {
+				Grantee struct {
+					Type string `xml:"type,attr"`
+				}
+				Permission string
+			} `xml:"AccessControlList>Grant"`
+		}
+		if err := xml.Unmarshal(body, &pol); err != nil {
+			writeerr(w, r, http.StatusBadRequest, "MalformedACLError", err.Error())
+			return
+		}
+		for _, g := range pol.Grants {
+			switch g.Permission {
+			case "READ", "WRITE", "READ_ACP", "WRITE_ACP", "FULL_CONTROL":
+			default:
+				writeerr(w, r, http.StatusBadRequest, "MalformedACLError", "invalid permission "+g.Permission)
+				return
+			}
+			if g.Grantee.Type == "" {
+				writeerr(w, r, http.StatusBadRequest, "MalformedACLError", "grantee type missing")
+				return
+			}
+		}
+		body = bytes.TrimSpace(body)
+		if bytes.HasPrefix(body, []byte("<?xml")) {
+			if idx := bytes.Index(body, []byte("?>")); idx != -1 {
+				body = bytes.TrimSpace(body[idx+2:])
+			}
+		}
+		*acl = body
+	default:
+		writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
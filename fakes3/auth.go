@@ -0,0 +1,157 @@
+package fakes3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wtnb75/go-s3cmd/sigv4"
+)
+
+type autherror struct {
+	code string
+	msg  string
+}
+
+// verify signature v4 when Keys is set, decode aws-chunked body
+func (s *Server) authenticate(r *http.Request) *autherror {
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if s.Keys == nil && payload != sigv4.StreamingPayload {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return &autherror{"IncompleteBody", err.Error()}
+	}
+	setbody := func(data []byte) {
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		r.ContentLength = int64(len(data))
+		r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	setbody(body)
+	if s.Keys == nil {
+		data, err := decodechunked(body, nil)
+		if err != nil {
+			return &autherror{"IncompleteBody", err.Error()}
+		}
+		setbody(data)
+		return trimchunked(r)
+	}
+	var cred, sig, date string
+	var headers []string
+	q := r.URL.Query()
+	req := &http.Request{Method: r.Method, URL: &url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery}, Host: r.Host, Header: r.Header}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, sigv4.Algorithm+" ") {
+		for _, kv := range strings.Split(strings.TrimPrefix(auth, sigv4.Algorithm+" "), ",") {
+			kv = strings.TrimSpace(kv)
+			switch {
+			case strings.HasPrefix(kv, "Credential="):
+				cred = strings.TrimPrefix(kv, "Credential=")
+			case strings.HasPrefix(kv, "SignedHeaders="):
+				headers = strings.Split(strings.TrimPrefix(kv, "SignedHeaders="), ";")
+			case strings.HasPrefix(kv, "Signature="):
+				sig = strings.TrimPrefix(kv, "Signature=")
+			}
+		}
+		date = r.Header.Get("X-Amz-Date")
+	} else if q.Get("X-Amz-Algorithm") == sigv4.Algorithm {
+		cred = q.Get("X-Amz-Credential")
+		headers = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+		sig = q.Get("X-Amz-Signature")
+		date = q.Get("X-Amz-Date")
+		payload = sigv4.UnsignedPayload
+		q.Del("X-Amz-Signature")
+		req.URL.RawQuery = q.Encode()
+	} else {
+		return &autherror{"AccessDenied", "signature v4 required"}
+	}
+	scope := strings.Split(cred, "/")
+	if len(scope) != 5 {
+		return &autherror{"AuthorizationHeaderMalformed", "invalid credential " + cred}
+	}
+	token := r.Header.Get("X-Amz-Security-Token")
+	if token == "" {
+		token = q.Get("X-Amz-Security-Token")
+	}
+	secret, aerr := s.secret(scope[0], token)
+	if aerr != nil {
+		return aerr
+	}
+	t, err := time.Parse(sigv4.TimeFormat, date)
+	if err != nil || t.Format("20060102") != scope[1] {
+		return &autherror{"AccessDenied", "invalid date " + date}
+	}
+	signer := &sigv4.Signer{AccessKey: scope[0], SecretKey: secret, Region: scope[2], Service: scope[3]}
+	if signer.Signature(req, t, headers, payload) != sig {
+		return &autherror{"SignatureDoesNotMatch", "signature does not match"}
+	}
+	switch payload {
+	case sigv4.UnsignedPayload:
+	case sigv4.StreamingPayload:
+		prev := sig
+		data, err := decodechunked(body, func(csig string, chunk []byte) bool {
+			ok := signer.ChunkSignature(t, prev, chunk) == csig
+			prev = csig
+			return ok
+		})
+		if err != nil {
+			return &autherror{"SignatureDoesNotMatch", err.Error()}
+		}
+		setbody(data)
+		return trimchunked(r)
+	default:
+		if sigv4.PayloadHash(body) != payload {
+			return &autherror{"XAmzContentSHA256Mismatch", "payload hash mismatch"}
+		}
+	}
+	return nil
+}
+
+// "hex(size);chunk-signature=sig\r\n" data "\r\n" ... until 0 size chunk
+func decodechunked(body []byte, verify func(sig string, data []byte) bool) ([]byte, error) {
+	var out bytes.Buffer
+	for {
+		idx := bytes.Index(body, []byte("\r\n"))
+		if idx == -1 {
+			return nil, fmt.Errorf("chunk header not found")
+		}
+		hdr := strings.SplitN(string(body[:idx]), ";chunk-signature=", 2)
+		body = body[idx+2:]
+		n, err := strconv.ParseInt(hdr[0], 16, 64)
+		if err != nil || len(hdr) != 2 || n < 0 || int64(len(body)) < n+2 {
+			return nil, fmt.Errorf("invalid chunk")
+		}
+		data := body[:n]
+		body = body[n+2:]
+		if verify != nil && !verify(hdr[1], data) {
+			return nil, fmt.Errorf("chunk signature does not match")
+		}
+		out.Write(data)
+		if n == 0 {
+			return out.Bytes(), nil
+		}
+	}
+}
+
+func trimchunked(r *http.Request) *autherror {
+	if dl := r.Header.Get("X-Amz-Decoded-Content-Length"); dl != strconv.FormatInt(r.ContentLength, 10) {
+		return &autherror{"IncompleteBody", "decoded length mismatch " + dl}
+	}
+	enc := []string{}
+	for _, v := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+		if v = strings.TrimSpace(v); v != "" && v != "aws-chunked" {
+			enc = append(enc, v)
+		}
+	}
+	if len(enc) == 0 {
+		r.Header.Del("Content-Encoding")
+	} else {
+		r.Header.Set("Content-Encoding", strings.Join(enc, ","))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package fakes3
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// GET, PUT and DELETE ?lifecycle. configuration is stored as sent
+func (s *Server) lifecycleop(w http.ResponseWriter, r *http.Request, bkt *bucket) {
+	switch r.Method {
+	case "GET":
+		if bkt.lifecycle == nil {
+			writeerr(w, r, http.StatusNotFound, "NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist")
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Length", strconv.Itoa(len(bkt.lifecycle)))
+		w.Write(bkt.lifecycle)
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeerr(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if r.Header.Get("Content-MD5") == "" {
+			writeerr(w, r, http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: Content-MD5")
+			return
+		}
+		if !checkmd5(r.Header, body) {
+			writeerr(w, r, http.StatusBadRequest, "BadDigest", "Content-MD5 mismatch")
+			return
+		}
+		var conf struct {
+			XMLName xml.Name `xml:"LifecycleConfiguration"`
+			Rules   []struct {
+				ID     string
+				Status string
+			} `xml:"Rule"`
+		}
+		if err := xml.Unmarshal(body, &conf); err != nil || len(conf.Rules) == 0 || len(conf.Rules) > 1000 {
+			writeerr(w, r, http.StatusBadRequest, "MalformedXML", "invalid LifecycleConfiguration")
+			return
+		}
+		for _, rule := range conf.Rules {
+			if rule.Status != "Enabled" && rule.Status != "Disabled" {
+				writeerr(w, r, http.StatusBadRequest, "MalformedXML", "invalid Status")
+				return
+			}
+		}
+		bkt.lifecycle = body
+	case "DELETE":
+		bkt.lifecycle = nil
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
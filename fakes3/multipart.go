@@ -0,0 +1,235 @@
+package fakes3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type part struct {
+	data []byte
+	etag string
+}
+
+type upload struct {
+	id      string
+	key     string
+	header  http.Header
+	acl     []byte
+	started time.Time
+	parts   map[int]*part
+}
+
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (s *Server) initmulti(w http.ResponseWriter, r *http.Request, bkt *bucket, key string) {
+	if _, ok := customerkey(w, r, ssecprefix); !ok {
+		return
+	}
+	up := &upload{id: s.newid(), key: key, header: reqheader(r.Header), acl: cannedacl(r.Header.Get("x-amz-acl")),
+		started: time.Now(), parts: map[int]*part{}}
+	bkt.uploads[up.id] = up
+	writexml(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3ns, Bucket: bkt.name, Key: key, UploadId: up.id})
+}
+
+func (s *Server) multiop(w http.ResponseWriter, r *http.Request, bkt *bucket, key string, q url.Values) {
+	up, ok := bkt.uploads[q.Get("uploadId")]
+	if !ok || up.key != key {
+		writeerr(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil || n < 1 || n > 10000 {
+			writeerr(w, r, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+			return
+		}
+		if !checkcustomerkey(w, r, up.header, ssecprefix) {
+			return
+		}
+		if r.Header.Get("x-amz-copy-source") != "" {
+			s.putpartcopy(w, r, up, n)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeerr(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if !checkmd5(r.Header, data) {
+			writeerr(w, r, http.StatusBadRequest, "BadDigest", "Content-MD5 mismatch")
+			return
+		}
+		p := &part{data: data, etag: md5hex(data)}
+		up.parts[n] = p
+		w.Header().Set("ETag", `"`+p.etag+`"`)
+	case "GET":
+		s.listparts(w, r, bkt, up)
+	case "POST":
+		s.complete(w, r, bkt, up)
+	case "DELETE":
+		delete(bkt.uploads, up.id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
+
+func (s *Server) putpartcopy(w http.ResponseWriter, r *http.Request, up *upload, n int) {
+	src := s.srcobj(w, r)
+	if src == nil {
+		return
+	}
+	data := src.data
+	if rng := r.Header.Get("x-amz-copy-source-range"); rng != "" {
+		first, last, ok := parserange(rng, int64(len(data)))
+		if !ok {
+			writeerr(w, r, http.StatusBadRequest, "InvalidArgument", "invalid copy source range")
+			return
+		}
+		data = data[first : last+1]
+	}
+	p := &part{data: data, etag: md5hex(data)}
+	up.parts[n] = p
+	writexml(w, struct {
+		XMLName xml.Name `xml:"CopyPartResult"`
+		copyresult
+	}{copyresult: copyresult{`"` + p.etag + `"`, time.Now().UTC().Format("2006-01-02T15:04:05.000Z")}})
+}
+
+func (s *Server) listparts(w http.ResponseWriter, r *http.Request, bkt *bucket, up *upload) {
+	type partinfo struct {
+		PartNumber int
+		ETag       string
+		Size       int64
+	}
+	res := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Key         string
+		UploadId    string
+		IsTruncated bool
+		Part        []partinfo
+	}{Xmlns: s3ns, Bucket: bkt.name, Key: up.key, UploadId: up.id}
+	nums := []int{}
+	for n, _ := range up.parts {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	for _, n := range nums {
+		res.Part = append(res.Part, partinfo{n, `"` + up.parts[n].etag + `"`, int64(len(up.parts[n].data))})
+	}
+	writexml(w, res)
+}
+
+func (s *Server) complete(w http.ResponseWriter, r *http.Request, bkt *bucket, up *upload) {
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeerr(w, r, http.StatusBadRequest, "MalformedXML", "invalid complete request")
+		return
+	}
+	var data, sums []byte
+	prev := 0
+	for i, rp := range req.Parts {
+		if rp.PartNumber <= prev {
+			writeerr(w, r, http.StatusBadRequest, "InvalidPartOrder", "parts must be in ascending order")
+			return
+		}
+		prev = rp.PartNumber
+		p, ok := up.parts[rp.PartNumber]
+		if !ok || strings.Trim(rp.ETag, `"`) != p.etag {
+			writeerr(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d not found", rp.PartNumber))
+			return
+		}
+		if i != len(req.Parts)-1 && int64(len(p.data)) < s.MinPartSize {
+			writeerr(w, r, http.StatusBadRequest, "EntityTooSmall", fmt.Sprintf("part %d too small", rp.PartNumber))
+			return
+		}
+		data = append(data, p.data...)
+		sum, _ := hex.DecodeString(p.etag)
+		sums = append(sums, sum...)
+	}
+	total := md5.Sum(sums)
+	obj := &object{data: data, etag: fmt.Sprintf("%s-%d", hex.EncodeToString(total[:]), len(req.Parts)),
+		lastmod: time.Now(), header: up.header, acl: up.acl}
+	s.putobject(bkt, up.key, obj)
+	setversionid(w, bkt, obj)
+	delete(bkt.uploads, up.id)
+	writexml(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Xmlns: s3ns, Bucket: bkt.name, Key: up.key, ETag: `"` + obj.etag + `"`})
+}
+
+func (s *Server) listuploads(w http.ResponseWriter, r *http.Request, bkt *bucket, q url.Values) {
+	type uploadinfo struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	ups := []*upload{}
+	names := []string{}
+	for _, up := range bkt.uploads {
+		ups = append(ups, up)
+		names = append(names, up.key)
+	}
+	sort.Slice(ups, func(i, j int) bool {
+		if ups[i].key != ups[j].key {
+			return ups[i].key < ups[j].key
+		}
+		return ups[i].id < ups[j].id
+	})
+	sort.Strings(names)
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	keys, prefixes, _, _ := listkeys(names, prefix, delim, q.Get("key-marker"), 1<<30)
+	match := map[string]bool{}
+	for _, k := range keys {
+		match[k] = true
+	}
+	res := struct {
+		XMLName        xml.Name `xml:"ListMultipartUploadsResult"`
+		Xmlns          string   `xml:"xmlns,attr"`
+		Bucket         string
+		Prefix         string
+		Delimiter      string `xml:",omitempty"`
+		IsTruncated    bool
+		Upload         []uploadinfo
+		CommonPrefixes []commonprefix
+	}{Xmlns: s3ns, Bucket: bkt.name, Prefix: prefix, Delimiter: delim}
+	for _, up := range ups {
+		if match[up.key] {
+			res.Upload = append(res.Upload, uploadinfo{up.key, up.id, up.started.UTC().Format("2006-01-02T15:04:05.000Z")})
+		}
+	}
+	for _, p := range prefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, commonprefix{p})
+	}
+	writexml(w, res)
+}
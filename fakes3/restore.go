@@ -0,0 +1,73 @@
+package fakes3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// objects of these classes need restore before GET or copy
+func archived(obj *object) bool {
+	switch obj.header.Get("X-Amz-Storage-Class") {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return true
+	}
+	return false
+}
+
+func restored(obj *object) bool {
+	return !obj.restoredone.IsZero() && !time.Now().Before(obj.restoredone) && time.Now().Before(obj.restoreexpiry)
+}
+
+// x-amz-restore of ongoing or finished restore
+func restoreheader(obj *object) string {
+	switch {
+	case obj.restoredone.IsZero():
+		return ""
+	case time.Now().Before(obj.restoredone):
+		return `ongoing-request="true"`
+	}
+	return fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`, obj.restoreexpiry.UTC().Format(http.TimeFormat))
+}
+
+// POST ?restore. finishes after RestoreDelay
+func (s *Server) restoreobj(w http.ResponseWriter, r *http.Request, obj *object) {
+	if !archived(obj) {
+		writeerr(w, r, http.StatusForbidden, "InvalidObjectState", "Restore is not allowed for the object's current storage class")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeerr(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	var req struct {
+		XMLName xml.Name `xml:"RestoreRequest"`
+		Days    int
+		Tier    string `xml:"GlacierJobParameters>Tier"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil || req.Days <= 0 {
+		writeerr(w, r, http.StatusBadRequest, "MalformedXML", "invalid RestoreRequest")
+		return
+	}
+	switch req.Tier {
+	case "", "Standard", "Bulk", "Expedited":
+	default:
+		writeerr(w, r, http.StatusBadRequest, "MalformedXML", "invalid Tier")
+		return
+	}
+	now := time.Now()
+	switch {
+	case !obj.restoredone.IsZero() && now.Before(obj.restoredone):
+		writeerr(w, r, http.StatusConflict, "RestoreAlreadyInProgress", "Object restore is already in progress")
+	case restored(obj):
+		obj.restoreexpiry = now.Add(time.Duration(req.Days) * 24 * time.Hour)
+		w.WriteHeader(http.StatusOK)
+	default:
+		obj.restoredone = now.Add(s.RestoreDelay)
+		obj.restoreexpiry = obj.restoredone.Add(time.Duration(req.Days) * 24 * time.Hour)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,781 @@
+// Package fakes3 is an in-memory S3 compatible server for tests.
+//
+// Only path-style requests are supported. Signature v4 is verified when Keys is set,
+// other signatures are not verified. POST / is a minimal STS for Roles.
+package fakes3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const s3ns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+const (
+	OwnerID   = "fakes3"
+	OwnerName = "fakes3"
+)
+
+// headers stored with object and returned by GET/HEAD
+var storedheaders = []string{
+	"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language",
+	"Cache-Control", "Expires", "X-Amz-Storage-Class", "X-Amz-Website-Redirect-Location",
+	"X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Customer-Algorithm", "X-Amz-Server-Side-Encryption-Customer-Key-Md5",
+}
+
+type object struct {
+	data    []byte
+	etag    string
+	lastmod time.Time
+	header  http.Header
+	acl     []byte
+	// restore of archived object finishes at restoredone
+	restoredone   time.Time
+	restoreexpiry time.Time
+	// "null" unless written in versioning enabled bucket
+	versionid    string
+	deletemarker bool
+}
+
+type bucket struct {
+	name    string
+	created time.Time
+	objects map[string]*object
+	uploads map[string]*upload
+	acl     []byte
+	// "", Enabled or Suspended
+	versioning string
+	// all versions of key, oldest first. current object is in objects
+	versions map[string][]*object
+	// LifecycleConfiguration xml
+	lifecycle []byte
+	// key -> error code of DeleteObjects
+	delerrors map[string]string
+}
+
+type Server struct {
+	URL string
+	// parts except the last must be at least this size
+	MinPartSize int64
+	// access key -> secret key. requests must be signed with v4 if set
+	Keys map[string]string
+	// role arn -> role for STS. issued credentials are accepted as Keys
+	Roles map[string]Role
+	// mfa serial -> code accepted by GetSessionToken
+	MFA map[string]string
+	// time until restore of archived objects finishes
+	RestoreDelay time.Duration
+
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	sessions map[string]session
+	seq      int
+	srv      *httptest.Server
+}
+
+func New() *Server {
+	return &Server{MinPartSize: 5 * 1024 * 1024, buckets: map[string]*bucket{}}
+}
+
+// Start listens on random local port
+func Start() *Server {
+	s := New()
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+}
+
+type s3error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+func writeerr(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	xml.NewEncoder(w).Encode(s3error{Code: code, Message: msg, Resource: r.URL.Path})
+}
+
+func writexml(w http.ResponseWriter, v interface{}) {
+	buf, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(buf)))
+	io.WriteString(w, xml.Header)
+	w.Write(buf)
+}
+
+func md5hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) newid() string {
+	s.seq += 1
+	return fmt.Sprintf("%016x%08x", time.Now().UnixNano(), s.seq)
+}
+
+// split path into bucket and key. subresource in path (goamz "?location") goes to query
+func splitpath(r *http.Request) (string, string, url.Values) {
+	q := r.URL.Query()
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	bkt, key := p, ""
+	if idx := strings.Index(p, "/"); idx != -1 {
+		bkt, key = p[:idx], p[idx+1:]
+	}
+	if idx := strings.Index(key, "?"); idx != -1 {
+		if sub, err := url.ParseQuery(key[idx+1:]); err == nil {
+			for k, v := range sub {
+				q[k] = v
+			}
+		}
+		key = strings.TrimPrefix(key[:idx], "/")
+	}
+	// query string authentication is not a subresource
+	for k := range q {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-") || k == "AWSAccessKeyId" || k == "Signature" || k == "Expires" {
+			q.Del(k)
+		}
+	}
+	return bkt, key, q
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == "/" {
+		s.sts(w, r)
+		return
+	}
+	if aerr := s.authenticate(r); aerr != nil {
+		writeerr(w, r, http.StatusForbidden, aerr.code, aerr.msg)
+		return
+	}
+	bktname, key, q := splitpath(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bktname == "" {
+		if r.Method != "GET" {
+			writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+			return
+		}
+		s.listbuckets(w, r)
+		return
+	}
+	if key == "" {
+		s.bucketop(w, r, bktname, q)
+		return
+	}
+	bkt, ok := s.buckets[bktname]
+	if !ok {
+		writeerr(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	s.objectop(w, r, bkt, key, q)
+}
+
+type owner struct {
+	ID          string
+	DisplayName string
+}
+
+func (s *Server) listbuckets(w http.ResponseWriter, r *http.Request) {
+	type bucketinfo struct {
+		Name         string
+		CreationDate string
+	}
+	res := struct {
+		XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+		Xmlns   string       `xml:"xmlns,attr"`
+		Owner   owner        `xml:"Owner"`
+		Buckets []bucketinfo `xml:"Buckets>Bucket"`
+	}{Xmlns: s3ns, Owner: owner{OwnerID, OwnerName}}
+	names := []string{}
+	for k, _ := range s.buckets {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		res.Buckets = append(res.Buckets, bucketinfo{k, s.buckets[k].created.UTC().Format("2006-01-02T15:04:05.000Z")})
+	}
+	writexml(w, res)
+}
+
+func (s *Server) bucketop(w http.ResponseWriter, r *http.Request, name string, q url.Values) {
+	bkt, ok := s.buckets[name]
+	if r.Method == "PUT" && len(q) == 0 {
+		if ok {
+			writeerr(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou", "bucket already exists")
+			return
+		}
+		s.buckets[name] = &bucket{name: name, created: time.Now(), objects: map[string]*object{}, uploads: map[string]*upload{},
+			versions: map[string][]*object{}, acl: cannedacl(r.Header.Get("x-amz-acl"))}
+		w.Header().Set("Location", "/"+name)
+		return
+	}
+	if !ok {
+		writeerr(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	switch {
+	case hasq(q, "acl"):
+		s.aclop(w, r, &bkt.acl)
+	case hasq(q, "location"):
+		if r.Method != "GET" {
+			writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+			return
+		}
+		writexml(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3ns})
+	case hasq(q, "uploads") && r.Method == "GET":
+		s.listuploads(w, r, bkt, q)
+	case hasq(q, "delete") && r.Method == "POST":
+		s.delmulti(w, r, bkt)
+	case hasq(q, "versioning"):
+		s.versioningop(w, r, bkt)
+	case hasq(q, "lifecycle"):
+		s.lifecycleop(w, r, bkt)
+	case hasq(q, "versions") && r.Method == "GET":
+		s.listversions(w, r, bkt, q)
+	case r.Method == "GET" && len(q["versions"]) == 0 && len(q["torrent"]) == 0:
+		s.list(w, r, bkt, q)
+	case r.Method == "HEAD":
+		return
+	case r.Method == "DELETE":
+		if len(bkt.versions) != 0 || len(bkt.uploads) != 0 {
+			writeerr(w, r, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+			return
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeerr(w, r, http.StatusNotImplemented, "NotImplemented", "not implemented")
+	}
+}
+
+func hasq(q url.Values, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+type listkey struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	Owner        owner
+}
+
+type commonprefix struct {
+	Prefix string
+}
+
+func (o *object) listkey(key string) listkey {
+	sc := o.header.Get("X-Amz-Storage-Class")
+	if sc == "" {
+		sc = "STANDARD"
+	}
+	return listkey{Key: key, LastModified: o.lastmod.UTC().Format("2006-01-02T15:04:05.000Z"),
+		ETag: `"` + o.etag + `"`, Size: int64(len(o.data)), StorageClass: sc, Owner: owner{OwnerID, OwnerName}}
+}
+
+// group sorted keys by delimiter. returns keys, prefixes, truncated and next marker
+func listkeys(names []string, prefix, delim, marker string, max int) ([]string, []string, bool, string) {
+	keys := []string{}
+	prefixes := []string{}
+	var last string
+	for _, k := range names {
+		if !strings.HasPrefix(k, prefix) || k <= marker {
+			continue
+		}
+		if delim != "" {
+			if idx := strings.Index(k[len(prefix):], delim); idx != -1 {
+				cp := k[:len(prefix)+idx+len(delim)]
+				if cp == last || cp <= marker {
+					continue
+				}
+				if len(keys)+len(prefixes) == max {
+					return keys, prefixes, true, last
+				}
+				prefixes = append(prefixes, cp)
+				last = cp
+				continue
+			}
+		}
+		if len(keys)+len(prefixes) == max {
+			return keys, prefixes, true, last
+		}
+		keys = append(keys, k)
+		last = k
+	}
+	return keys, prefixes, false, ""
+}
+
+func maxkeys(q url.Values, name string) int {
+	max := 1000
+	if v, err := strconv.Atoi(q.Get(name)); err == nil && v >= 0 && v < max {
+		max = v
+	}
+	return max
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bkt *bucket, q url.Values) {
+	names := []string{}
+	for k, _ := range bkt.objects {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	prefix, delim, marker := q.Get("prefix"), q.Get("delimiter"), q.Get("marker")
+	max := maxkeys(q, "max-keys")
+	keys, prefixes, truncated, next := listkeys(names, prefix, delim, marker, max)
+	res := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Xmlns          string   `xml:"xmlns,attr"`
+		Name           string
+		Prefix         string
+		Marker         string
+		NextMarker     string `xml:",omitempty"`
+		MaxKeys        int
+		Delimiter      string `xml:",omitempty"`
+		IsTruncated    bool
+		Contents       []listkey
+		CommonPrefixes []commonprefix
+	}{Xmlns: s3ns, Name: bkt.name, Prefix: prefix, Marker: marker, MaxKeys: max, Delimiter: delim,
+		IsTruncated: truncated, NextMarker: next}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, bkt.objects[k].listkey(k))
+	}
+	for _, p := range prefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, commonprefix{p})
+	}
+	writexml(w, res)
+}
+
+func (s *Server) delmulti(w http.ResponseWriter, r *http.Request, bkt *bucket) {
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key       string
+			VersionId string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeerr(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if len(req.Objects) > 1000 {
+		writeerr(w, r, http.StatusBadRequest, "MalformedXML", "too many objects")
+		return
+	}
+	type deleted struct {
+		Key                   string
+		VersionId             string `xml:",omitempty"`
+		DeleteMarker          bool   `xml:",omitempty"`
+		DeleteMarkerVersionId string `xml:",omitempty"`
+	}
+	type delerror struct {
+		Key       string
+		VersionId string `xml:",omitempty"`
+		Code      string
+		Message   string
+	}
+	res := struct {
+		XMLName xml.Name   `xml:"DeleteResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Deleted []deleted  `xml:"Deleted"`
+		Errors  []delerror `xml:"Error"`
+	}{Xmlns: s3ns}
+	for _, o := range req.Objects {
+		if code, ok := bkt.delerrors[o.Key]; ok {
+			res.Errors = append(res.Errors, delerror{o.Key, o.VersionId, code, "failed by FailDelete"})
+			continue
+		}
+		d := deleted{Key: o.Key, VersionId: o.VersionId}
+		if o.VersionId != "" {
+			if v := bkt.delversion(o.Key, o.VersionId); v != nil {
+				d.DeleteMarker = v.deletemarker
+			}
+		} else if marker := s.delobject(bkt, o.Key); marker != nil {
+			d.DeleteMarker, d.DeleteMarkerVersionId = true, marker.versionid
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, d)
+		}
+	}
+	writexml(w, res)
+}
+
+func (s *Server) objectop(w http.ResponseWriter, r *http.Request, bkt *bucket, key string, q url.Values) {
+	switch {
+	case hasq(q, "uploads") && r.Method == "POST":
+		s.initmulti(w, r, bkt, key)
+		return
+	case hasq(q, "uploadId"):
+		s.multiop(w, r, bkt, key, q)
+		return
+	}
+	obj, ok := bkt.objects[key]
+	if hasq(q, "acl") {
+		if !ok {
+			writeerr(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		s.aclop(w, r, &obj.acl)
+		return
+	}
+	if hasq(q, "restore") && r.Method == "POST" {
+		if !ok {
+			writeerr(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		s.restoreobj(w, r, obj)
+		return
+	}
+	vid := q.Get("versionId")
+	switch r.Method {
+	case "GET", "HEAD":
+		if vid != "" {
+			obj = bkt.version(key, vid)
+			if obj == nil {
+				writeerr(w, r, http.StatusNotFound, "NoSuchVersion", "The specified version does not exist.")
+				return
+			}
+			if obj.deletemarker {
+				w.Header().Set("x-amz-delete-marker", "true")
+				setversionid(w, bkt, obj)
+				writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+				return
+			}
+			ok = true
+		}
+		if !ok {
+			if vers := bkt.versions[key]; len(vers) != 0 && vers[len(vers)-1].deletemarker {
+				w.Header().Set("x-amz-delete-marker", "true")
+			}
+			writeerr(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		setversionid(w, bkt, obj)
+		if !checkcustomerkey(w, r, obj.header, ssecprefix) {
+			return
+		}
+		if r.Method == "GET" && archived(obj) && !restored(obj) {
+			writeerr(w, r, http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+			return
+		}
+		s.getobj(w, r, obj)
+	case "PUT":
+		if r.Header.Get("x-amz-copy-source") != "" {
+			s.copyobj(w, r, bkt, key)
+			return
+		}
+		if _, ok := customerkey(w, r, ssecprefix); !ok {
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeerr(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if cl := r.Header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(data)) {
+			writeerr(w, r, http.StatusBadRequest, "IncompleteBody", "content length mismatch")
+			return
+		}
+		obj := &object{data: data, etag: md5hex(data), lastmod: time.Now(), header: reqheader(r.Header),
+			acl: cannedacl(r.Header.Get("x-amz-acl"))}
+		if !checkmd5(r.Header, data) {
+			writeerr(w, r, http.StatusBadRequest, "BadDigest", "Content-MD5 mismatch")
+			return
+		}
+		s.putobject(bkt, key, obj)
+		setversionid(w, bkt, obj)
+		w.Header().Set("ETag", `"`+obj.etag+`"`)
+	case "DELETE":
+		if vid != "" {
+			if v := bkt.delversion(key, vid); v != nil && v.deletemarker {
+				w.Header().Set("x-amz-delete-marker", "true")
+			}
+			w.Header().Set("x-amz-version-id", vid)
+		} else if marker := s.delobject(bkt, key); marker != nil {
+			w.Header().Set("x-amz-delete-marker", "true")
+			setversionid(w, bkt, marker)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
+
+func checkmd5(hdr http.Header, data []byte) bool {
+	v := hdr.Get("Content-MD5")
+	if v == "" {
+		return true
+	}
+	sum := md5.Sum(data)
+	return v == b64(sum[:])
+}
+
+// pick stored headers and user metadata
+func reqheader(hdr http.Header) http.Header {
+	res := http.Header{}
+	for _, k := range storedheaders {
+		if v := hdr.Get(k); v != "" {
+			res.Set(k, v)
+		}
+	}
+	for k, v := range hdr {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			res[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	if res.Get("Content-Type") == "" {
+		res.Set("Content-Type", "binary/octet-stream")
+	}
+	return res
+}
+
+// bytes=first-last, bytes=first-, bytes=-suffix
+func parserange(v string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(v, "bytes=") || strings.Contains(v, ",") {
+		return 0, 0, false
+	}
+	v = strings.TrimPrefix(v, "bytes=")
+	idx := strings.Index(v, "-")
+	if idx == -1 {
+		return 0, 0, false
+	}
+	first, last := v[:idx], v[idx+1:]
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, size > 0
+	}
+	f, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || f >= size {
+		return 0, 0, false
+	}
+	l := size - 1
+	if last != "" {
+		if l, err = strconv.ParseInt(last, 10, 64); err != nil || l < f {
+			return 0, 0, false
+		}
+		if l >= size {
+			l = size - 1
+		}
+	}
+	return f, l, true
+}
+
+func (s *Server) getobj(w http.ResponseWriter, r *http.Request, obj *object) {
+	for k, v := range obj.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", `"`+obj.etag+`"`)
+	w.Header().Set("Last-Modified", obj.lastmod.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if v := restoreheader(obj); v != "" {
+		w.Header().Set("X-Amz-Restore", v)
+	}
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		first, last, ok := parserange(rng, int64(len(data)))
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			writeerr(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+		data = data[first : last+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+// "/bucket/key", "bucket/key" or QueryEscape'd form, optional ?versionId=
+func copysource(v string) (string, string, string, bool) {
+	var vid string
+	if idx := strings.Index(v, "?"); idx != -1 {
+		q, _ := url.ParseQuery(v[idx+1:])
+		v, vid = v[:idx], q.Get("versionId")
+	}
+	var src string
+	var err error
+	if strings.Contains(strings.ToUpper(v), "%2F") {
+		src, err = url.QueryUnescape(v)
+	} else {
+		src, err = url.PathUnescape(v)
+	}
+	if err != nil {
+		return "", "", "", false
+	}
+	src = strings.TrimPrefix(src, "/")
+	idx := strings.Index(src, "/")
+	if idx == -1 {
+		return "", "", "", false
+	}
+	return src[:idx], src[idx+1:], vid, true
+}
+
+func (s *Server) srcobj(w http.ResponseWriter, r *http.Request) *object {
+	sbkt, skey, vid, ok := copysource(r.Header.Get("x-amz-copy-source"))
+	if !ok {
+		writeerr(w, r, http.StatusBadRequest, "InvalidArgument", "invalid copy source")
+		return nil
+	}
+	b, ok := s.buckets[sbkt]
+	if !ok {
+		writeerr(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return nil
+	}
+	obj, ok := b.objects[skey]
+	if vid != "" {
+		obj = b.version(skey, vid)
+		if obj == nil || obj.deletemarker {
+			writeerr(w, r, http.StatusNotFound, "NoSuchVersion", "The specified version does not exist.")
+			return nil
+		}
+		ok = true
+	}
+	if !ok {
+		writeerr(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return nil
+	}
+	if !checkcustomerkey(w, r, obj.header, copyssecprefix) {
+		return nil
+	}
+	if archived(obj) && !restored(obj) {
+		writeerr(w, r, http.StatusForbidden, "InvalidObjectState", "The source object of the COPY action is not in the active tier")
+		return nil
+	}
+	return obj
+}
+
+type copyresult struct {
+	ETag         string
+	LastModified string
+}
+
+func (s *Server) copyobj(w http.ResponseWriter, r *http.Request, bkt *bucket, key string) {
+	src := s.srcobj(w, r)
+	if src == nil {
+		return
+	}
+	if _, ok := customerkey(w, r, ssecprefix); !ok {
+		return
+	}
+	obj := &object{data: src.data, etag: src.etag, lastmod: time.Now(), acl: cannedacl(r.Header.Get("x-amz-acl"))}
+	if strings.ToUpper(r.Header.Get("x-amz-metadata-directive")) == "REPLACE" {
+		obj.header = reqheader(r.Header)
+	} else {
+		obj.header = http.Header{}
+		for k, v := range src.header {
+			obj.header[k] = v
+		}
+		if sc := r.Header.Get("X-Amz-Storage-Class"); sc != "" {
+			obj.header.Set("X-Amz-Storage-Class", sc)
+		}
+	}
+	setencryption(obj.header, r)
+	s.putobject(bkt, key, obj)
+	setversionid(w, bkt, obj)
+	writexml(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		copyresult
+	}{copyresult: copyresult{`"` + obj.etag + `"`, obj.lastmod.UTC().Format("2006-01-02T15:04:05.000Z")}})
+}
+
+// FailDelete makes DeleteObjects report error code for key. empty code clears it
+func (s *Server) FailDelete(bktname, key, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bkt, ok := s.buckets[bktname]
+	if !ok {
+		return
+	}
+	if bkt.delerrors == nil {
+		bkt.delerrors = map[string]string{}
+	}
+	if code == "" {
+		delete(bkt.delerrors, key)
+	} else {
+		bkt.delerrors[key] = code
+	}
+}
+
+// Objects returns sorted keys of bucket, nil if no such bucket
+func (s *Server) Objects(bktname string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bkt, ok := s.buckets[bktname]
+	if !ok {
+		return nil
+	}
+	res := []string{}
+	for k, _ := range bkt.objects {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Object returns content and stored headers of key
+func (s *Server) Object(bktname, key string) ([]byte, http.Header, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bkt, ok := s.buckets[bktname]
+	if !ok {
+		return nil, nil, false
+	}
+	obj, ok := bkt.objects[key]
+	if !ok {
+		return nil, nil, false
+	}
+	hdr := http.Header{}
+	for k, v := range obj.header {
+		hdr[k] = v
+	}
+	hdr.Set("ETag", `"`+obj.etag+`"`)
+	if v := restoreheader(obj); v != "" {
+		hdr.Set("X-Amz-Restore", v)
+	}
+	return bytes.Clone(obj.data), hdr, true
+}
@@ -0,0 +1,72 @@
+package fakes3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	ssecprefix     = "X-Amz-Server-Side-Encryption-Customer-"
+	copyssecprefix = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-"
+)
+
+// headers of object encryption, decided by each write request
+var encheaders = []string{
+	"X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	ssecprefix + "Algorithm", ssecprefix + "Key-Md5",
+}
+
+// md5 of SSE-C key in headers with prefix, "" if not encrypted with customer key
+func customerkey(w http.ResponseWriter, r *http.Request, prefix string) (string, bool) {
+	algo := r.Header.Get(prefix + "Algorithm")
+	if algo == "" {
+		return "", true
+	}
+	if algo != "AES256" {
+		writeerr(w, r, http.StatusBadRequest, "InvalidEncryptionAlgorithmError", "The encryption request you specified is not valid. The valid value is AES256.")
+		return "", false
+	}
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get(prefix + "Key"))
+	if err != nil || len(key) != 32 {
+		writeerr(w, r, http.StatusBadRequest, "InvalidArgument", "The secret key was invalid for the specified algorithm.")
+		return "", false
+	}
+	sum := md5.Sum(key)
+	if b64(sum[:]) != r.Header.Get(prefix+"Key-Md5") {
+		writeerr(w, r, http.StatusBadRequest, "InvalidArgument", "The calculated MD5 hash of the key did not match the hash that was provided.")
+		return "", false
+	}
+	return b64(sum[:]), true
+}
+
+// request must have SSE-C key of stored header
+func checkcustomerkey(w http.ResponseWriter, r *http.Request, stored http.Header, prefix string) bool {
+	sum, ok := customerkey(w, r, prefix)
+	if !ok {
+		return false
+	}
+	switch stored.Get(ssecprefix + "Key-Md5") {
+	case sum:
+		return true
+	case "":
+		writeerr(w, r, http.StatusBadRequest, "InvalidArgument", "The object was not encrypted with customer provided key.")
+	default:
+		if sum == "" {
+			writeerr(w, r, http.StatusBadRequest, "InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+		} else {
+			writeerr(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+		}
+	}
+	return false
+}
+
+// replace encryption headers of copied object with request
+func setencryption(hdr http.Header, r *http.Request) {
+	for _, k := range encheaders {
+		hdr.Del(k)
+		if v := r.Header.Get(k); v != "" {
+			hdr.Set(k, v)
+		}
+	}
+}
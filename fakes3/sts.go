@@ -0,0 +1,191 @@
+package fakes3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stsns = "https://sts.amazonaws.com/doc/2011-06-15/"
+
+// Role assumable by STS AssumeRole (signed) or AssumeRoleWithWebIdentity.
+// non-empty fields must match the request. TokenCode is not needed when
+// signed by mfa session of GetSessionToken
+type Role struct {
+	ExternalId       string
+	TokenCode        string
+	WebIdentityToken string
+}
+
+// temporary credentials issued by STS
+type session struct {
+	secret string
+	token  string
+	exp    time.Time
+	// issued by GetSessionToken with mfa code
+	mfa bool
+}
+
+// secret of access key. temporary credentials need valid unexpired token
+func (s *Server) secret(akey, token string) (string, *autherror) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if secret, ok := s.Keys[akey]; ok {
+		return secret, nil
+	}
+	sess, ok := s.sessions[akey]
+	if !ok {
+		return "", &autherror{"InvalidAccessKeyId", "unknown access key " + akey}
+	}
+	if sess.token != token {
+		return "", &autherror{"InvalidToken", "invalid security token"}
+	}
+	if time.Now().After(sess.exp) {
+		return "", &autherror{"ExpiredToken", "The provided token has expired."}
+	}
+	return sess.secret, nil
+}
+
+// Sessions is number of issued temporary credentials
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// request is signed by temporary credentials authenticated with mfa
+func (s *Server) mfasession(r *http.Request) bool {
+	cred := r.Header.Get("Authorization")
+	idx := strings.Index(cred, "Credential=")
+	if idx == -1 {
+		return false
+	}
+	akey := strings.SplitN(cred[idx+len("Credential="):], "/", 2)[0]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[akey].mfa
+}
+
+func stserr(w http.ResponseWriter, status int, code, msg string) {
+	res := struct {
+		XMLName xml.Name `xml:"ErrorResponse"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Type    string   `xml:"Error>Type"`
+		Code    string   `xml:"Error>Code"`
+		Message string   `xml:"Error>Message"`
+	}{Xmlns: stsns, Type: "Sender", Code: code, Message: msg}
+	buf, _ := xml.Marshal(res)
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// POST / with Action=AssumeRole, AssumeRoleWithWebIdentity or GetSessionToken
+func (s *Server) sts(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		stserr(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		stserr(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	action := form.Get("Action")
+	s.mu.Lock()
+	role, ok := s.Roles[form.Get("RoleArn")]
+	s.mu.Unlock()
+	switch action {
+	case "AssumeRole":
+		if aerr := s.authenticate(r); aerr != nil {
+			stserr(w, http.StatusForbidden, aerr.code, aerr.msg)
+			return
+		}
+		if !ok || form.Get("ExternalId") != role.ExternalId {
+			stserr(w, http.StatusForbidden, "AccessDenied", "not authorized to assume "+form.Get("RoleArn"))
+			return
+		}
+		if role.TokenCode != "" && !s.mfasession(r) && (form.Get("SerialNumber") == "" || form.Get("TokenCode") != role.TokenCode) {
+			stserr(w, http.StatusForbidden, "AccessDenied", "MultiFactorAuthentication failed")
+			return
+		}
+	case "AssumeRoleWithWebIdentity":
+		if !ok || role.WebIdentityToken == "" || form.Get("WebIdentityToken") != role.WebIdentityToken {
+			stserr(w, http.StatusForbidden, "InvalidIdentityToken", "invalid web identity token")
+			return
+		}
+	case "GetSessionToken":
+		if aerr := s.authenticate(r); aerr != nil {
+			stserr(w, http.StatusForbidden, aerr.code, aerr.msg)
+			return
+		}
+		s.mu.Lock()
+		code, ok := s.MFA[form.Get("SerialNumber")]
+		s.mu.Unlock()
+		if form.Get("SerialNumber") != "" && (!ok || form.Get("TokenCode") != code) {
+			stserr(w, http.StatusForbidden, "AccessDenied", "MultiFactorAuthentication failed")
+			return
+		}
+	default:
+		stserr(w, http.StatusBadRequest, "InvalidAction", "unknown action "+action)
+		return
+	}
+	if form.Get("RoleSessionName") == "" && action != "GetSessionToken" {
+		stserr(w, http.StatusBadRequest, "ValidationError", "RoleSessionName is required")
+		return
+	}
+	duration := 3600
+	if v := form.Get("DurationSeconds"); v != "" {
+		if duration, err = strconv.Atoi(v); err != nil || duration <= 0 {
+			stserr(w, http.StatusBadRequest, "ValidationError", "invalid DurationSeconds "+v)
+			return
+		}
+	}
+	s.mu.Lock()
+	id := s.newid()
+	akey := "ASIA" + id
+	sess := session{secret: "secret" + id, token: "token" + id, exp: time.Now().Add(time.Duration(duration) * time.Second),
+		mfa: action == "GetSessionToken" && form.Get("SerialNumber") != ""}
+	if s.sessions == nil {
+		s.sessions = map[string]session{}
+	}
+	s.sessions[akey] = sess
+	s.mu.Unlock()
+	type credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	type result struct {
+		XMLName     xml.Name
+		Credentials credentials
+	}
+	res := struct {
+		XMLName xml.Name
+		Xmlns   string `xml:"xmlns,attr"`
+		Result  result
+	}{
+		XMLName: xml.Name{Local: action + "Response"},
+		Xmlns:   stsns,
+		Result: result{
+			XMLName:     xml.Name{Local: action + "Result"},
+			Credentials: credentials{akey, sess.secret, sess.token, sess.exp.UTC().Format(time.RFC3339)},
+		},
+	}
+	buf, err := xml.Marshal(res)
+	if err != nil {
+		stserr(w, http.StatusInternalServerError, "InternalFailure", fmt.Sprint(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf)
+}
@@ -0,0 +1,210 @@
+package fakes3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// store obj as current version of key. version id is "null" unless versioning is enabled
+func (s *Server) putobject(bkt *bucket, key string, obj *object) {
+	obj.versionid = "null"
+	if bkt.versioning == "Enabled" {
+		obj.versionid = s.newid()
+	}
+	bkt.addversion(key, obj)
+	bkt.objects[key] = obj
+}
+
+// DELETE without version id. returns delete marker of versioned bucket
+func (s *Server) delobject(bkt *bucket, key string) *object {
+	delete(bkt.objects, key)
+	if bkt.versioning == "" {
+		delete(bkt.versions, key)
+		return nil
+	}
+	marker := &object{deletemarker: true, lastmod: time.Now(), versionid: "null"}
+	if bkt.versioning == "Enabled" {
+		marker.versionid = s.newid()
+	}
+	bkt.addversion(key, marker)
+	return marker
+}
+
+// null version is replaced
+func (b *bucket) addversion(key string, obj *object) {
+	vers := []*object{}
+	for _, v := range b.versions[key] {
+		if obj.versionid != "null" || v.versionid != "null" {
+			vers = append(vers, v)
+		}
+	}
+	b.versions[key] = append(vers, obj)
+}
+
+func (b *bucket) version(key, vid string) *object {
+	for _, v := range b.versions[key] {
+		if v.versionid == vid {
+			return v
+		}
+	}
+	return nil
+}
+
+// DELETE ?versionId. latest remaining version becomes current
+func (b *bucket) delversion(key, vid string) *object {
+	vers := b.versions[key]
+	var removed *object
+	for i, v := range vers {
+		if v.versionid == vid {
+			removed = v
+			vers = append(vers[:i:i], vers[i+1:]...)
+			break
+		}
+	}
+	if removed == nil {
+		return nil
+	}
+	delete(b.objects, key)
+	if len(vers) == 0 {
+		delete(b.versions, key)
+		return removed
+	}
+	b.versions[key] = vers
+	if last := vers[len(vers)-1]; !last.deletemarker {
+		b.objects[key] = last
+	}
+	return removed
+}
+
+// version id header of object in versioned bucket
+func setversionid(w http.ResponseWriter, bkt *bucket, obj *object) {
+	if bkt.versioning != "" && obj != nil {
+		w.Header().Set("x-amz-version-id", obj.versionid)
+	}
+}
+
+func (s *Server) versioningop(w http.ResponseWriter, r *http.Request, bkt *bucket) {
+	type config struct {
+		XMLName xml.Name `xml:"VersioningConfiguration"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Status  string   `xml:",omitempty"`
+	}
+	switch r.Method {
+	case "GET":
+		writexml(w, config{Xmlns: s3ns, Status: bkt.versioning})
+	case "PUT":
+		var req config
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeerr(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		switch req.Status {
+		case "Enabled", "Suspended":
+			bkt.versioning = req.Status
+		default:
+			writeerr(w, r, http.StatusBadRequest, "MalformedXML", "invalid Status")
+		}
+	default:
+		writeerr(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
+
+type versionentry struct {
+	XMLName      xml.Name
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         *int64 `xml:",omitempty"`
+	StorageClass string `xml:",omitempty"`
+	Owner        owner
+}
+
+func versionof(key string, obj *object, latest bool) versionentry {
+	e := versionentry{XMLName: xml.Name{Local: "DeleteMarker"}, Key: key, VersionId: obj.versionid, IsLatest: latest,
+		LastModified: obj.lastmod.UTC().Format("2006-01-02T15:04:05.000Z"), Owner: owner{OwnerID, OwnerName}}
+	if !obj.deletemarker {
+		lk := obj.listkey(key)
+		e.XMLName.Local, e.ETag, e.Size, e.StorageClass = "Version", lk.ETag, &lk.Size, lk.StorageClass
+	}
+	return e
+}
+
+// GET ?versions. versions of a key are newest first
+func (s *Server) listversions(w http.ResponseWriter, r *http.Request, bkt *bucket, q url.Values) {
+	names := []string{}
+	for k := range bkt.versions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	keymarker, vermarker := q.Get("key-marker"), q.Get("version-id-marker")
+	max := maxkeys(q, "max-keys")
+	res := struct {
+		XMLName             xml.Name `xml:"ListVersionsResult"`
+		Xmlns               string   `xml:"xmlns,attr"`
+		Name                string
+		Prefix              string
+		KeyMarker           string
+		VersionIdMarker     string
+		NextKeyMarker       string `xml:",omitempty"`
+		NextVersionIdMarker string `xml:",omitempty"`
+		MaxKeys             int
+		Delimiter           string `xml:",omitempty"`
+		IsTruncated         bool
+		Entries             []versionentry
+		CommonPrefixes      []commonprefix
+	}{Xmlns: s3ns, Name: bkt.name, Prefix: prefix, KeyMarker: keymarker, VersionIdMarker: vermarker,
+		MaxKeys: max, Delimiter: delim}
+	count := 0
+	full := func(key, vid string) bool {
+		if count < max {
+			count += 1
+			return false
+		}
+		res.IsTruncated, res.NextKeyMarker, res.NextVersionIdMarker = true, key, vid
+		return true
+	}
+	var lastprefix, lastkey, lastvid string
+	for _, k := range names {
+		if !strings.HasPrefix(k, prefix) || k < keymarker || k == keymarker && vermarker == "" {
+			continue
+		}
+		if delim != "" {
+			if idx := strings.Index(k[len(prefix):], delim); idx != -1 {
+				cp := k[:len(prefix)+idx+len(delim)]
+				if cp == lastprefix || cp <= keymarker {
+					continue
+				}
+				if full(lastkey, lastvid) {
+					break
+				}
+				res.CommonPrefixes = append(res.CommonPrefixes, commonprefix{cp})
+				lastprefix, lastkey, lastvid = cp, cp, ""
+				continue
+			}
+		}
+		vers := bkt.versions[k]
+		skip := k == keymarker
+		for i := len(vers) - 1; i >= 0; i-- {
+			if skip {
+				skip = vers[i].versionid != vermarker
+				continue
+			}
+			if full(lastkey, lastvid) {
+				break
+			}
+			res.Entries = append(res.Entries, versionof(k, vers[i], i == len(vers)-1))
+			lastkey, lastvid = k, vers[i].versionid
+		}
+		if res.IsTruncated {
+			break
+		}
+	}
+	writexml(w, res)
+}
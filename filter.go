@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+type pathmatcher func(name string) bool
+
+type pathfilter struct {
+	include []pathmatcher
+	exclude []pathmatcher
+}
+
+var pathflt = &pathfilter{}
+
+var filterflags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "include files matching glob pattern",
+	},
+	cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "exclude files matching glob pattern (pattern/ matches directory)",
+	},
+	cli.StringSliceFlag{
+		Name:  "rinclude",
+		Usage: "include files matching regexp",
+	},
+	cli.StringSliceFlag{
+		Name:  "rexclude",
+		Usage: "exclude files matching regexp",
+	},
+	cli.StringSliceFlag{
+		Name:  "exclude-from",
+		Usage: "read exclude glob patterns from file",
+	},
+}
+
+func globmatcher(pat string) (pathmatcher, error) {
+	if _, err := path.Match(pat, ""); err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(pat, "/") {
+		// directory: match any parent component
+		dirpat := strings.TrimSuffix(pat, "/")
+		return func(name string) bool {
+			dirs := strings.Split(path.Dir(name), "/")
+			for i := range dirs {
+				if ok, _ := path.Match(dirpat, strings.Join(dirs[:i+1], "/")); ok {
+					return true
+				}
+				if ok, _ := path.Match(dirpat, dirs[i]); ok && !strings.Contains(dirpat, "/") {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return func(name string) bool {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+		if !strings.Contains(pat, "/") {
+			ok, _ := path.Match(pat, path.Base(name))
+			return ok
+		}
+		return false
+	}, nil
+}
+
+func regexmatcher(pat string) (pathmatcher, error) {
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+func readpatterns(fn string) ([]string, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	res := []string{}
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res = append(res, line)
+	}
+	return res, scanner.Err()
+}
+
+func newpathfilter(c *cli.Context) (*pathfilter, error) {
+	f := &pathfilter{}
+	excludes := c.StringSlice("exclude")
+	for _, fn := range c.StringSlice("exclude-from") {
+		pats, err := readpatterns(fn)
+		if err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, pats...)
+	}
+	for _, pat := range excludes {
+		m, err := globmatcher(pat)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, m)
+	}
+	for _, pat := range c.StringSlice("include") {
+		m, err := globmatcher(pat)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, m)
+	}
+	for _, pat := range c.StringSlice("rexclude") {
+		m, err := regexmatcher(pat)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, m)
+	}
+	for _, pat := range c.StringSlice("rinclude") {
+		m, err := regexmatcher(pat)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, m)
+	}
+	return f, nil
+}
+
+func matchany(ms []pathmatcher, name string) bool {
+	for _, m := range ms {
+		if m(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// include wins over exclude. include only: whitelist
+func (f *pathfilter) match(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.exclude) == 0 {
+		return len(f.include) == 0 || matchany(f.include, name)
+	}
+	if matchany(f.exclude, name) {
+		return matchany(f.include, name)
+	}
+	return true
+}
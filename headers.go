@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+var headerflags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "meta",
+		Usage: "user metadata key=value of uploads (repeatable)",
+	},
+	cli.StringSliceFlag{
+		Name:  "header",
+		Usage: "'Name: value' of uploads: Cache-Control, Content-Disposition, Content-Encoding, Content-Type, Expires, x-amz-website-redirect-location, x-amz-meta-* (repeatable)",
+	},
+}
+
+var headerruleflags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "header-rules",
+		Usage: "file of 'glob Name: value' lines, headers of matching files",
+	},
+}
+
+type headerrule struct {
+	pat   string
+	name  string
+	value string
+}
+
+// options of uploads. header has what s3.Options can not carry (Expires)
+type putopts struct {
+	s3.Options
+	header http.Header
+}
+
+// headers of uploads. rules override --header and --meta
+var hdropt struct {
+	hdr   http.Header
+	rules []headerrule
+}
+
+// header name and value, checked against what uploads can send
+func parseheader(s string) (string, string, error) {
+	idx := strings.Index(s, ":")
+	if idx <= 0 {
+		return "", "", fmt.Errorf("invalid header: %s", s)
+	}
+	name := http.CanonicalHeaderKey(strings.TrimSpace(s[:idx]))
+	value := strings.TrimSpace(s[idx+1:])
+	switch {
+	case strings.HasPrefix(name, "X-Amz-Meta-") && len(name) > len("X-Amz-Meta-"):
+	case name == "Cache-Control", name == "Content-Disposition", name == "Content-Encoding",
+		name == "Content-Type", name == "Expires", name == "X-Amz-Website-Redirect-Location":
+	default:
+		return "", "", fmt.Errorf("unsupported header: %s", name)
+	}
+	return name, value, nil
+}
+
+// lines of 'glob Name: value'
+func readheaderrules(fn string) ([]headerrule, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	res := []headerrule{}
+	scanner := bufio.NewScanner(fp)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: no header", fn, n)
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, n, err)
+		}
+		name, value, err := parseheader(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, n, err)
+		}
+		res = append(res, headerrule{fields[0], name, value})
+	}
+	return res, scanner.Err()
+}
+
+func headersetup(c *cli.Context) error {
+	hdropt.hdr, hdropt.rules = http.Header{}, nil
+	for _, s := range c.StringSlice("meta") {
+		idx := strings.Index(s, "=")
+		if idx <= 0 {
+			return usageerr("invalid meta: %s", s)
+		}
+		hdropt.hdr.Set("X-Amz-Meta-"+s[:idx], s[idx+1:])
+	}
+	for _, s := range c.StringSlice("header") {
+		name, value, err := parseheader(s)
+		if err != nil {
+			return usageerr("%v", err)
+		}
+		hdropt.hdr.Set(name, value)
+	}
+	for _, fn := range c.StringSlice("header-rules") {
+		rules, err := readheaderrules(fn)
+		if err != nil {
+			return usageerr("header rules: %v", err)
+		}
+		hdropt.rules = append(hdropt.rules, rules...)
+	}
+	return nil
+}
+
+// glob without slash matches file name, with slash matches trailing path
+func rulematch(pat, name string) bool {
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i := range parts {
+		if ok, _ := path.Match(pat, strings.Join(parts[i:], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// --header, --meta and matching rules of file name
+func uploadheaders(name string) http.Header {
+	hdr := http.Header{}
+	for k, v := range hdropt.hdr {
+		hdr[k] = v
+	}
+	for _, r := range hdropt.rules {
+		if rulematch(r.pat, name) {
+			hdr.Set(r.name, r.value)
+		}
+	}
+	return hdr
+}
+
+// content type and options of upload of file name
+func uploadoptions(name, ctyp string, opts putopts) (string, putopts) {
+	if classopt != "" {
+		opts.StorageClass = classopt
+	}
+	return headeroptions(uploadheaders(name), ctyp, opts)
+}
+
+// content type and options with headers of hdr added
+func headeroptions(hdr http.Header, ctyp string, opts putopts) (string, putopts) {
+	if len(hdr) == 0 {
+		return ctyp, opts
+	}
+	meta := map[string][]string{}
+	for k, v := range opts.Meta {
+		meta[k] = v
+	}
+	raw := http.Header{}
+	for k, v := range opts.header {
+		raw[k] = v
+	}
+	for k, v := range hdr {
+		switch k {
+		case "Content-Type":
+			ctyp = v[0]
+		case "Cache-Control":
+			opts.CacheControl = v[0]
+		case "Content-Disposition":
+			opts.ContentDisposition = v[0]
+		case "Content-Encoding":
+			opts.ContentEncoding = v[0]
+		case "X-Amz-Website-Redirect-Location":
+			opts.RedirectLocation = v[0]
+		case "Content-Language", "Expires":
+			raw[k] = v
+		default:
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				meta[strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))] = v
+			}
+		}
+	}
+	if len(meta) != 0 {
+		opts.Meta = meta
+	}
+	if len(raw) != 0 {
+		opts.header = raw
+	}
+	return ctyp, opts
+}
+
+// InitMulti with encryption and raw headers
+func initmultipart(bkt *s3.Bucket, key, ctyp string, opts putopts) (*s3.Multi, error) {
+	opts.Options = sseoptions(opts.Options)
+	if len(opts.header) == 0 {
+		var multi *s3.Multi
+		err := retry("initmulti s3://"+bkt.Name+"/"+key, func() (err error) {
+			multi, err = bkt.InitMulti(key, ctyp, s3.Private, opts.Options)
+			return
+		})
+		return multi, err
+	}
+	return initmultiheader(bkt, key, putheaders(ctyp, opts))
+}
+
+// InitMulti with all headers of the object
+func initmultiheader(bkt *s3.Bucket, key string, hdr http.Header) (multi *s3.Multi, err error) {
+	err = retry("initmulti s3://"+bkt.Name+"/"+key, func() error {
+		rsp, err := s3do(bkt, "POST", key, url.Values{"uploads": {""}}, hdr, nil)
+		if err != nil {
+			return err
+		}
+		defer rsp.Body.Close()
+		var res struct {
+			UploadId string
+		}
+		if err := xml.NewDecoder(rsp.Body).Decode(&res); err != nil {
+			return err
+		}
+		multi = &s3.Multi{Bucket: bkt, Key: key, UploadId: res.UploadId}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// rule file, YAML or JSON
+type lcfile struct {
+	Rules []lcrule `json:"rules" yaml:"rules"`
+}
+
+type lcrule struct {
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+	// enabled (default) or disabled
+	Status string            `json:"status,omitempty" yaml:"status,omitempty"`
+	Prefix string            `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// YYYY-MM-DD
+	ExpireDate            string         `json:"expire_date,omitempty" yaml:"expire_date,omitempty"`
+	ExpireDays            int            `json:"expire_days,omitempty" yaml:"expire_days,omitempty"`
+	ExpiredDeleteMarker   bool           `json:"expired_delete_marker,omitempty" yaml:"expired_delete_marker,omitempty"`
+	Transitions           []lctransition `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+	NoncurrentExpireDays  int            `json:"noncurrent_expire_days,omitempty" yaml:"noncurrent_expire_days,omitempty"`
+	NoncurrentTransitions []lctransition `json:"noncurrent_transitions,omitempty" yaml:"noncurrent_transitions,omitempty"`
+	AbortMultipartDays    int            `json:"abort_multipart_days,omitempty" yaml:"abort_multipart_days,omitempty"`
+}
+
+type lctransition struct {
+	Days  int    `json:"days,omitempty" yaml:"days,omitempty"`
+	Date  string `json:"date,omitempty" yaml:"date,omitempty"`
+	Class string `json:"class" yaml:"class"`
+}
+
+// classes objects can transition into
+var lcclasses = []string{"STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"}
+
+const lcdate = "2006-01-02"
+
+func (t lctransition) check(noncurrent bool) error {
+	valid := false
+	for _, c := range lcclasses {
+		valid = valid || c == t.Class
+	}
+	if !valid {
+		return fmt.Errorf("invalid transition class %s, choose from %s", t.Class, strings.Join(lcclasses, ","))
+	}
+	if t.Date != "" {
+		if noncurrent {
+			return errors.New("noncurrent transition has no date")
+		}
+		if t.Days != 0 {
+			return errors.New("transition has both days and date")
+		}
+		if _, err := time.Parse(lcdate, t.Date); err != nil {
+			return fmt.Errorf("invalid transition date: %s", t.Date)
+		}
+		return nil
+	}
+	if t.Days < 0 || noncurrent && t.Days == 0 {
+		return fmt.Errorf("invalid transition days: %d", t.Days)
+	}
+	if (t.Class == "STANDARD_IA" || t.Class == "ONEZONE_IA") && t.Days < 30 {
+		return fmt.Errorf("transition to %s needs 30 days or more", t.Class)
+	}
+	return nil
+}
+
+// each class once, all by days in ascending order or all by dates. returns last days
+func checktransitions(ts []lctransition, noncurrent bool) (int, error) {
+	seen := map[string]bool{}
+	dated := 0
+	last := -1
+	for _, t := range ts {
+		if err := t.check(noncurrent); err != nil {
+			return 0, err
+		}
+		if seen[t.Class] {
+			return 0, fmt.Errorf("duplicate transition to %s", t.Class)
+		}
+		seen[t.Class] = true
+		if t.Date != "" {
+			dated += 1
+			continue
+		}
+		if t.Days <= last {
+			return 0, errors.New("transitions are not in ascending days")
+		}
+		last = t.Days
+	}
+	if dated != 0 && dated != len(ts) {
+		return 0, errors.New("transitions mix days and dates")
+	}
+	return last, nil
+}
+
+// checks of S3 done before sending
+func (r lcrule) check() error {
+	switch strings.ToLower(r.Status) {
+	case "", "enabled", "disabled":
+	default:
+		return fmt.Errorf("invalid status: %s", r.Status)
+	}
+	if len(r.ID) > 255 {
+		return errors.New("id longer than 255")
+	}
+	for k := range r.Tags {
+		if k == "" {
+			return errors.New("empty tag key")
+		}
+	}
+	if r.ExpireDays == 0 && r.ExpireDate == "" && !r.ExpiredDeleteMarker && len(r.Transitions) == 0 &&
+		r.NoncurrentExpireDays == 0 && len(r.NoncurrentTransitions) == 0 && r.AbortMultipartDays == 0 {
+		return errors.New("no action")
+	}
+	nexp := 0
+	for _, set := range []bool{r.ExpireDays != 0, r.ExpireDate != "", r.ExpiredDeleteMarker} {
+		if set {
+			nexp += 1
+		}
+	}
+	if nexp > 1 {
+		return errors.New("expire_days, expire_date and expired_delete_marker are exclusive")
+	}
+	if r.ExpireDays < 0 || r.NoncurrentExpireDays < 0 || r.AbortMultipartDays < 0 {
+		return errors.New("days must be positive")
+	}
+	if r.ExpireDate != "" {
+		if _, err := time.Parse(lcdate, r.ExpireDate); err != nil {
+			return fmt.Errorf("invalid expire_date: %s", r.ExpireDate)
+		}
+	}
+	if len(r.Tags) != 0 && (r.ExpiredDeleteMarker || r.AbortMultipartDays != 0) {
+		return errors.New("expired_delete_marker and abort_multipart_days can not be used with tags")
+	}
+	last, err := checktransitions(r.Transitions, false)
+	if err != nil {
+		return err
+	}
+	if r.ExpireDays != 0 && last >= r.ExpireDays {
+		return errors.New("expire_days is not later than transitions")
+	}
+	last, err = checktransitions(r.NoncurrentTransitions, true)
+	if err != nil {
+		return err
+	}
+	if r.NoncurrentExpireDays != 0 && last >= r.NoncurrentExpireDays {
+		return errors.New("noncurrent_expire_days is not later than transitions")
+	}
+	return nil
+}
+
+func (f lcfile) check() error {
+	if len(f.Rules) == 0 {
+		return errors.New("no rules")
+	}
+	if len(f.Rules) > 1000 {
+		return errors.New("more than 1000 rules")
+	}
+	ids := map[string]bool{}
+	for n, r := range f.Rules {
+		if r.ID != "" && ids[r.ID] {
+			return fmt.Errorf("rule %d: duplicate id %s", n+1, r.ID)
+		}
+		ids[r.ID] = true
+		if err := r.check(); err != nil {
+			if r.ID != "" {
+				return fmt.Errorf("rule %s: %v", r.ID, err)
+			}
+			return fmt.Errorf("rule %d: %v", n+1, err)
+		}
+	}
+	return nil
+}
+
+// .json is JSON, others YAML. unknown keys are error
+func readlifecycle(fn string) (lcfile, error) {
+	var f lcfile
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return f, err
+	}
+	if strings.EqualFold(filepath.Ext(fn), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return f, fmt.Errorf("%s: %v", fn, err)
+	}
+	return f, f.check()
+}
+
+// LifecycleConfiguration xml. goamz LifecycleRule has no filter, multiple transitions and abort
+type lctag struct {
+	Key   string
+	Value string
+}
+
+type lcfilter struct {
+	Prefix *string `xml:"Prefix"`
+	Tag    *lctag  `xml:"Tag"`
+	And    *struct {
+		Prefix string  `xml:"Prefix,omitempty"`
+		Tags   []lctag `xml:"Tag"`
+	} `xml:"And"`
+}
+
+type lcxmltransition struct {
+	Days           *int   `xml:"Days"`
+	NoncurrentDays int    `xml:"NoncurrentDays,omitempty"`
+	Date           string `xml:"Date,omitempty"`
+	StorageClass   string
+}
+
+type lcxmlrule struct {
+	ID     string `xml:"ID,omitempty"`
+	Filter *lcfilter
+	// rules without filter
+	Prefix                      *string `xml:"Prefix"`
+	Status                      string
+	Transitions                 []lcxmltransition `xml:"Transition"`
+	NoncurrentVersionTransition []lcxmltransition
+	Expiration                  *struct {
+		Days                      int    `xml:",omitempty"`
+		Date                      string `xml:",omitempty"`
+		ExpiredObjectDeleteMarker bool   `xml:",omitempty"`
+	}
+	NoncurrentVersionExpiration *struct {
+		NoncurrentDays int
+	}
+	AbortIncompleteMultipartUpload *struct {
+		DaysAfterInitiation int
+	}
+}
+
+type lcconfig struct {
+	XMLName xml.Name    `xml:"LifecycleConfiguration"`
+	Xmlns   string      `xml:"xmlns,attr,omitempty"`
+	Rules   []lcxmlrule `xml:"Rule"`
+}
+
+func (r lcrule) xmlrule() lcxmlrule {
+	x := lcxmlrule{ID: r.ID, Status: "Enabled", Filter: &lcfilter{}}
+	if strings.ToLower(r.Status) == "disabled" {
+		x.Status = "Disabled"
+	}
+	keys := []string{}
+	for k := range r.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	switch {
+	case len(keys) == 0:
+		x.Filter.Prefix = &r.Prefix
+	case len(keys) == 1 && r.Prefix == "":
+		x.Filter.Tag = &lctag{keys[0], r.Tags[keys[0]]}
+	default:
+		x.Filter.And = &struct {
+			Prefix string  `xml:"Prefix,omitempty"`
+			Tags   []lctag `xml:"Tag"`
+		}{Prefix: r.Prefix}
+		for _, k := range keys {
+			x.Filter.And.Tags = append(x.Filter.And.Tags, lctag{k, r.Tags[k]})
+		}
+	}
+	for _, t := range r.Transitions {
+		xt := lcxmltransition{StorageClass: t.Class}
+		if t.Date != "" {
+			xt.Date = t.Date + "T00:00:00Z"
+		} else {
+			days := t.Days
+			xt.Days = &days
+		}
+		x.Transitions = append(x.Transitions, xt)
+	}
+	for _, t := range r.NoncurrentTransitions {
+		x.NoncurrentVersionTransition = append(x.NoncurrentVersionTransition, lcxmltransition{NoncurrentDays: t.Days, StorageClass: t.Class})
+	}
+	if r.ExpireDays != 0 || r.ExpireDate != "" || r.ExpiredDeleteMarker {
+		x.Expiration = &struct {
+			Days                      int    `xml:",omitempty"`
+			Date                      string `xml:",omitempty"`
+			ExpiredObjectDeleteMarker bool   `xml:",omitempty"`
+		}{Days: r.ExpireDays, ExpiredObjectDeleteMarker: r.ExpiredDeleteMarker}
+		if r.ExpireDate != "" {
+			x.Expiration.Date = r.ExpireDate + "T00:00:00Z"
+		}
+	}
+	if r.NoncurrentExpireDays != 0 {
+		x.NoncurrentVersionExpiration = &struct{ NoncurrentDays int }{r.NoncurrentExpireDays}
+	}
+	if r.AbortMultipartDays != 0 {
+		x.AbortIncompleteMultipartUpload = &struct{ DaysAfterInitiation int }{r.AbortMultipartDays}
+	}
+	return x
+}
+
+// date part of ISO 8601
+func lcday(s string) string {
+	if len(s) > len(lcdate) {
+		return s[:len(lcdate)]
+	}
+	return s
+}
+
+func (x lcxmlrule) rule() lcrule {
+	r := lcrule{ID: x.ID, Status: strings.ToLower(x.Status)}
+	if x.Prefix != nil {
+		r.Prefix = *x.Prefix
+	}
+	if f := x.Filter; f != nil {
+		tags := []lctag{}
+		switch {
+		case f.Prefix != nil:
+			r.Prefix = *f.Prefix
+		case f.Tag != nil:
+			tags = append(tags, *f.Tag)
+		case f.And != nil:
+			r.Prefix, tags = f.And.Prefix, f.And.Tags
+		}
+		for _, t := range tags {
+			if r.Tags == nil {
+				r.Tags = map[string]string{}
+			}
+			r.Tags[t.Key] = t.Value
+		}
+	}
+	for _, t := range x.Transitions {
+		lt := lctransition{Date: lcday(t.Date), Class: t.StorageClass}
+		if t.Days != nil {
+			lt.Days = *t.Days
+		}
+		r.Transitions = append(r.Transitions, lt)
+	}
+	for _, t := range x.NoncurrentVersionTransition {
+		r.NoncurrentTransitions = append(r.NoncurrentTransitions, lctransition{Days: t.NoncurrentDays, Class: t.StorageClass})
+	}
+	if e := x.Expiration; e != nil {
+		r.ExpireDays, r.ExpireDate, r.ExpiredDeleteMarker = e.Days, lcday(e.Date), e.ExpiredObjectDeleteMarker
+	}
+	if x.NoncurrentVersionExpiration != nil {
+		r.NoncurrentExpireDays = x.NoncurrentVersionExpiration.NoncurrentDays
+	}
+	if x.AbortIncompleteMultipartUpload != nil {
+		r.AbortMultipartDays = x.AbortIncompleteMultipartUpload.DaysAfterInitiation
+	}
+	return r
+}
+
+func (f lcfile) xml() ([]byte, error) {
+	conf := lcconfig{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+	for _, r := range f.Rules {
+		conf.Rules = append(conf.Rules, r.xmlrule())
+	}
+	return xml.MarshalIndent(conf, "", "  ")
+}
+
+func lifecyclebucket(c *cli.Context) (*s3.Bucket, error) {
+	if len(c.Args()) != 1 {
+		return nil, usageerr("lifecycle %s needs bucket", c.Command.Name)
+	}
+	bkt, _, err := url2bktpath(s3cl, c.Args()[0])
+	if err != nil {
+		return nil, usageerr("invalid url: %s %v", c.Args()[0], err)
+	}
+	return bkt, nil
+}
+
+func lifecycleget(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	bkt, err := lifecyclebucket(c)
+	if err != nil {
+		return err
+	}
+	// rules file is yaml (text) or json, not records
+	if outfmt != "text" && outfmt != "json" {
+		return usageerr("lifecycle get does not support output format %s", outfmt)
+	}
+	rsp, err := s3raw(bkt, "GET", "", url.Values{"lifecycle": {""}}, http.Header{}, nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	var conf lcconfig
+	if err := xml.NewDecoder(rsp.Body).Decode(&conf); err != nil {
+		return err
+	}
+	f := lcfile{Rules: []lcrule{}}
+	for _, x := range conf.Rules {
+		f.Rules = append(f.Rules, x.rule())
+	}
+	if outfmt == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f)
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(f); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func lifecycleput(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if len(c.Args()) != 2 {
+		return usageerr("lifecycle put needs rule file and bucket")
+	}
+	f, err := readlifecycle(c.Args()[0])
+	if err != nil {
+		return usageerr("lifecycle: %v", err)
+	}
+	bkt, _, err := url2bktpath(s3cl, c.Args()[1])
+	if err != nil {
+		return usageerr("invalid url: %s %v", c.Args()[1], err)
+	}
+	body, err := f.xml()
+	if err != nil {
+		return err
+	}
+	if c.Bool("dry-run") {
+		fmt.Println(string(body))
+		return nil
+	}
+	sum := md5.Sum(body)
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "application/xml")
+	hdr.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	rsp, err := s3raw(bkt, "PUT", "", url.Values{"lifecycle": {""}}, hdr, body)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	fmt.Printf("s3://%s %d rules\n", bkt.Name, len(f.Rules))
+	return nil
+}
+
+func lifecycledelete(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	bkt, err := lifecyclebucket(c)
+	if err != nil {
+		return err
+	}
+	rsp, err := s3raw(bkt, "DELETE", "", url.Values{"lifecycle": {""}}, http.Header{}, nil)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+// headers kept by setmeta, with user metadata
+var objheaders = []string{
+	"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language",
+	"Cache-Control", "Expires", "X-Amz-Website-Redirect-Location", "X-Amz-Storage-Class",
+	"X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+}
+
+// metadata describing content, kept by --replace
+func keptmeta(name string) bool {
+	name = strings.ToLower(name)
+	return name == "x-amz-meta-"+metamd5 || strings.HasPrefix(name, "x-amz-meta-"+metacse)
+}
+
+func pickheaders(hdr http.Header) http.Header {
+	res := http.Header{}
+	for _, k := range objheaders {
+		if v := hdr.Get(k); v != "" {
+			res.Set(k, v)
+		}
+	}
+	for k, v := range hdr {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			res[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	return res
+}
+
+// new headers of key from stored headers
+func metaheaders(old http.Header, key string, replace bool, remove []string) http.Header {
+	hdr := http.Header{}
+	for k, v := range old {
+		if replace && strings.HasPrefix(k, "X-Amz-Meta-") && !keptmeta(k) {
+			continue
+		}
+		hdr[k] = v
+	}
+	for _, k := range remove {
+		hdr.Del("X-Amz-Meta-" + k)
+	}
+	for k, v := range uploadheaders(key) {
+		hdr[k] = v
+	}
+	return targetheaders(hdr)
+}
+
+// storage class and encryption of copy destination
+func targetheaders(hdr http.Header) http.Header {
+	if classopt != "" {
+		hdr.Set("X-Amz-Storage-Class", string(classopt))
+	}
+	switch {
+	case sseopt.ckey != nil:
+		hdr.Del("X-Amz-Server-Side-Encryption")
+		hdr.Del("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+	case sseopt.mode != "":
+		hdr.Set("X-Amz-Server-Side-Encryption", sseopt.mode)
+		hdr.Del("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+		if sseopt.kmskey != "" {
+			hdr.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", sseopt.kmskey)
+		}
+	}
+	return hdr
+}
+
+func showheaders(us string, hdr http.Header) {
+	fmt.Println(us)
+	keys := []string{}
+	for k := range hdr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s: %s\n", k, strings.Join(hdr[k], ","))
+	}
+}
+
+// copy object onto itself with new headers, keep acl
+func rewritemeta(bkt *s3.Bucket, key string, replace bool, remove []string, partsz int64, dry bool) error {
+	us := "s3://" + bkt.Name + "/" + key
+	rsp, err := headobj(bkt, key)
+	if err != nil {
+		return err
+	}
+	old := pickheaders(rsp.Header)
+	hdr := metaheaders(old, key, replace, remove)
+	if dry {
+		showheaders(us, hdr)
+		return nil
+	}
+	if reflect.DeepEqual(old, hdr) && sseopt.ckey == nil {
+		log.Println("unchanged", us)
+		return nil
+	}
+	acl, err := getaclpol(bkt, key)
+	if err != nil {
+		log.Println("getacl", us, err)
+		acl = nil
+	}
+	hdr.Set("x-amz-acl", string(s3.Private))
+	customerheaders(hdr, ssecprefix, sseopt.ckey)
+	source := path.Join(bkt.Name, key)
+	if rsp.ContentLength > maxcopysize {
+		multi, err := initmultiheader(bkt, key, hdr)
+		if err != nil {
+			return err
+		}
+		_, err = copyparts(multi, bkt, key, "", rsp.ContentLength, partsz)
+	} else {
+		hdr.Set("x-amz-metadata-directive", "REPLACE")
+		err = retry("setmeta "+us, func() error {
+			return copyraw(bkt, key, nil, hdr, source, "", &s3.CopyObjectResult{})
+		})
+	}
+	if err != nil || acl == nil {
+		return err
+	}
+	return putaclpol(bkt, key, acl)
+}
+
+func setmeta(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if len(c.Args()) == 0 {
+		return usageerr("setmeta needs url")
+	}
+	if len(hdropt.hdr) == 0 && len(hdropt.rules) == 0 && len(c.StringSlice("remove-meta")) == 0 && !c.Bool("replace") && classopt == "" {
+		return usageerr("specify --meta, --header, --header-rules, --remove-meta, --replace or --storage-class")
+	}
+	partsz := int64(c.Int("split"))
+	if partsz < minpartsize {
+		partsz = minpartsize
+	}
+	fail := newfailures()
+	for _, arg := range c.Args() {
+		urls, err := expandurls(arg, c.Bool("recursive"))
+		if err != nil {
+			fail.add(arg, err)
+			continue
+		}
+		for _, us := range urls {
+			bkt, key, err := url2bktpath(s3cl, us)
+			if err != nil {
+				return usageerr("invalid url: %s %v", us, err)
+			}
+			fail.add(us, rewritemeta(bkt, key, c.Bool("replace"), c.StringSlice("remove-meta"), partsz, c.Bool("dry-run")))
+		}
+	}
+	return fail.result("setmeta")
+}
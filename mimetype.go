@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+type mimedetector struct {
+	fallback  string
+	detect    bool
+	overrides map[string]string
+}
+
+var mimeflags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "mime-map",
+		Usage: "mime.types style file: 'content/type ext1 ext2 ...'",
+	},
+	cli.BoolFlag{
+		Name:  "no-mime-detect",
+		Usage: "always use --content-type",
+	},
+}
+
+// load mime.types style file
+func loadmimemap(fn string) (map[string]string, error) {
+	res := map[string]string{}
+	fp, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			res["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	return res, scanner.Err()
+}
+
+func newmimedetector(c *cli.Context) (*mimedetector, error) {
+	m := &mimedetector{
+		fallback:  c.String("content-type"),
+		detect:    !c.Bool("no-mime-detect"),
+		overrides: map[string]string{},
+	}
+	if c.String("mime-map") != "" {
+		ov, err := loadmimemap(c.String("mime-map"))
+		if err != nil {
+			return nil, err
+		}
+		m.overrides = ov
+	}
+	return m, nil
+}
+
+// mapping file > extension > content sniffing > fallback
+func (m *mimedetector) typeof(fn string, rd io.ReadSeeker) string {
+	if m == nil {
+		return "binary/octet-stream"
+	}
+	if !m.detect {
+		return m.fallback
+	}
+	ext := strings.ToLower(filepath.Ext(fn))
+	if v, ok := m.overrides[ext]; ok {
+		return v
+	}
+	if v := mime.TypeByExtension(ext); ext != "" && v != "" {
+		return v
+	}
+	if rd != nil {
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(rd, buf)
+		if _, err := rd.Seek(0, io.SeekStart); err == nil && n != 0 {
+			if v := http.DetectContentType(buf[:n]); v != "application/octet-stream" {
+				return v
+			}
+		}
+	}
+	return m.fallback
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+var outputformats = []string{"text", "json", "ndjson", "csv"}
+
+var outputflags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "output, o",
+		Value:  "text",
+		Usage:  "output format of listing commands (" + strings.Join(outputformats, "|") + ")",
+		EnvVar: "S3CMD_OUTPUT",
+	},
+}
+
+var outfmt = "text"
+
+func outputsetup(c *cli.Context) error {
+	f := c.GlobalString("output")
+	if f == "" {
+		f = "text"
+	}
+	for _, v := range outputformats {
+		if v == f {
+			outfmt = f
+			return nil
+		}
+	}
+	return usageerr("invalid output format %s, choose from %s", f, strings.Join(outputformats, ","))
+}
+
+type partrecord struct {
+	Part int    `json:"part"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// one listing entry
+type record struct {
+	Bucket        string            `json:"bucket"`
+	Key           string            `json:"key"`
+	Size          int64             `json:"size"`
+	ETag          string            `json:"etag,omitempty"`
+	LastModified  string            `json:"last_modified,omitempty"`
+	StorageClass  string            `json:"storage_class,omitempty"`
+	Owner         string            `json:"owner,omitempty"`
+	Prefix        bool              `json:"prefix"`
+	Count         int64             `json:"count,omitempty"`
+	UploadId      string            `json:"upload_id,omitempty"`
+	Parts         []partrecord      `json:"parts,omitempty"`
+	URL           string            `json:"url,omitempty"`
+	Header        map[string]string `json:"header,omitempty"`
+	Acl           *aclpol           `json:"acl,omitempty"`
+	Restore       string            `json:"restore,omitempty"`
+	RestoreExpiry string            `json:"restore_expiry,omitempty"`
+	VersionId     string            `json:"version_id,omitempty"`
+	IsLatest      bool              `json:"is_latest,omitempty"`
+	DeleteMarker  bool              `json:"delete_marker,omitempty"`
+}
+
+var csvheader = []string{"bucket", "key", "size", "etag", "last_modified", "storage_class", "owner", "prefix", "count", "upload_id", "url", "grants", "restore", "restore_expiry",
+	"version_id", "is_latest", "delete_marker"}
+
+func (r record) csv() []string {
+	grants := []string{}
+	if r.Acl != nil {
+		for _, g := range r.Acl.AccessControlList.Grant {
+			grants = append(grants, g.Permission+":"+g.Grantee.String())
+		}
+	}
+	return []string{r.Bucket, r.Key, strconv.FormatInt(r.Size, 10), r.ETag, r.LastModified,
+		r.StorageClass, r.Owner, strconv.FormatBool(r.Prefix), strconv.FormatInt(r.Count, 10), r.UploadId, r.URL,
+		strings.Join(grants, " "), r.Restore, r.RestoreExpiry,
+		r.VersionId, strconv.FormatBool(r.IsLatest), strconv.FormatBool(r.DeleteMarker)}
+}
+
+func keyrecord(bkt *s3.Bucket, k s3.Key) record {
+	owner := k.Owner.DisplayName
+	if owner == "" {
+		owner = k.Owner.ID
+	}
+	return record{Bucket: bkt.Name, Key: k.Key, Size: k.Size, ETag: strings.Trim(k.ETag, "\""),
+		LastModified: k.LastModified, StorageClass: k.StorageClass, Owner: owner}
+}
+
+func prefixrecord(bkt *s3.Bucket, prefix string) record {
+	return record{Bucket: bkt.Name, Key: prefix, Prefix: true}
+}
+
+func headrecord(bkt *s3.Bucket, key string, rsp *http.Response) record {
+	r := record{Bucket: bkt.Name, Key: key, Size: rsp.ContentLength,
+		ETag:         strings.Trim(rsp.Header.Get("ETag"), "\""),
+		LastModified: rsp.Header.Get("Last-Modified"),
+		StorageClass: rsp.Header.Get("x-amz-storage-class"),
+		Header:       map[string]string{}}
+	if r.StorageClass == "" {
+		r.StorageClass = "STANDARD"
+	}
+	for k, v := range rsp.Header {
+		r.Header[k] = strings.Join(v, ", ")
+	}
+	return r
+}
+
+// writes records in selected format. text mode calls the given func instead
+type output struct {
+	format string
+	wr     io.Writer
+	csvwr  *csv.Writer
+	enc    *json.Encoder
+	list   []record
+}
+
+func newoutput() *output {
+	o := &output{format: outfmt, wr: os.Stdout}
+	switch o.format {
+	case "csv":
+		o.csvwr = csv.NewWriter(o.wr)
+		o.csvwr.Write(csvheader)
+	case "ndjson":
+		o.enc = json.NewEncoder(o.wr)
+	case "json":
+		o.list = []record{}
+	}
+	return o
+}
+
+func (o *output) text() bool {
+	return o.format == "text"
+}
+
+func (o *output) emit(r record, text func()) error {
+	switch o.format {
+	case "csv":
+		return o.csvwr.Write(r.csv())
+	case "ndjson":
+		return o.enc.Encode(r)
+	case "json":
+		o.list = append(o.list, r)
+	default:
+		if text != nil {
+			text()
+		}
+	}
+	return nil
+}
+
+func (o *output) close() error {
+	switch o.format {
+	case "csv":
+		o.csvwr.Flush()
+		return o.csvwr.Error()
+	case "json":
+		enc := json.NewEncoder(o.wr)
+		enc.SetIndent("", "  ")
+		return enc.Encode(o.list)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+	"github.com/vaughan0/go-ini"
+)
+
+func profileflags(homedir string) []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "profile name in config, s3cfg or aws credentials",
+			EnvVar: "AWS_PROFILE,AWS_DEFAULT_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "aws_credentials",
+			Value:  path.Join(homedir, ".aws", "credentials"),
+			Usage:  "aws shared credentials file",
+			EnvVar: "AWS_SHARED_CREDENTIALS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "aws_config",
+			Value:  path.Join(homedir, ".aws", "config"),
+			Usage:  "aws config file",
+			EnvVar: "AWS_CONFIG_FILE",
+		},
+	}
+}
+
+var copyprofileflags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "src-profile",
+		Usage: "profile of source url (same as s3://profile@bucket/key)",
+	},
+	cli.StringFlag{
+		Name:  "dst-profile",
+		Usage: "profile of destination url",
+	},
+}
+
+// settings read from config files
+type profile struct {
+	name  string
+	akey  string
+	skey  string
+	reg   aws.Region
+	debug bool
+	// v2 or v4, empty for default
+	signature string
+	// region in v4 signature
+	region  string
+	payload string
+	// session token of temporary credentials
+	token string
+	role  rolecfg
+}
+
+func loadprofile(c *cli.Context, name string) (profile, error) {
+	prof, err := readprofile(c, name)
+	if err != nil || prof.role.source == "" {
+		return prof, err
+	}
+	src, err := readprofile(c, prof.role.source)
+	if err != nil {
+		return prof, err
+	}
+	if src.role.arn != "" {
+		return prof, usageerr("source profile %s: role chaining not supported", src.name)
+	}
+	prof.akey, prof.skey, prof.token = src.akey, src.skey, src.token
+	return prof, nil
+}
+
+// first config file having the profile wins: config(json), s3cfg, aws
+func readprofile(c *cli.Context, name string) (profile, error) {
+	prof := profile{name: name}
+	if found, err := jsonprofile(c.GlobalString("config"), &prof); found || err != nil {
+		return prof, err
+	}
+	if found, err := s3cfgprofile(c.GlobalString("s3cfg"), &prof); found || err != nil {
+		return prof, err
+	}
+	if found, err := awsprofile(c.GlobalString("aws_credentials"), c.GlobalString("aws_config"), &prof); found || err != nil {
+		return prof, err
+	}
+	if prof.name != "" {
+		return prof, usageerr("profile not found: %s", prof.name)
+	}
+	return prof, nil
+}
+
+func jsonprofile(fn string, prof *profile) (bool, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return false, nil
+	}
+	dec := json.NewDecoder(fp)
+	var conf Config
+	err = dec.Decode(&conf)
+	fp.Close()
+	if err != nil {
+		return false, fmt.Errorf("json decode %s: %v", fn, err)
+	}
+	if named, ok := conf.Profiles[prof.name]; ok {
+		conf = named
+	} else if prof.name != "" && prof.name != "default" {
+		return false, nil
+	}
+	log.Println("profile", prof.name, "from", fn)
+	prof.debug = conf.Debug
+	prof.akey = conf.AccessKey
+	prof.skey = conf.SecretKey
+	prof.reg.Name = "customized"
+	prof.reg.S3Endpoint = conf.StorageAPI
+	if !conf.Force_path_style {
+		u, _ := url.Parse(prof.reg.S3Endpoint)
+		u.Host = "${bucket}." + u.Host
+		prof.reg.S3BucketEndpoint = u.String()
+		log.Println("not force_path_style:", prof.reg.S3BucketEndpoint)
+	}
+	prof.reg.S3LowercaseBucket = true
+	prof.signature = conf.Signature
+	prof.region = conf.Region
+	prof.payload = conf.Payload
+	prof.token = conf.SessionToken
+	prof.role = rolecfg{arn: conf.RoleArn, externalid: conf.ExternalId, session: conf.RoleSessionName,
+		duration: time.Duration(conf.DurationSeconds) * time.Second, mfaserial: conf.MfaSerial,
+		tokenfile: conf.WebIdentityTokenFile, endpoint: conf.StsEndpoint}
+	return true, checkrole(prof.role)
+}
+
+func s3cfgprofile(fn string, prof *profile) (bool, error) {
+	conf, err := ini.LoadFile(fn)
+	if err != nil {
+		return false, nil
+	}
+	section := prof.name
+	if section == "" {
+		section = "default"
+	} else if _, ok := conf[section]; !ok {
+		return false, nil
+	}
+	log.Println("profile", section, "from", fn)
+	if v, ok := conf.Get(section, "verbosity"); ok && v == "DEBUG" {
+		prof.debug = true
+	}
+	if v, ok := conf.Get(section, "bucket_location"); ok {
+		prof.reg = aws.Regions[v]
+	} else {
+		prof.reg.Name = "customized"
+		if prof.reg.S3Endpoint, ok = conf.Get(section, "host_base"); ok {
+			if ssl, ok := conf.Get(section, "use_https"); ok && ssl == "False" {
+				prof.reg.S3Endpoint = "http://" + prof.reg.S3Endpoint + "/"
+			} else {
+				prof.reg.S3Endpoint = "https://" + prof.reg.S3Endpoint + "/"
+			}
+		}
+		prof.reg.S3LowercaseBucket = true
+	}
+	if v, ok := conf.Get(section, "signature_v2"); ok {
+		prof.signature = "v4"
+		if v == "True" {
+			prof.signature = "v2"
+		}
+	}
+	prof.akey, _ = conf.Get(section, "access_key")
+	prof.skey, _ = conf.Get(section, "secret_key")
+	prof.token, _ = conf.Get(section, "access_token")
+	return true, nil
+}
+
+// ~/.aws/credentials [name], ~/.aws/config [profile name]
+func awsprofile(credfn, conffn string, prof *profile) (bool, error) {
+	name := prof.name
+	if name == "" {
+		name = "default"
+	}
+	found := false
+	if cred, err := ini.LoadFile(credfn); err == nil {
+		if _, ok := cred[name]; ok {
+			log.Println("profile", name, "from", credfn)
+			found = true
+			prof.akey, _ = cred.Get(name, "aws_access_key_id")
+			prof.skey, _ = cred.Get(name, "aws_secret_access_key")
+			prof.token, _ = cred.Get(name, "aws_session_token")
+		}
+	}
+	if conf, err := ini.LoadFile(conffn); err == nil {
+		section := "profile " + name
+		if _, ok := conf[section]; !ok && name == "default" {
+			section = "default"
+		}
+		if _, ok := conf[section]; ok {
+			log.Println("profile", name, "from", conffn)
+			found = true
+			if v, ok := conf.Get(section, "region"); ok {
+				prof.reg = aws.Regions[v]
+				prof.region = v
+			}
+			if v, ok := conf.Get(section, "endpoint_url"); ok {
+				prof.reg.Name = "customized"
+				prof.reg.S3Endpoint = strings.TrimSuffix(v, "/") + "/"
+				prof.reg.S3BucketEndpoint = ""
+				prof.reg.S3LowercaseBucket = true
+			}
+			for k, v := range map[string]*string{
+				"role_arn":                &prof.role.arn,
+				"source_profile":          &prof.role.source,
+				"external_id":             &prof.role.externalid,
+				"role_session_name":       &prof.role.session,
+				"mfa_serial":              &prof.role.mfaserial,
+				"web_identity_token_file": &prof.role.tokenfile,
+			} {
+				*v, _ = conf.Get(section, k)
+			}
+			if v, ok := conf.Get(section, "duration_seconds"); ok {
+				sec, err := strconv.Atoi(v)
+				if err != nil {
+					return true, fmt.Errorf("%s: invalid duration_seconds %s", conffn, v)
+				}
+				prof.role.duration = time.Duration(sec) * time.Second
+			}
+		}
+	}
+	if found {
+		prof.signature = "v4"
+		// same as aws cli: AWS_REGION, AWS_DEFAULT_REGION, then us-east-1
+		if prof.region == "" {
+			prof.region = firstenv("AWS_REGION", "AWS_DEFAULT_REGION")
+			if prof.region == "" {
+				prof.region = "us-east-1"
+			}
+			if prof.reg.S3Endpoint == "" {
+				prof.reg = aws.Regions[prof.region]
+			}
+		}
+		// region unknown to goamz
+		if prof.reg.S3Endpoint == "" {
+			prof.reg.Name = prof.region
+			prof.reg.S3Endpoint = "https://s3." + prof.region + ".amazonaws.com"
+			prof.reg.S3LowercaseBucket = true
+		}
+	}
+	return found, nil
+}
+
+func firstenv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func newclient(prof profile) (*s3.S3, error) {
+	var auth aws.Auth
+	// web identity needs no credentials
+	if prof.role.tokenfile == "" {
+		var err error
+		auth, err = aws.GetAuth(prof.akey, prof.skey, "", time.Now().Add(time.Hour))
+		if err != nil {
+			return nil, exitError{code: exitAuth, msg: fmt.Sprintf("auth %s: %v", prof.name, err)}
+		}
+		if prof.token != "" {
+			auth = newauth(auth.AccessKey, auth.SecretKey, prof.token)
+		}
+	}
+	cl := s3.New(auth, prof.reg)
+	if prof.role.arn != "" {
+		if err := assumesetup(cl, prof.role); err != nil {
+			return nil, err
+		}
+	}
+	return cl, nil
+}
+
+// clients of s3://profile@bucket/key, created on first use
+var clients struct {
+	sync.Mutex
+	ctx *cli.Context
+	cl  map[string]*s3.S3
+}
+
+func clientsetup(c *cli.Context) {
+	clients.Lock()
+	defer clients.Unlock()
+	clients.ctx = c
+	clients.cl = map[string]*s3.S3{}
+	sessions.Lock()
+	defer sessions.Unlock()
+	sessions.list = nil
+}
+
+func profileclient(name string) (*s3.S3, error) {
+	clients.Lock()
+	defer clients.Unlock()
+	if cl, ok := clients.cl[name]; ok {
+		return cl, nil
+	}
+	if clients.ctx == nil {
+		return nil, fmt.Errorf("profile %s: not set up", name)
+	}
+	prof, err := loadprofile(clients.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := newclient(prof)
+	if err != nil {
+		return nil, err
+	}
+	if err := signclient(cl, prof); err != nil {
+		return nil, err
+	}
+	log.Println("client", name, cl.S3Endpoint)
+	clients.cl[name] = cl
+	return cl, nil
+}
+
+// s3://bucket/key -> s3://prof@bucket/key
+func withprofile(us, prof string) string {
+	if prof == "" {
+		return us
+	}
+	u, err := url.Parse(us)
+	if err != nil || (u.Scheme != "s3" && u.Scheme != "dag") || u.User != nil {
+		return us
+	}
+	u.User = url.User(prof)
+	return u.String()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cheggaaa/pb"
+	"github.com/urfave/cli"
+)
+
+var recursiveflags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "recursive,R",
+		Usage: "transfer directory tree / prefix",
+	},
+	cli.IntFlag{
+		Name:  "parallel,p",
+		Usage: "parallel upload/download (with -R)",
+		Value: 4,
+	},
+	cli.IntFlag{
+		Name:  "split",
+		Value: 0,
+		Usage: "do multipart upload/download larger than this size (with -R)",
+	},
+	cli.IntFlag{
+		Name:  "split-parallel",
+		Value: 4,
+		Usage: "parallel ranged get per object (with -R)",
+	},
+	cli.BoolFlag{
+		Name:  "store-md5",
+		Usage: "store md5 of multipart uploaded file in metadata (with -R)",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run,n",
+		Usage: "show what would be transferred (with -R)",
+	},
+}
+
+// run transfers with sync workers
+func runtransfers(ents []*SyncEntry, parallel int, opt SyncOption) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var total int64
+	for _, e := range ents {
+		total += e.Size
+	}
+	pbar = pb.New64(total)
+	pbar.ShowSpeed = true
+	pbar.SetUnits(pb.U_BYTES)
+	pbar.Start()
+	var wg sync.WaitGroup
+	ch := make(chan *SyncEntry, parallel)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go sync_routine(ch, &wg, opt)
+	}
+	for _, e := range ents {
+		ch <- e
+	}
+	ch <- nil
+	wg.Wait()
+	pbar.Finish()
+}
+
+// local path under basedir, refuse keys escaping it
+func localpath(basedir, rel string) (string, error) {
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key escapes destination: %s", rel)
+	}
+	return filepath.Join(basedir, rel), nil
+}
+
+// expand url to object urls when recursive
+func expandurls(us string, recursive bool) ([]string, error) {
+	if !recursive {
+		return []string{us}, nil
+	}
+	res, err := lists3(us, "")
+	if err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	for k, _ := range res {
+		urls = append(urls, us+k)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+func getrecursive(c *cli.Context) error {
+	args := c.Args()
+	if len(args) == 0 {
+		return usageerr("get -R needs src")
+	}
+	dstdir := "."
+	if len(args) > 1 {
+		if _, _, err := url2bktpath(s3cl, args[len(args)-1]); err != nil {
+			dstdir = args[len(args)-1]
+			args = args[:len(args)-1]
+		}
+	}
+	opt, err := syncoption(c)
+	if err != nil {
+		return err
+	}
+	ents := []*SyncEntry{}
+	local := &filestorage{}
+	for _, us := range args {
+		bkt, prefix, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		src := s3store(bkt)
+		res, err := listentries(src, prefix)
+		if err != nil {
+			opt.Fail.add(us, err)
+			continue
+		}
+		base := dstdir
+		if len(args) != 1 {
+			base = filepath.Join(dstdir, path.Base(strings.TrimSuffix(prefix, "/")))
+		}
+		keys := []string{}
+		for k, _ := range res {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fn, err := localpath(base, k)
+			if err != nil {
+				opt.Fail.add(src.url(res[k].key), err)
+				continue
+			}
+			if restoreopt.wait {
+				if err := waitrestore(bkt, res[k].key); err != nil {
+					opt.Fail.add(src.url(res[k].key), err)
+					continue
+				}
+			}
+			ents = append(ents, syncentry(src, res[k].key, local, fn, res[k].size))
+		}
+	}
+	log.Println("get", len(ents), "objects to", dstdir)
+	runtransfers(ents, c.Int("parallel"), opt)
+	return opt.Fail.result("get")
+}
+
+func putrecursive(c *cli.Context) error {
+	args := c.Args()
+	if len(args) < 2 {
+		return usageerr("put -R needs src and dst")
+	}
+	dst := args[len(args)-1]
+	src := args[0 : len(args)-1]
+	dstbkt, dstbase, err := url2bktpath(s3cl, dst)
+	if err != nil {
+		return usageerr("invalid url: %s %v", dst, err)
+	}
+	opt, err := syncoption(c)
+	if err != nil {
+		return err
+	}
+	ents := []*SyncEntry{}
+	local := &filestorage{}
+	dstst := s3store(dstbkt)
+	for _, s := range src {
+		fi, err := os.Stat(s)
+		if err != nil {
+			opt.Fail.add(s, err)
+			continue
+		}
+		if !fi.IsDir() {
+			dstkey := path.Join(dstbase, filepath.Base(s))
+			ents = append(ents, syncentry(local, s, dstst, dstkey, fi.Size()))
+			continue
+		}
+		base := dstbase
+		if len(src) != 1 {
+			base = path.Join(dstbase, filepath.Base(filepath.Clean(s)))
+		}
+		res, err := listentries(local, filepath.Clean(s))
+		if err != nil {
+			opt.Fail.add(s, err)
+			continue
+		}
+		names := []string{}
+		for k, _ := range res {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			dstkey := path.Join(base, k)
+			ents = append(ents, syncentry(local, res[k].key, dstst, dstkey, res[k].size))
+		}
+	}
+	log.Println("put", len(ents), "files to", dst)
+	runtransfers(ents, c.Int("parallel"), opt)
+	return opt.Fail.result("put")
+}
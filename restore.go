@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+var restoreflags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "wait",
+		Usage: "wait until restore of archived objects finishes",
+	},
+	cli.DurationFlag{
+		Name:  "wait-interval",
+		Value: time.Minute,
+		Usage: "polling interval of --wait",
+	},
+	cli.DurationFlag{
+		Name:  "wait-timeout",
+		Value: 48 * time.Hour,
+		Usage: "give up --wait after this (0: no limit)",
+	},
+}
+
+var restoretiers = []string{"Standard", "Bulk", "Expedited"}
+
+var restoreopt struct {
+	wait     bool
+	interval time.Duration
+	// end of --wait of the command, zero if no limit
+	deadline time.Time
+}
+
+func restoresetup(c *cli.Context) {
+	restoreopt.wait = c.Bool("wait")
+	restoreopt.interval = c.Duration("wait-interval")
+	if restoreopt.interval <= 0 {
+		restoreopt.interval = time.Minute
+	}
+	restoreopt.deadline = time.Time{}
+	if d := c.Duration("wait-timeout"); d > 0 {
+		restoreopt.deadline = time.Now().Add(d)
+	}
+}
+
+// classes needing restore before read
+func archiveclass(sc string) bool {
+	return sc == "GLACIER" || sc == "DEEP_ARCHIVE"
+}
+
+var restorekv = regexp.MustCompile(`([a-z-]+)="([^"]*)"`)
+
+// x-amz-restore: ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+func parserestore(v string) (ongoing bool, expiry string) {
+	for _, m := range restorekv.FindAllStringSubmatch(v, -1) {
+		switch m[1] {
+		case "ongoing-request":
+			ongoing = m[2] == "true"
+		case "expiry-date":
+			expiry = m[2]
+		}
+	}
+	return
+}
+
+// archived, restoring, restored or available
+func restorestate(hdr http.Header) (string, string) {
+	v := hdr.Get("x-amz-restore")
+	if v == "" {
+		if archiveclass(hdr.Get("x-amz-storage-class")) {
+			return "archived", ""
+		}
+		return "available", ""
+	}
+	ongoing, expiry := parserestore(v)
+	if ongoing {
+		return "restoring", ""
+	}
+	return "restored", expiry
+}
+
+func restorekey(bkt *s3.Bucket, key string, days int, tier string) error {
+	body := fmt.Sprintf("<RestoreRequest><Days>%d</Days><GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters></RestoreRequest>", days, tier)
+	rsp, err := s3raw(bkt, "POST", key, url.Values{"restore": {""}}, http.Header{}, []byte(body))
+	var s3err *s3.Error
+	if errors.As(err, &s3err) && s3err.Code == "RestoreAlreadyInProgress" {
+		log.Println("restore in progress", "s3://"+bkt.Name+"/"+key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+// poll until object is readable
+func waitrestore(bkt *s3.Bucket, key string) error {
+	us := "s3://" + bkt.Name + "/" + key
+	for {
+		rsp, err := headobj(bkt, key)
+		if err != nil {
+			return err
+		}
+		rsp.Body.Close()
+		switch st, _ := restorestate(rsp.Header); st {
+		case "archived":
+			return fmt.Errorf("%s is archived, run restore first", us)
+		case "restoring":
+			if !restoreopt.deadline.IsZero() && time.Now().Add(restoreopt.interval).After(restoreopt.deadline) {
+				return exitError{code: exitTimeout, msg: us + " is still restoring, wait timed out"}
+			}
+			log.Println("waiting restore", us, restoreopt.interval)
+			time.Sleep(restoreopt.interval)
+		default:
+			return nil
+		}
+	}
+}
+
+func restore(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if len(c.Args()) == 0 {
+		return usageerr("restore needs url")
+	}
+	days := c.Int("days")
+	if days <= 0 {
+		return usageerr("days must be positive")
+	}
+	tier := ""
+	for _, v := range restoretiers {
+		if strings.EqualFold(v, c.String("tier")) {
+			tier = v
+		}
+	}
+	if tier == "" {
+		return usageerr("invalid tier %s, choose from %s", c.String("tier"), strings.Join(restoretiers, ","))
+	}
+	fail := newfailures()
+	type target struct {
+		bkt *s3.Bucket
+		key string
+	}
+	targets := []target{}
+	for _, us := range c.Args() {
+		bkt, key, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		if !c.Bool("recursive") {
+			targets = append(targets, target{bkt, key})
+			continue
+		}
+		var marker string
+		for {
+			rsp, err := listpage(bkt, key, "", marker)
+			if err != nil {
+				fail.add(us, err)
+				break
+			}
+			for _, k := range rsp.Contents {
+				if archiveclass(k.StorageClass) && pathflt.match(strings.TrimPrefix(k.Key, key)) {
+					targets = append(targets, target{bkt, k.Key})
+				}
+			}
+			marker = rsp.NextMarker
+			if !rsp.IsTruncated {
+				break
+			}
+		}
+	}
+	restored := []target{}
+	for _, t := range targets {
+		us := "s3://" + t.bkt.Name + "/" + t.key
+		fmt.Printf("restore %s days=%d tier=%s\n", us, days, tier)
+		if c.Bool("dry-run") {
+			continue
+		}
+		if err := restorekey(t.bkt, t.key, days, tier); err != nil {
+			fail.add(us, err)
+			continue
+		}
+		restored = append(restored, t)
+	}
+	for _, t := range restored {
+		if !restoreopt.wait {
+			fail.success()
+			continue
+		}
+		fail.add("s3://"+t.bkt.Name+"/"+t.key, waitrestore(t.bkt, t.key))
+	}
+	return fail.result("restore")
+}
+
+func restorestatus(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	out := newoutput()
+	fail := newfailures()
+	for _, arg := range c.Args() {
+		urls, err := expandurls(arg, c.Bool("recursive"))
+		if err != nil {
+			fail.add(arg, err)
+			continue
+		}
+		for _, us := range urls {
+			bkt, key, err := url2bktpath(s3cl, us)
+			if err != nil {
+				return usageerr("invalid url: %s %v", us, err)
+			}
+			rsp, err := headobj(bkt, key)
+			fail.add(us, err)
+			if err != nil {
+				continue
+			}
+			rsp.Body.Close()
+			rec := headrecord(bkt, key, rsp)
+			rec.Header = nil
+			rec.Restore, rec.RestoreExpiry = restorestate(rsp.Header)
+			out.emit(rec, func() {
+				if rec.RestoreExpiry != "" {
+					fmt.Printf("%s %s %s until %s\n", us, rec.StorageClass, rec.Restore, rec.RestoreExpiry)
+				} else {
+					fmt.Printf("%s %s %s\n", us, rec.StorageClass, rec.Restore)
+				}
+			})
+		}
+	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("restore-status")
+}
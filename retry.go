@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+type retrypolicy struct {
+	attempts int
+	wait     time.Duration
+	maxwait  time.Duration
+	jitter   float64
+}
+
+var retrypol = retrypolicy{attempts: 5, wait: 500 * time.Millisecond, maxwait: 30 * time.Second, jitter: 0.5}
+
+var retryflags = []cli.Flag{
+	cli.IntFlag{
+		Name:   "retry",
+		Value:  5,
+		Usage:  "max attempts of each S3 request",
+		EnvVar: "S3CMD_RETRY",
+	},
+	cli.DurationFlag{
+		Name:  "retry-wait",
+		Value: 500 * time.Millisecond,
+		Usage: "initial wait of exponential backoff",
+	},
+	cli.DurationFlag{
+		Name:  "retry-max-wait",
+		Value: 30 * time.Second,
+		Usage: "max wait of exponential backoff",
+	},
+	cli.Float64Flag{
+		Name:  "retry-jitter",
+		Value: 0.5,
+		Usage: "randomize ratio of wait (0.0-1.0)",
+	},
+}
+
+func retrysetup(c *cli.Context) {
+	retrypol.attempts = c.GlobalInt("retry")
+	if retrypol.attempts < 1 {
+		retrypol.attempts = 1
+	}
+	retrypol.wait = c.GlobalDuration("retry-wait")
+	retrypol.maxwait = c.GlobalDuration("retry-max-wait")
+	retrypol.jitter = c.GlobalFloat64("retry-jitter")
+	if retrypol.jitter < 0 {
+		retrypol.jitter = 0
+	} else if retrypol.jitter > 1 {
+		retrypol.jitter = 1
+	}
+}
+
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var s3err *s3.Error
+	if errors.As(err, &s3err) {
+		switch s3err.Code {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable",
+			"Throttling", "ThrottlingException", "RequestLimitExceeded", "OperationAborted",
+			// refreshed before next attempt
+			"ExpiredToken":
+			return true
+		}
+		return s3err.StatusCode >= 500 || s3err.StatusCode == http.StatusTooManyRequests
+	}
+	var neterr net.Error
+	return errors.As(err, &neterr)
+}
+
+func (p retrypolicy) backoff(n int) time.Duration {
+	d := p.wait << uint(n)
+	if d > p.maxwait || d <= 0 {
+		d = p.maxwait
+	}
+	if p.jitter > 0 {
+		d = d - time.Duration(rand.Float64()*p.jitter*float64(d))
+	}
+	return d
+}
+
+func retry(name string, fn func() error) error {
+	var err error
+	for n := 0; n < retrypol.attempts; n++ {
+		if n != 0 {
+			wait := retrypol.backoff(n - 1)
+			log.Println("retry", name, n, "after", wait, err)
+			time.Sleep(wait)
+		}
+		refreshcreds()
+		if err = authed(fn); !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func listpage(bkt *s3.Bucket, prefix, delim, marker string) (rsp *s3.ListResp, err error) {
+	err = retry("list s3://"+bkt.Name+"/"+prefix, func() error {
+		rsp, err = bkt.List(prefix, delim, marker, 1000)
+		return err
+	})
+	return
+}
+
+func getservice() (rsp *s3.GetServiceResp, err error) {
+	err = retry("list buckets", func() error {
+		rsp, err = s3cl.GetService()
+		return err
+	})
+	return
+}
+
+func listmultis(bkt *s3.Bucket, prefix, delim string) (multis []*s3.Multi, prefixes []string, err error) {
+	err = retry("listmulti s3://"+bkt.Name+"/"+prefix, func() error {
+		multis, prefixes, err = bkt.ListMulti(prefix, delim)
+		return err
+	})
+	return
+}
+
+func getresponse(bkt *s3.Bucket, key, vid string, hdr http.Header) (rsp *http.Response, err error) {
+	err = retry("get s3://"+bkt.Name+"/"+key, func() error {
+		rsp, err = getobject(bkt, key, vid, readheaders(hdr))
+		return err
+	})
+	return
+}
+
+// HEAD of current version
+func headobj(bkt *s3.Bucket, key string) (*http.Response, error) {
+	return headversion(bkt, key, "")
+}
+
+func headversion(bkt *s3.Bucket, key, vid string) (rsp *http.Response, err error) {
+	err = retry("head s3://"+bkt.Name+"/"+key, func() error {
+		rsp, err = headobject(bkt, key, vid, readheaders(nil))
+		return err
+	})
+	return
+}
+
+func putreader(bkt *s3.Bucket, key string, rd io.ReadSeeker, size int64, ctyp string, opts putopts) error {
+	opts.Options = sseoptions(opts.Options)
+	return retry("put s3://"+bkt.Name+"/"+key, func() error {
+		if _, err := rd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if streaming(bkt.S3) || len(opts.header) != 0 {
+			rsp, err := putstream(bkt, key, nil, putheaders(ctyp, opts), rd, size)
+			if err == nil {
+				rsp.Body.Close()
+			}
+			return err
+		}
+		return bkt.PutReader(key, rd, size, ctyp, s3.Private, opts.Options)
+	})
+}
+
+func putcopy(bkt *s3.Bucket, key string, opts s3.CopyOptions, source, vid string) (res *s3.CopyObjectResult, err error) {
+	err = retry("copy "+source+" s3://"+bkt.Name+"/"+key, func() error {
+		res, err = copyobject(bkt, key, opts, source, vid)
+		return err
+	})
+	return
+}
+
+func delobj(bkt *s3.Bucket, key string) error {
+	return retry("delete s3://"+bkt.Name+"/"+key, func() error {
+		return bkt.Del(key)
+	})
+}
+
+// DeleteObjects accepts up to 1000 keys per request. returns errors of keys not deleted
+func delmulti(bkt *s3.Bucket, objs []s3.Object) map[string]error {
+	errs := map[string]error{}
+	for len(objs) != 0 {
+		n := len(objs)
+		if n > 1000 {
+			n = 1000
+		}
+		res, err := delchunk(bkt, objs[:n])
+		if err != nil {
+			log.Println("delmulti", bkt.Name, n, err)
+			for _, o := range objs[:n] {
+				errs[o.Key] = err
+			}
+		}
+		for _, e := range res.Errors {
+			errs[e.Key] = &s3.Error{StatusCode: http.StatusOK, Code: e.Code, Message: e.Code + ": " + e.Message, BucketName: bkt.Name}
+		}
+		objs = objs[n:]
+	}
+	return errs
+}
+
+// goamz DelMulti ignores errors of each key
+type deleteresult struct {
+	Errors []struct {
+		Key       string
+		VersionId string
+		Code      string
+		Message   string
+	} `xml:"Error"`
+}
+
+func delchunk(bkt *s3.Bucket, objs []s3.Object) (res deleteresult, err error) {
+	doc, err := xml.Marshal(s3.Delete{Quiet: true, Objects: objs})
+	if err != nil {
+		return
+	}
+	sum := md5.Sum(doc)
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "text/xml")
+	hdr.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	err = retry("delmulti s3://"+bkt.Name, func() error {
+		rsp, err := s3do(bkt, "POST", "", url.Values{"delete": {""}}, hdr, doc)
+		if err != nil {
+			return err
+		}
+		defer rsp.Body.Close()
+		res = deleteresult{}
+		return xml.NewDecoder(rsp.Body).Decode(&res)
+	})
+	return
+}
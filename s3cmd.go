@@ -6,11 +6,9 @@ import (
 	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -27,7 +25,6 @@ import (
 	"github.com/AdRoll/goamz/s3"
 	"github.com/cheggaaa/pb"
 	"github.com/urfave/cli"
-	"github.com/vaughan0/go-ini"
 	"github.com/wtnb75/go-cmdrepl"
 )
 
@@ -38,6 +35,21 @@ type Config struct {
 	StorageAPI       string `json:"storage_api"`
 	Debug            bool   `json:"debug"`
 	Force_path_style bool   `json:"force_path_style"`
+	// v2 or v4. region and payload (signed, unsigned, chunked) for v4
+	Signature string `json:"signature,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+	// temporary credentials, assume role
+	SessionToken         string `json:"session_token,omitempty"`
+	RoleArn              string `json:"role_arn,omitempty"`
+	ExternalId           string `json:"external_id,omitempty"`
+	RoleSessionName      string `json:"role_session_name,omitempty"`
+	DurationSeconds      int    `json:"duration_seconds,omitempty"`
+	MfaSerial            string `json:"mfa_serial,omitempty"`
+	WebIdentityTokenFile string `json:"web_identity_token_file,omitempty"`
+	StsEndpoint          string `json:"sts_endpoint,omitempty"`
+	// named profiles selected by --profile
+	Profiles map[string]Config `json:"profiles,omitempty"`
 }
 
 var verbose bool = false
@@ -50,11 +62,17 @@ func usage() {
 func url2bktpath(s3cl *s3.S3, ustr string) (*s3.Bucket, string, error) {
 	u, err := url.Parse(ustr)
 	if err != nil {
-		log.Fatal("url parse", err)
+		return nil, "", err
 	}
 	if u.Scheme != "s3" && u.Scheme != "dag" {
 		return nil, "", fmt.Errorf("invalid scheme: %s", u.Scheme)
 	}
+	if u.User != nil {
+		// s3://profile@bucket/key
+		if s3cl, err = profileclient(u.User.Username()); err != nil {
+			return nil, "", err
+		}
+	}
 	bkt := s3cl.Bucket(u.Host)
 	key := u.Path
 	if strings.HasPrefix(key, "/") {
@@ -63,28 +81,34 @@ func url2bktpath(s3cl *s3.S3, ustr string) (*s3.Bucket, string, error) {
 	return bkt, key, nil
 }
 
-func mb(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, us := range args {
+func mb(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	fail := newfailures()
+	for _, us := range c.Args() {
 		bkt, _, err := url2bktpath(s3cl, us)
-		err = bkt.PutBucket(s3.Private)
-		if err != nil {
-			log.Fatal("PutBucket", err)
+		if err == nil {
+			err = bkt.PutBucket(s3.Private)
 		}
+		fail.add(us, err)
 	}
+	return fail.result("mb")
 }
 
-func rb(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, us := range args {
+func rb(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	fail := newfailures()
+	for _, us := range c.Args() {
 		bkt, _, err := url2bktpath(s3cl, us)
-		err = bkt.DelBucket()
-		if err != nil {
-			log.Fatal("DelBucket", err)
+		if err == nil {
+			err = bkt.DelBucket()
 		}
+		fail.add(us, err)
 	}
+	return fail.result("rb")
 }
 
 func lsshowd(bkt *s3.Bucket, k string, longfmt bool) {
@@ -93,66 +117,90 @@ func lsshowd(bkt *s3.Bucket, k string, longfmt bool) {
 
 func lsshow(bkt *s3.Bucket, k s3.Key, longfmt bool) {
 	if longfmt {
-		fmt.Printf("%v %10d  %s %s s3://%s/%s\n", k.LastModified, k.Size, k.ETag, k.Owner.DisplayName, bkt.Name, k.Key)
+		fmt.Printf("%v %10d  %-19s %s %s s3://%s/%s\n", k.LastModified, k.Size, keyclass(k), k.ETag, k.Owner.DisplayName, bkt.Name, k.Key)
 	} else {
 		fmt.Printf("%v %10d  s3://%s/%s\n", k.LastModified, k.Size, bkt.Name, k.Key)
 	}
 }
 
-func ls(c *cli.Context) {
-	setup(c)
+func ls(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	out := newoutput()
 	if len(c.Args()) == 0 {
 		// GetService
-		gs, err := s3cl.GetService()
+		gs, err := getservice()
 		if err != nil {
-			log.Fatal("GetService", gs, err)
+			return err
+		}
+		if out.text() {
+			fmt.Println("Owner:", gs.Owner.DisplayName)
 		}
-		fmt.Println("Owner:", gs.Owner.DisplayName)
 		u, _ := url.Parse("s3://dummy")
 		for _, b := range gs.Buckets {
 			u.Host = b.Name
-			fmt.Printf("%v  %s\n", b.CreationDate, u)
+			out.emit(record{Bucket: b.Name, LastModified: b.CreationDate, Owner: gs.Owner.DisplayName, Prefix: true}, func() {
+				fmt.Printf("%v  %s\n", b.CreationDate, u)
+			})
 		}
-	} else {
-		for _, us := range c.Args() {
-			bkt, prefix, err := url2bktpath(s3cl, us)
+		return out.close()
+	}
+	fail := newfailures()
+	for _, us := range c.Args() {
+		bkt, prefix, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		var marker string
+		delim := "/"
+		if c.Bool("recursive") {
+			delim = ""
+		}
+		if c.Bool("versions") {
+			fail.add(us, lsversions(bkt, prefix, delim, out))
+			continue
+		}
+		for {
+			rsp, err := listpage(bkt, prefix, delim, marker)
 			if err != nil {
-				log.Fatal("invalid url:", err)
+				fail.add(us, err)
+				break
 			}
-			var marker string
-			delim := "/"
-			if c.Bool("recursive") {
-				delim = ""
+			// log.Printf("list result: %+v", rsp)
+			for _, k := range rsp.CommonPrefixes {
+				out.emit(prefixrecord(bkt, k), func() { lsshowd(bkt, k, c.Bool("long")) })
 			}
-			for {
-				rsp, err := bkt.List(prefix, delim, marker, 1000)
-				if err != nil {
-					log.Println("error List", err)
-					break
-				}
-				// log.Printf("list result: %+v", rsp)
-				for _, k := range rsp.CommonPrefixes {
-					lsshowd(bkt, k, c.Bool("long"))
-				}
-				for _, k := range rsp.Contents {
-					// log.Printf("%+v\n", k)
-					lsshow(bkt, k, c.Bool("long"))
-				}
-				marker = rsp.NextMarker
-				if !rsp.IsTruncated {
-					break
+			for _, k := range rsp.Contents {
+				// log.Printf("%+v\n", k)
+				if !pathflt.match(strings.TrimPrefix(k.Key, prefix)) {
+					continue
 				}
+				out.emit(keyrecord(bkt, k), func() { lsshow(bkt, k, c.Bool("long")) })
+			}
+			marker = rsp.NextMarker
+			if !rsp.IsTruncated {
+				fail.success()
+				break
 			}
 		}
 	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("ls")
 }
 
-func geturl(c *cli.Context) {
-	setup(c)
+func geturl(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	out := newoutput()
+	fail := newfailures()
 	for _, us := range c.Args() {
 		bkt, prefix, err := url2bktpath(s3cl, us)
 		if err != nil {
-			log.Fatal("invalid url:", err)
+			return usageerr("invalid url: %s %v", us, err)
 		}
 		var marker string
 		delim := "/"
@@ -160,250 +208,438 @@ func geturl(c *cli.Context) {
 			delim = ""
 		}
 		for {
-			rsp, err := bkt.List(prefix, delim, marker, 1000)
+			rsp, err := listpage(bkt, prefix, delim, marker)
 			if err != nil {
-				log.Println("error List", err)
+				fail.add(us, err)
 				break
 			}
 			for _, k := range rsp.Contents {
 				// log.Printf("%+v\n", k)
-				fmt.Println(bkt.SignedURL(k.Key, time.Now().Add(c.Duration("expires"))))
+				rec := keyrecord(bkt, k)
+				rec.URL = presignurl(bkt, k.Key, time.Now().Add(c.Duration("expires")))
+				out.emit(rec, func() { fmt.Println(rec.URL) })
 			}
 			marker = rsp.NextMarker
 			if !rsp.IsTruncated {
+				fail.success()
 				break
 			}
 		}
 	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("list-url")
 }
 
-func la(c *cli.Context) {
-	setup(c)
-	gs, err := s3cl.GetService()
+func la(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	gs, err := getservice()
 	if err != nil {
-		log.Fatal("GetService ", err)
+		return err
 	}
+	out := newoutput()
+	fail := newfailures()
 	for _, b := range gs.Buckets {
 		bkt := s3cl.Bucket(b.Name)
 		var marker string
 		for {
-			rsp, err := bkt.List("", "", marker, 1000)
+			rsp, err := listpage(bkt, "", "", marker)
 			if err != nil {
-				log.Println("error List", err)
+				fail.add("s3://"+bkt.Name, err)
 				break
 			}
 			for _, k := range rsp.Contents {
-				fmt.Printf("%v %10d  s3://%s/%s\n", k.LastModified, k.Size, bkt.Name, k.Key)
+				out.emit(keyrecord(bkt, k), func() {
+					fmt.Printf("%v %10d  s3://%s/%s\n", k.LastModified, k.Size, bkt.Name, k.Key)
+				})
 			}
 			marker = rsp.NextMarker
 			if !rsp.IsTruncated {
+				fail.success()
 				break
 			}
 		}
 	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("la")
 }
 
-func exists(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, us := range args {
+func exists(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	for _, us := range c.Args() {
 		bkt, key, err := url2bktpath(s3cl, us)
 		if err != nil {
-			log.Fatal("url", err)
+			return usageerr("invalid url: %s %v", us, err)
 		}
 		r, err := bkt.Exists(key)
 		if err != nil {
-			log.Fatal("head", err)
+			return err
 		}
 		if r {
 			fmt.Println(us)
 		} else {
-			log.Println(us, "does not exists")
-			os.Exit(1)
+			return exitError{code: exitNotFound, msg: us + " does not exists"}
 		}
 	}
+	return nil
 }
 
-func head(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, us := range args {
+func head(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if err := checkversion(c, 1); err != nil {
+		return err
+	}
+	out := newoutput()
+	fail := newfailures()
+	for _, us := range c.Args() {
 		bkt, key, err := url2bktpath(s3cl, us)
 		if err != nil {
-			log.Fatal("url parse ", us, err)
+			return usageerr("invalid url: %s %v", us, err)
 		}
-		r, err := bkt.Head(key, map[string][]string{})
-		if err != nil {
-			log.Fatal("head", r, err)
+		r, err := headversion(bkt, key, srcversion)
+		fail.add(us, err)
+		if err == nil {
+			out.emit(headrecord(bkt, key, r), func() { r.Write(os.Stdout) })
 		}
-		r.Write(os.Stdout)
 		// fmt.Printf("%+v %+v\n", u, r)
 	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("head")
 }
 
-func reader_s3(s3cl *s3.S3, urlstr string, hdr http.Header) (res io.ReadCloser) {
+func reader_s3(s3cl *s3.S3, urlstr, vid string, hdr http.Header) (io.ReadCloser, error) {
 	bkt, key, err := url2bktpath(s3cl, urlstr)
 	if err != nil {
-		log.Fatal("url parse ", urlstr, err)
+		return nil, err
 	}
-	rsp, err := bkt.GetResponseWithHeaders(key, hdr)
-	if err != nil || rsp == nil {
-		log.Fatal("reader error ", urlstr, err)
-		return nil
+	rsp, err := getresponse(bkt, key, vid, hdr)
+	if err != nil {
+		return nil, err
 	}
-	return rsp.Body
+	return rsp.Body, nil
 }
 
-func cat(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, us := range args {
+// copy object to writer
+func cats3(wr io.Writer, us, vid string, hdr http.Header) error {
+	var rd io.ReadCloser
+	var err error
+	if restoreopt.wait {
+		bkt, key, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return err
+		}
+		if err := waitrestore(bkt, key); err != nil {
+			return err
+		}
+	}
+	if encrypting() {
+		rd, err = cryptreader(us, vid, hdr.Get("Range"))
+	} else {
+		rd, err = reader_s3(s3cl, us, vid, hdr)
+	}
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	_, err = io.Copy(wr, rd)
+	return err
+}
+
+func s3raw(bkt *s3.Bucket, method, key string, params url.Values, hdr http.Header, body []byte) (*http.Response, error) {
+	var rsp *http.Response
+	err := retry(method+" s3://"+bkt.Name+"/"+key, func() (err error) {
+		rsp, err = s3do(bkt, method, key, params, hdr, body)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// signed request without retry
+func s3do(bkt *s3.Bucket, method, key string, params url.Values, hdr http.Header, body []byte) (*http.Response, error) {
+	var req *http.Request
+	var err error
+	if signer := v4signer(bkt.S3); signer != nil {
+		var ou *url.URL
+		if ou, err = objurl(bkt, key, params); err == nil {
+			req, err = signedrequest(signer, method, ou, hdr, body)
+		}
+	} else {
+		if req, err = http.NewRequest(method, v2url(bkt, method, key, params, hdr), bytes.NewReader(body)); err == nil {
+			for k, v := range hdr {
+				req.Header[k] = v
+			}
+			req.ContentLength = int64(len(body))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode >= 300 {
+		defer rsp.Body.Close()
+		return nil, s3error(rsp)
+	}
+	return rsp, nil
+}
+
+func cat(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if err := checkversion(c, 1); err != nil {
+		return err
+	}
+	fail := newfailures()
+	for _, us := range c.Args() {
 		if c.Bool("recursive") {
-			res := lists3(us, "")
+			res, err := lists3(us, "")
+			if err != nil {
+				fail.add(us, err)
+				continue
+			}
 			for k, v := range res {
 				if v.size != 0 {
-					rd := reader_s3(s3cl, us+k, make(http.Header))
-					io.Copy(os.Stdout, rd)
-					rd.Close()
+					fail.add(us+k, cats3(os.Stdout, us+k, "", make(http.Header)))
 				}
 			}
 		} else {
-			rd := reader_s3(s3cl, us, make(http.Header))
-			io.Copy(os.Stdout, rd)
-			rd.Close()
+			fail.add(us, cats3(os.Stdout, us, srcversion, make(http.Header)))
 		}
 	}
+	return fail.result("cat")
 }
 
-func get(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, us := range args {
+func get(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if err := checkversion(c, 1); err != nil {
+		return err
+	}
+	if c.Bool("recursive") {
+		return getrecursive(c)
+	}
+	fail := newfailures()
+	for _, us := range c.Args() {
 		outf := path.Base(us)
 		fmt.Println("start get", us, "=>", outf)
 		st := time.Now()
+		bkt, key, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		if restoreopt.wait {
+			if err := waitrestore(bkt, key); err != nil {
+				fail.add(us, err)
+				continue
+			}
+		}
 		ofp, err := os.Create(outf)
 		if err != nil {
-			log.Fatal("create", err)
+			fail.add(us, err)
+			continue
 		}
-		rd := reader_s3(s3cl, us, make(http.Header))
-		ncp, _ := io.Copy(ofp, rd)
+		ncp, err := getfile(bkt, key, srcversion, ofp)
 		ofp.Close()
-		rd.Close()
+		fail.add(us, err)
 		fmt.Println("finished", time.Since(st), ncp)
 	}
+	return fail.result("get")
 }
 
-func catrange(c *cli.Context) {
-	setup(c)
-	args := c.Args()
+func catrange(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
 	// range=NNN-YYY
 	rstr := c.String("range")
-	for _, us := range args {
+	fail := newfailures()
+	for _, us := range c.Args() {
 		hdr := make(http.Header)
 		hdr.Set("Range", "bytes="+rstr)
 		log.Printf("hdr=%+v\n", hdr)
-		rd := reader_s3(s3cl, us, hdr)
-		io.Copy(os.Stdout, rd)
-		rd.Close()
+		fail.add(us, cats3(os.Stdout, us, "", hdr))
 	}
+	return fail.result("getrange")
 }
 
-func put(c *cli.Context) {
-	setup(c)
-	ctyp := c.String("content-type")
+func put(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if c.Bool("recursive") {
+		return putrecursive(c)
+	}
+	mimedet, err := newmimedetector(c)
+	if err != nil {
+		return usageerr("mime map: %v", err)
+	}
 	args := c.Args()
+	if len(args) < 2 {
+		return usageerr("put needs src and dst")
+	}
 	dst := args[len(args)-1]
 	src := args[0 : len(args)-1]
 	dstbkt, dstbase, err := url2bktpath(s3cl, dst)
 	if err != nil {
-		log.Fatal("url parse ", dst, err)
+		return usageerr("invalid url: %s %v", dst, err)
 	}
+	fail := newfailures()
 	for _, s := range src {
 		dstkey := dstbase
 		if len(src) != 1 {
 			dstkey = path.Join(dstbase, path.Base(s))
 		}
-		if ifp, err := os.Open(s); err == nil {
-			fmt.Printf("start put %s => s3://%s/%s\n", s, dstbkt.Name, dstkey)
-			fi, _ := ifp.Stat()
-			st := time.Now()
-			err = dstbkt.PutReader(dstkey, ifp, fi.Size(), ctyp, s3.Private, s3.Options{})
-			if err != nil {
-				log.Println("put error", err)
-			}
+		ifp, err := os.Open(s)
+		if err != nil {
+			fail.add(s, err)
+			continue
+		}
+		fmt.Printf("start put %s => s3://%s/%s\n", s, dstbkt.Name, dstkey)
+		fi, err := ifp.Stat()
+		if err == nil && fi.IsDir() {
+			err = fmt.Errorf("is a directory (use -R)")
+		} else if err == nil && !fi.Mode().IsRegular() {
+			err = fmt.Errorf("not a regular file")
+		}
+		if err != nil {
 			ifp.Close()
-			fmt.Println("finished", time.Since(st), fi.Size())
+			fail.add(s, err)
+			continue
 		}
+		ctyp, opts := uploadoptions(s, mimedet.typeof(s, ifp), putopts{})
+		st := time.Now()
+		err = s3store(dstbkt).write(dstkey, ifp, fi.Size(), ctyp, opts)
+		ifp.Close()
+		fail.add(s, err)
+		fmt.Println("finished", time.Since(st), fi.Size())
 	}
+	return fail.result("put")
 }
 
-func cp(c *cli.Context) {
-	setup(c)
+func cp(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
 	args := c.Args()
-	dst := args[len(args)-1]
+	if len(args) < 2 {
+		return usageerr("cp needs src and dst")
+	}
+	if err := checkversion(c, 2); err != nil {
+		return err
+	}
+	dst := withprofile(args[len(args)-1], c.String("dst-profile"))
 	src := args[0 : len(args)-1]
-	dstbkt, dstbase, err := url2bktpath(s3cl, dst)
+	dstst, dstbase, err := openstorage(dst)
 	if err != nil {
-		log.Fatal("url parse ", dst, err)
+		return usageerr("invalid url: %s %v", dst, err)
+	}
+	opt, err := syncoption(c)
+	if err != nil {
+		return err
 	}
 	for _, s := range src {
+		s = withprofile(s, c.String("src-profile"))
+		srcst, srckey, err := openstorage(s)
+		if err != nil {
+			return usageerr("invalid url: %s %v", s, err)
+		}
+		srcst = versionstore(srcst, srcversion)
 		dstkey := dstbase
-		if len(src) != 1 {
-			dstkey = path.Join(dstbase, path.Base(s))
+		_, local := dstst.(*filestorage)
+		if fi, err := os.Stat(dstbase); len(src) != 1 || (local && err == nil && fi.IsDir()) {
+			dstkey = dstst.join(dstbase, path.Base(filepath.ToSlash(srckey)))
 		}
-		srcbkt, srckey, err := url2bktpath(s3cl, s)
+		info, err := srcst.stat(srckey)
 		if err != nil {
-			log.Fatal("url parse ", dst, err)
+			opt.Fail.add(s, err)
+			continue
 		}
-		log.Printf("copy %s => s3://%s/%s", s, dstbkt.Name, dstkey)
-		res, err := dstbkt.PutCopy(dstkey, s3.Private, s3.CopyOptions{}, fmt.Sprintf("/%s/%s", srcbkt.Name, srckey))
-		if err != nil {
-			log.Println("putcopy", res, err)
+		log.Printf("copy %s => %s", s, dstst.url(dstkey))
+		if opt.Dry {
+			continue
 		}
+		opt.Fail.add(s, transfer(dstst, dstkey, srcst, srckey, info.size, opt))
 	}
+	return opt.Fail.result("cp")
 }
 
-func del(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, s := range args {
+func del(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if err := checkversion(c, 1); err != nil {
+		return err
+	}
+	fail := newfailures()
+	for _, s := range c.Args() {
+		bkt, key, err := url2bktpath(s3cl, s)
+		if err != nil {
+			return usageerr("invalid url: %s %v", s, err)
+		}
 		if c.Bool("recursive") {
-			res := lists3(s, "")
-			objs := s3.Delete{Quiet: true}
+			res, err := lists3(s, "")
+			if err != nil {
+				fail.add(s, err)
+				continue
+			}
+			objs := []s3.Object{}
 			for k, _ := range res {
-				urltodel := s + k
-				_, key, _ := url2bktpath(s3cl, urltodel)
-				objs.Objects = append(objs.Objects, s3.Object{Key: key})
+				objs = append(objs, s3.Object{Key: key + k})
 			}
-			bkt, _, err := url2bktpath(s3cl, s)
-			err = bkt.DelMulti(objs)
-			log.Println("delmulti", err)
-		} else {
-			bkt, key, err := url2bktpath(s3cl, s)
-			if err != nil {
-				log.Fatal("url parse ", s, err)
+			errs := delmulti(bkt, objs)
+			log.Println("delmulti", len(objs), "failed", len(errs))
+			for _, o := range objs {
+				fail.add("s3://"+bkt.Name+"/"+o.Key, errs[o.Key])
 			}
-			err = bkt.Del(key)
+		} else if srcversion != "" {
+			err = delversion(bkt, key, srcversion)
+			log.Println("delete:", s, srcversion, err)
+			fail.add(s, err)
+		} else {
+			err = delobj(bkt, key)
 			log.Println("delete:", s, err)
+			fail.add(s, err)
 		}
 	}
+	return fail.result("del")
 }
 
-func du(c *cli.Context) {
-	setup(c)
+func du(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	out := newoutput()
 	var total_cnt, total_sz int64
+	fail := newfailures()
 	for _, us := range c.Args() {
 		bkt, prefix, err := url2bktpath(s3cl, us)
 		if err != nil {
-			log.Fatal("invalid url:", err)
+			return usageerr("invalid url: %s %v", us, err)
 		}
 		var marker string
 		var cnt, sz int64
 		for {
-			rsp, err := bkt.List(prefix, "", marker, 1000)
+			rsp, err := listpage(bkt, prefix, "", marker)
 			if err != nil {
-				log.Println("error List", err)
+				fail.add(us, err)
 				break
 			}
 			for _, k := range rsp.Contents {
@@ -412,33 +648,44 @@ func du(c *cli.Context) {
 			}
 			marker = rsp.NextMarker
 			if !rsp.IsTruncated {
+				fail.success()
 				break
 			}
 		}
-		fmt.Printf("%12d %6d s3://%s/%s\n", sz, cnt, bkt.Name, prefix)
+		out.emit(record{Bucket: bkt.Name, Key: prefix, Size: sz, Count: cnt, Prefix: true}, func() {
+			fmt.Printf("%12d %6d s3://%s/%s\n", sz, cnt, bkt.Name, prefix)
+		})
 		total_cnt += cnt
 		total_sz += sz
 	}
-	if len(c.Args()) > 1 {
+	if len(c.Args()) > 1 && out.text() {
 		fmt.Printf("%12d %6d total\n", total_sz, total_cnt)
 	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("du")
 }
 
-func da(c *cli.Context) {
-	setup(c)
-	gs, err := s3cl.GetService()
+func da(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	gs, err := getservice()
 	if err != nil {
-		log.Fatal("GetService ", err)
+		return err
 	}
+	out := newoutput()
 	var total_sz, total_cnt int64
+	fail := newfailures()
 	for _, b := range gs.Buckets {
 		bkt := s3cl.Bucket(b.Name)
 		var sz, cnt int64
 		var marker string
 		for {
-			rsp, err := bkt.List("", "", marker, 1000)
+			rsp, err := listpage(bkt, "", "", marker)
 			if err != nil {
-				log.Println("error List", err)
+				fail.add("s3://"+bkt.Name, err)
 				break
 			}
 			for _, k := range rsp.Contents {
@@ -447,363 +694,670 @@ func da(c *cli.Context) {
 			}
 			marker = rsp.NextMarker
 			if !rsp.IsTruncated {
+				fail.success()
 				break
 			}
 		}
-		fmt.Printf("%12d %6d s3://%s\n", sz, cnt, bkt.Name)
+		out.emit(record{Bucket: bkt.Name, Size: sz, Count: cnt, Prefix: true}, func() {
+			fmt.Printf("%12d %6d s3://%s\n", sz, cnt, bkt.Name)
+		})
 		total_cnt += cnt
 		total_sz += sz
 	}
-	fmt.Printf("%12d %6d total\n", total_sz, total_cnt)
+	if out.text() {
+		fmt.Printf("%12d %6d total\n", total_sz, total_cnt)
+	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("da")
 }
 
-func putmulti(c *cli.Context) {
-	setup(c)
+func putmulti(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
 	args := c.Args()
+	if len(args) < 2 {
+		return usageerr("putmulti needs src and dst")
+	}
 	// 16MB split upload
 	var sepsz int64
 	sepsz = int64(c.Int("split"))
+	mimedet, err := newmimedetector(c)
+	if err != nil {
+		return usageerr("mime map: %v", err)
+	}
 	dst := args[len(args)-1]
 	src := args[0 : len(args)-1]
 	dstbkt, dstbase, err := url2bktpath(s3cl, dst)
 	if err != nil {
-		log.Fatal("url parse ", dst, err)
+		return usageerr("invalid url: %s %v", dst, err)
 	}
+	fail := newfailures()
 	for _, s := range src {
 		dstkey := dstbase
 		if len(src) != 1 {
 			dstkey = path.Join(dstbase, path.Base(s))
 		}
-		if ifp, err := os.Open(s); err == nil {
-			fi, err := ifp.Stat()
-			if err != nil {
-				log.Println("stat failed", err)
-				ifp.Close()
-				continue
-			}
-			st := time.Now()
-			if fi.Size() > sepsz {
-				fmt.Printf("multipart upload %s => s3://%s/%s\n", s, dstbkt.Name, dstkey)
-				multi, err := dstbkt.InitMulti(dstkey, c.String("content-type"), s3.Private, s3.Options{})
-				log.Println("initmulti:", multi, err)
-				parts, err := multi.PutAll(ifp, sepsz)
-				log.Println("putall:", parts, err)
-				err = multi.Complete(parts)
-				log.Println("complete:", err)
-			} else {
-				fmt.Printf("normal put %s => s3://%s/%s\n", s, dstbkt.Name, dstkey)
-				dstbkt.PutReader(dstkey, ifp, fi.Size(), c.String("content-type"), s3.Private, s3.Options{})
-			}
+		ifp, err := os.Open(s)
+		if err != nil {
+			fail.add(s, err)
+			continue
+		}
+		fi, err := ifp.Stat()
+		if err != nil {
 			ifp.Close()
-			fmt.Println("finished", time.Since(st), fi.Size())
+			fail.add(s, err)
+			continue
 		}
+		ctyp := mimedet.typeof(s, ifp)
+		st := time.Now()
+		if encrypting() {
+			fmt.Printf("encrypted upload %s => s3://%s/%s\n", s, dstbkt.Name, dstkey)
+			err = transfer(s3store(dstbkt), dstkey, &filestorage{}, s, fi.Size(), SyncOption{Split: csealign(sepsz), SplitParallel: 1, Mime: mimedet})
+		} else if fi.Size() > sepsz {
+			fmt.Printf("multipart upload %s => s3://%s/%s\n", s, dstbkt.Name, dstkey)
+			opts := putopts{}
+			if c.Bool("store-md5") {
+				if sum, err := filemd5(s); err == nil {
+					opts.Meta = map[string][]string{metamd5: {sum}}
+				}
+			}
+			ctyp, opts := uploadoptions(s, ctyp, opts)
+			err = putmultipart(dstbkt, dstkey, ifp, sepsz, ctyp, opts)
+		} else {
+			fmt.Printf("normal put %s => s3://%s/%s\n", s, dstbkt.Name, dstkey)
+			ctyp, opts := uploadoptions(s, ctyp, putopts{})
+			err = putreader(dstbkt, dstkey, ifp, fi.Size(), ctyp, opts)
+		}
+		ifp.Close()
+		fail.add(s, err)
+		fmt.Println("finished", time.Since(st), fi.Size())
 	}
+	return fail.result("putmulti")
 }
 
-func listmulti(c *cli.Context) {
-	setup(c)
-	args := c.Args()
+const minpartsize = 5 * 1024 * 1024
+
+func putmultipart(dstbkt *s3.Bucket, dstkey string, ifp s3.ReaderAtSeeker, partsz int64, ctyp string, opts putopts) error {
+	if partsz < minpartsize {
+		partsz = minpartsize
+	}
+	multi, err := initmultipart(dstbkt, dstkey, ctyp, opts)
+	if err != nil {
+		return err
+	}
+	// upload is aborted below on seek error
+	size, err := ifp.Seek(0, io.SeekEnd)
+	var parts []s3.Part
+	for offset := int64(0); offset < size && err == nil; offset += partsz {
+		n := len(parts) + 1
+		// Size() of section is partsz even for the last part
+		sectsz := partsz
+		if size-offset < sectsz {
+			sectsz = size - offset
+		}
+		sect := io.NewSectionReader(ifp, offset, sectsz)
+		var part s3.Part
+		err = retry(fmt.Sprintf("put part s3://%s/%s n=%d", dstbkt.Name, dstkey, n), func() (err error) {
+			part, err = putpart(multi, n, sect, sectsz)
+			return
+		})
+		parts = append(parts, part)
+	}
+	if err == nil {
+		err = retry("complete s3://"+dstbkt.Name+"/"+dstkey, func() error {
+			return multi.Complete(parts)
+		})
+	}
+	if err != nil {
+		if aerr := authed(multi.Abort); aerr != nil {
+			log.Println("abort multi failed", aerr)
+		}
+	}
+	return err
+}
+
+// download whole version vid of object, restart from the beginning on error
+func getfile(bkt *s3.Bucket, key, vid string, outf *os.File) (ncp int64, err error) {
+	if encrypting() {
+		// reader of encrypted object retries and resumes by itself
+		rd, err := versionstore(s3store(bkt), vid).open(key, 0, -1)
+		if err != nil {
+			return 0, err
+		}
+		defer rd.Close()
+		return io.Copy(outf, rd)
+	}
+	err = retry("get s3://"+bkt.Name+"/"+key, func() error {
+		if _, err := outf.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := outf.Truncate(0); err != nil {
+			return err
+		}
+		rsp, err := getobject(bkt, key, vid, readheaders(nil))
+		if err != nil {
+			return err
+		}
+		defer rsp.Body.Close()
+		ncp, err = io.Copy(outf, rsp.Body)
+		if err == nil && rsp.ContentLength != -1 && ncp != rsp.ContentLength {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	return
+}
+
+func listmulti(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
 	log.Println("list unfinished multipart uploads.")
 	delim := "/"
 	if c.Bool("recursive") {
 		delim = ""
 	}
-	for _, dst := range args {
+	out := newoutput()
+	fail := newfailures()
+	for _, dst := range c.Args() {
 		dstbkt, dstbase, err := url2bktpath(s3cl, dst)
 		if err != nil {
-			log.Fatal("url parse ", dst, err)
+			return usageerr("invalid url: %s %v", dst, err)
 		}
-		multis, prefx, err := dstbkt.ListMulti(dstbase, delim)
+		multis, prefx, err := listmultis(dstbkt, dstbase, delim)
 		log.Println("listmulti", dstbkt.Name, dstbase, multis, prefx, err)
+		fail.add(dst, err)
 		for _, v := range prefx {
-			lsshowd(dstbkt, v, c.Bool("longfmt"))
+			out.emit(prefixrecord(dstbkt, v), func() { lsshowd(dstbkt, v, c.Bool("longfmt")) })
 		}
 		for _, v := range multis {
-			if c.Bool("longfmt") {
+			rec := record{Bucket: v.Bucket.Name, Key: v.Key, UploadId: v.UploadId}
+			if !c.Bool("longfmt") {
+				out.emit(rec, func() { fmt.Printf("s3://%s/%s\n", v.Bucket.Name, v.Key) })
+				continue
+			}
+			parts, err := v.ListParts()
+			if err != nil {
+				fail.add(fmt.Sprintf("s3://%s/%s %s", v.Bucket.Name, v.Key, v.UploadId), err)
+				continue
+			}
+			for _, part := range parts {
+				rec.Parts = append(rec.Parts, partrecord{Part: part.N, Size: part.Size, ETag: strings.Trim(part.ETag, "\"")})
+				rec.Size += part.Size
+			}
+			rec.Count = int64(len(parts))
+			out.emit(rec, func() {
 				fmt.Printf("s3://%s/%s  %s\n", v.Bucket.Name, v.Key, v.UploadId)
-				if parts, err := v.ListParts(); err == nil {
-					var cursize int64
-					for _, part := range parts {
-						fmt.Printf("  part[%d]: ETag=%s Size=%d\n", part.N, part.ETag, part.Size)
-						cursize += part.Size
-					}
-					fmt.Printf("  current size: %d\n", cursize)
-				} else {
-					log.Println("listparts error", err)
+				for _, part := range parts {
+					fmt.Printf("  part[%d]: ETag=%s Size=%d\n", part.N, part.ETag, part.Size)
 				}
-			} else {
-				fmt.Printf("s3://%s/%s\n", v.Bucket.Name, v.Key)
-			}
+				fmt.Printf("  current size: %d\n", rec.Size)
+			})
 		}
 	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	return fail.result("listmulti")
 }
 
-func cleanmulti(c *cli.Context) {
-	setup(c)
-	args := c.Args()
+func cleanmulti(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
 	delim := "/"
 	if c.Bool("recursive") {
 		delim = ""
 	}
-	for _, dst := range args {
+	fail := newfailures()
+	for _, dst := range c.Args() {
 		dstbkt, dstbase, err := url2bktpath(s3cl, dst)
 		if err != nil {
-			log.Fatal("url parse ", dst, err)
+			return usageerr("invalid url: %s %v", dst, err)
 		}
-		multis, prefx, err := dstbkt.ListMulti(dstbase, delim)
+		multis, prefx, err := listmultis(dstbkt, dstbase, delim)
 		log.Println("listmulti", dstbkt.Name, dstbase, multis, prefx, err)
+		if err != nil {
+			fail.add(dst, err)
+			continue
+		}
 		for _, v := range multis {
 			if c.String("id") != "" && v.UploadId != c.String("id") {
 				continue
 			}
+			name := fmt.Sprintf("s3://%s/%s %s", v.Bucket.Name, v.Key, v.UploadId)
 			if c.Bool("complete") {
-				if parts, err := v.ListParts(); err == nil {
+				parts, err := v.ListParts()
+				if err == nil {
 					log.Printf("complete upload s3://%s/%s  %s  %d parts", v.Bucket.Name, v.Key, v.UploadId, len(parts))
-					if err = v.Complete(parts); err != nil {
-						log.Println("complete failed", err)
-					} else {
-						log.Println("complete success.")
-					}
-				} else {
-					log.Println("listparts", err)
+					err = v.Complete(parts)
 				}
+				fail.add(name, err)
 			} else {
 				log.Printf("aborting upload s3://%s/%s  %s", v.Bucket.Name, v.Key, v.UploadId)
-				if err := v.Abort(); err != nil {
-					log.Println("abort failed", err)
-				}
+				fail.add(name, authed(v.Abort))
 			}
 		}
 	}
+	return fail.result("cleanmulti")
 }
 
-func putpart_sub(parts []s3.Part, multi *s3.Multi, buf *bytes.Buffer) ([]s3.Part, error) {
-	if buf.Len() == 0 {
-		return parts, nil
-	}
-	rdbuf := bytes.NewReader(buf.Bytes())
-	log.Println("putpart", len(parts), buf.Len())
-	part, err := multi.PutPart(len(parts)+1, rdbuf)
-	if err != nil {
-		return parts, err
+func merge(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
 	}
-	parts = append(parts, part)
-	buf.Reset()
-	return parts, nil
-}
-
-func merge(c *cli.Context) {
-	setup(c)
 	args := c.Args()
+	if len(args) == 0 {
+		return usageerr("merge needs dst and src")
+	}
 	dst := args[0]
 	src := args[1:]
 	log.Println("src", src, "dst", dst)
 	if len(src) == 0 {
-		log.Println("empty source")
-		return
+		return usageerr("empty source")
 	}
-	dstbkt, dstbase, err := url2bktpath(s3cl, dst)
+	dstst, dstbase, err := openstorage(dst)
 	if err != nil {
-		log.Fatal("url parse ", dst, err)
+		return usageerr("invalid url: %s %v", dst, err)
 	}
-	log.Println("dst", dstbkt, dstbase)
-	srcurls := map[string]entry{}
+	log.Println("dst", dstst.url(dstbase))
+	type srcobj struct {
+		st   storage
+		info objinfo
+	}
+	srcobjs := map[string]srcobj{}
 	for _, s := range src {
-		res := lists3(s, "")
+		st, dir, err := openstorage(s)
+		if err != nil {
+			return usageerr("invalid url: %s %v", s, err)
+		}
+		res, err := expand(st, dir)
+		if err != nil {
+			return err
+		}
 		log.Println("srcfiles", s, len(res))
-		for k, v := range res {
+		for _, v := range res {
 			if v.size == 0 {
 				continue
 			}
-			srcurls[s+k] = v
+			srcobjs[st.url(v.key)] = srcobj{st, v}
 		}
 	}
 	var down, copy int
 	var downsz, copysz int64
-	for _, v := range srcurls {
-		if v.size > 5*1024*1024 {
+	for _, v := range srcobjs {
+		if v.info.size > minpartsize {
 			copy += 1
-			copysz += v.size
+			copysz += v.info.size
 		} else {
 			down += 1
-			downsz += v.size
+			downsz += v.info.size
 		}
 	}
 	log.Println("down", down, downsz)
 	log.Println("copy", copy, copysz)
 	if c.Bool("dry-run") {
-		return
+		return nil
 	}
 	urllist := []string{}
-	for k, _ := range srcurls {
+	for k, _ := range srcobjs {
 		urllist = append(urllist, k)
 	}
 	sort.Strings(urllist)
 	if len(urllist) == 0 {
-		log.Println("empty source")
-		return
+		return exitError{code: exitNotFound, msg: "empty source"}
 	}
 	if len(urllist) == 1 {
 		log.Println("single source")
-		srcbkt, srcbase, err := url2bktpath(s3cl, urllist[0])
-		res, err := dstbkt.PutCopy(dstbase, s3.Private, s3.CopyOptions{}, path.Join(srcbkt.Name, srcbase))
-		if err != nil {
-			log.Println("putcopy failed", err, res)
+		v := srcobjs[urllist[0]]
+		return transfer(dstst, dstbase, v.st, v.info.key, v.info.size, SyncOption{})
+	}
+	if encrypting() {
+		return usageerr("merge of multiple objects is not supported with encryption")
+	}
+	mu, err := dstst.initmulti(dstbase, c.String("content-type"), downsz+copysz, putopts{})
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		if aerr := mu.abort(); aerr != nil {
+			log.Println("abort multi failed", aerr)
 		}
-		return
+		return err
 	}
 	var buf bytes.Buffer
-	parts := []s3.Part{}
-	multi, err := dstbkt.InitMulti(dstbase, c.String("content-type"), s3.Private, s3.Options{})
-	if err != nil {
-		log.Fatal("init multi ", dstbase, err)
+	var n int
+	var offset int64
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		sz := int64(buf.Len())
+		if err := mu.put(n+1, offset, bytes.NewReader(buf.Bytes()), sz); err != nil {
+			return err
+		}
+		n += 1
+		offset += sz
+		buf.Reset()
+		return nil
 	}
 	for _, s := range urllist {
-		v := srcurls[s]
-		if v.size > 5*1024*1024 && (buf.Len() == 0 || buf.Len() > 5*1024*1024) {
-			parts, err = putpart_sub(parts, multi, &buf)
-			if err != nil {
-				log.Fatal("putpart ", err)
+		v := srcobjs[s]
+		if v.info.size > minpartsize && (buf.Len() == 0 || buf.Len() > minpartsize) {
+			if err := flush(); err != nil {
+				return abort(err)
 			}
-			srcbkt, srcbase, err := url2bktpath(s3cl, s)
-			if err != nil {
-				log.Fatal("src ", s, err)
-			}
-			srcbktstr := srcbkt.Name
 			log.Println("copy", s)
-			res, part, err := multi.PutPartCopy(len(parts)+1, s3.CopyOptions{}, path.Join(srcbktstr, srcbase))
+			err := mu.copy(n+1, offset, v.st, v.info.key, v.info.size)
+			if err == errcross {
+				err = transferpart(mu, n+1, offset, v.st, v.info.key, v.info.size)
+			}
 			if err != nil {
-				log.Fatal("PutPartCopy ", s, err, res)
+				return abort(fmt.Errorf("copy part %s: %v", s, err))
 			}
-			parts = append(parts, part)
+			n += 1
+			offset += v.info.size
 		} else {
-			log.Println("read", s, v.size, buf.Len())
-			rsz, err := buf.ReadFrom(reader_s3(s3cl, s, make(http.Header)))
-			if rsz != v.size || err != nil {
-				log.Fatal("copy error ", s, rsz, err)
+			log.Println("read", s, v.info.size, buf.Len())
+			rd, err := v.st.open(v.info.key, 0, -1)
+			if err != nil {
+				return abort(err)
+			}
+			rsz, err := buf.ReadFrom(rd)
+			rd.Close()
+			if err == nil && rsz != v.info.size {
+				err = fmt.Errorf("size mismatch %s: %d != %d", s, rsz, v.info.size)
+			}
+			if err != nil {
+				return abort(err)
 			}
-			if buf.Len() > 16*1024*1024 {
-				parts, err = putpart_sub(parts, multi, &buf)
-				if err != nil {
-					log.Fatal("putpartsub ", err)
+			if buf.Len() > 16*mib {
+				if err := flush(); err != nil {
+					return abort(err)
 				}
 			}
 		}
 	}
-	if len(parts) == 0 {
-		err = multi.Abort()
-		if err != nil {
-			log.Println("abort multi failed", err)
-		}
-		log.Println("single put", dstbkt.Name, dstbase)
-		err = dstbkt.Put(dstbase, buf.Bytes(), c.String("content-type"), s3.Private, s3.Options{})
-		if err != nil {
-			log.Println("put failed", err)
-		}
-	} else {
-		parts, err = putpart_sub(parts, multi, &buf)
-		if err != nil {
-			log.Fatal("PutPart(last) ", err)
-		}
-		err = multi.Complete(parts)
-		if err != nil {
-			log.Println("complete", err)
-		}
+	if n == 0 {
+		abort(nil)
+		log.Println("single put", dstst.url(dstbase))
+		return dstst.write(dstbase, bytes.NewReader(buf.Bytes()), int64(buf.Len()), c.String("content-type"), putopts{})
+	}
+	if err := flush(); err != nil {
+		return abort(err)
 	}
+	if err := mu.complete(); err != nil {
+		return abort(err)
+	}
+	return nil
 }
 
 type aclpol struct {
-	Owner struct {
+	XMLName xml.Name `xml:"AccessControlPolicy" json:"-"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty" json:"-"`
+	Owner   struct {
 		ID          string
 		DisplayName string
 	}
 	AccessControlList struct {
-		Grant []struct {
-			Grantee struct {
-				ID          string
-				DisplayName string
+		Grant []aclgrant
+	}
+}
+
+func info(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	for _, srcobj := range c.Args() {
+		srcbkt, srcbase, err := url2bktpath(s3cl, srcobj)
+		if err != nil {
+			return usageerr("invalid url: %s %v", srcobj, err)
+		}
+		fmt.Printf("s3://%s/%s\n", srcbkt.Name, srcbase)
+		if loc, err := srcbkt.Location(); err == nil {
+			fmt.Println("Location:", loc)
+		} else {
+			return err
+		}
+		if st, err := getversioning(srcbkt); err == nil && st != "" {
+			fmt.Println("Versioning:", st)
+		}
+		nver, ndel := 0, 0
+		err = walkversions(srcbkt, srcbase, func(v objversion) error {
+			if v.deletemarker() {
+				ndel += 1
+			} else {
+				nver += 1
 			}
-			Permission string
+			return nil
+		})
+		if err == nil {
+			fmt.Printf("Versions: %d, delete markers: %d\n", nver, ndel)
+		} else {
+			log.Println("versions", err)
+		}
+		if acl, err := getaclpol(srcbkt, srcbase); err == nil {
+			log.Printf("acl: %+v\n", acl)
+		}
+		if tr, err := srcbkt.Get(srcbase + "?torrent"); err == nil {
+			log.Println("torrent", tr)
 		}
 	}
+	return nil
 }
 
-func info(c *cli.Context) {
-	setup(c)
-	args := c.Args()
-	for _, srcobj := range args {
-		if srcbkt, srcbase, err := url2bktpath(s3cl, srcobj); err == nil {
-			fmt.Printf("s3://%s/%s\n", srcbkt.Name, srcbase)
-			if loc, err := srcbkt.Location(); err == nil {
-				fmt.Println("Location:", loc)
-			}
-			vers, err := srcbkt.Versions(srcbase, "/", "", "", 1000)
-			log.Println("vers", vers, err)
-			if rd, err := srcbkt.GetReader(srcbase + "?acl"); err == nil {
-				dec := xml.NewDecoder(rd)
-				var acl aclpol
-				dec.Decode(&acl)
-				log.Printf("acl: %+v\n", acl)
-			}
-			if tr, err := srcbkt.Get(srcbase + "?torrent"); err == nil {
-				log.Println("torrent", tr)
+var maxcopysize int64 = 5 * 1024 * 1024 * 1024
+
+func putcopy_multi(dstbkt *s3.Bucket, dstkey string, srcbkt *s3.Bucket, srckey, vid string, size int64, partsz int64) (string, error) {
+	// UploadPartCopy does not copy headers like CopyObject
+	rsp, err := headversion(srcbkt, srckey, vid)
+	if err != nil {
+		return "", err
+	}
+	rsp.Body.Close()
+	hdr := targetheaders(pickheaders(rsp.Header))
+	hdr.Set("x-amz-acl", string(s3.Private))
+	customerheaders(hdr, ssecprefix, sseopt.ckey)
+	multi, err := initmultiheader(dstbkt, dstkey, hdr)
+	if err != nil {
+		return "", err
+	}
+	return copyparts(multi, srcbkt, srckey, vid, size, partsz)
+}
+
+// UploadPartCopy by ranges of partsz, abort on error. returns etag of the object
+func copyparts(multi *s3.Multi, srcbkt *s3.Bucket, srckey, vid string, size int64, partsz int64) (string, error) {
+	parts := []s3.Part{}
+	for offset := int64(0); offset < size; offset += partsz {
+		last := offset + partsz - 1
+		if last >= size {
+			last = size - 1
+		}
+		opts := s3.CopyOptions{CopySourceOptions: fmt.Sprintf("bytes=%d-%d", offset, last)}
+		var part s3.Part
+		err := retry(fmt.Sprintf("copy part s3://%s/%s offset=%d", srcbkt.Name, srckey, offset), func() (err error) {
+			part, err = copypart(multi, len(parts)+1, opts, path.Join(srcbkt.Name, srckey), vid)
+			return
+		})
+		if err != nil {
+			log.Println("PutPartCopy", srckey, offset, err)
+			if aerr := authed(multi.Abort); aerr != nil {
+				log.Println("abort multi failed", aerr)
 			}
+			return "", err
 		}
+		parts = append(parts, part)
+	}
+	err := retry("complete s3://"+multi.Bucket.Name+"/"+multi.Key, func() error {
+		return multi.Complete(parts)
+	})
+	if err != nil {
+		return "", err
 	}
+	return multietag(parts), nil
 }
 
-func setacl(c *cli.Context) {
-	setup(c)
+// server side copy of version vid of source, current version if empty. returns etag of the copy
+func copyobj(dstbkt *s3.Bucket, dstkey string, srcbkt *s3.Bucket, srckey, vid string, size int64, partsz int64) (string, error) {
+	if size > maxcopysize {
+		return putcopy_multi(dstbkt, dstkey, srcbkt, srckey, vid, size, partsz)
+	}
+	res, err := putcopy(dstbkt, dstkey, s3.CopyOptions{Options: s3.Options{StorageClass: classopt}, MetadataDirective: "COPY"}, fmt.Sprintf("/%s/%s", srcbkt.Name, srckey), vid)
+	if err != nil {
+		log.Println("putcopy", res, err)
+		return "", err
+	}
+	return strings.Trim(res.ETag, "\""), nil
 }
 
-func getacl(c *cli.Context) {
-	setup(c)
+// destination has size and etag of the copy before source is deleted
+func verifycopy(dstbkt *s3.Bucket, dstkey string, size int64, etag string) error {
+	rsp, err := headobj(dstbkt, dstkey)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.ContentLength != size {
+		return fmt.Errorf("size mismatch s3://%s/%s: %d != %d", dstbkt.Name, dstkey, rsp.ContentLength, size)
+	}
+	if dstetag := strings.Trim(rsp.Header.Get("ETag"), "\""); etag == "" || dstetag != etag {
+		return fmt.Errorf("etag mismatch s3://%s/%s: %s != %s", dstbkt.Name, dstkey, dstetag, etag)
+	}
+	return nil
 }
 
-func mv(c *cli.Context) {
-	setup(c)
+// copy through encrypting storage, data key is kept or content is encrypted again
+func moveencrypted(dstbkt *s3.Bucket, dstkey string, srcbkt *s3.Bucket, srckey string, partsz int64) error {
+	src, dst := s3store(srcbkt), s3store(dstbkt)
+	info, err := src.stat(srckey)
+	if err != nil {
+		return err
+	}
+	if err := transfer(dst, dstkey, src, srckey, info.size, SyncOption{Split: partsz, SplitParallel: 1}); err != nil {
+		return err
+	}
+	res, err := dst.stat(dstkey)
+	if err != nil {
+		return err
+	}
+	if res.size != info.size {
+		return fmt.Errorf("size mismatch s3://%s/%s: %d != %d", dstbkt.Name, dstkey, res.size, info.size)
+	}
+	return nil
+}
+
+func moveobj(dstbkt *s3.Bucket, dstkey string, srcbkt *s3.Bucket, srckey string, size int64, partsz int64) error {
+	if srcbkt.Name == dstbkt.Name && srckey == dstkey {
+		return fmt.Errorf("source and destination are same: s3://%s/%s", srcbkt.Name, srckey)
+	}
+	log.Printf("move s3://%s/%s => s3://%s/%s", srcbkt.Name, srckey, dstbkt.Name, dstkey)
+	if encrypting() {
+		if err := moveencrypted(dstbkt, dstkey, srcbkt, srckey, partsz); err != nil {
+			return err
+		}
+		return delobj(srcbkt, srckey)
+	}
+	etag, err := copyobj(dstbkt, dstkey, srcbkt, srckey, "", size, partsz)
+	if err != nil {
+		return err
+	}
+	if err := verifycopy(dstbkt, dstkey, size, etag); err != nil {
+		return err
+	}
+	return delobj(srcbkt, srckey)
+}
+
+func mv(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	args := c.Args()
+	if len(args) < 2 {
+		return usageerr("mv needs src and dst")
+	}
+	partsz := int64(c.Int("split"))
+	dst := args[len(args)-1]
+	src := args[0 : len(args)-1]
+	dstbkt, dstbase, err := url2bktpath(s3cl, dst)
+	if err != nil {
+		return usageerr("invalid url: %s %v", dst, err)
+	}
+	fail := newfailures()
+	for _, s := range src {
+		srcbkt, srckey, err := url2bktpath(s3cl, s)
+		if err != nil {
+			return usageerr("invalid url: %s %v", s, err)
+		}
+		if c.Bool("recursive") {
+			res, err := lists3(s, "/")
+			if err != nil {
+				fail.add(s, err)
+				continue
+			}
+			keys := []string{}
+			for k, _ := range res {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			srcprefix := strings.TrimSuffix(srckey, "/")
+			for _, k := range keys {
+				dstkey := path.Join(dstbase, k)
+				if len(src) != 1 {
+					dstkey = path.Join(dstbase, path.Base(srcprefix), k)
+				}
+				err := moveobj(dstbkt, dstkey, srcbkt, path.Join(srcprefix, k), res[k].size, partsz)
+				fail.add(fmt.Sprintf("s3://%s/%s", srcbkt.Name, path.Join(srcprefix, k)), err)
+			}
+		} else {
+			dstkey := dstbase
+			if len(src) != 1 || dstkey == "" || strings.HasSuffix(dstkey, "/") {
+				dstkey = path.Join(dstbase, path.Base(srckey))
+			}
+			rsp, err := headobj(srcbkt, srckey)
+			if err != nil {
+				fail.add(s, err)
+				continue
+			}
+			fail.add(s, moveobj(dstbkt, dstkey, srcbkt, srckey, rsp.ContentLength, partsz))
+		}
+	}
+	return fail.result("mv")
 }
 
-func save2tar(wr *tar.Writer, bkt *s3.Bucket, key s3.Key) error {
-	rsp, err := bkt.GetResponseWithHeaders(key.Key, http.Header{})
-	if err != nil || rsp == nil {
-		log.Println("get error", bkt.Name, key.Key, err, rsp)
+func save2tar(wr *tar.Writer, st storage, info objinfo) error {
+	if info.header == nil {
+		full, err := st.stat(info.key)
 		if err != nil {
+			log.Println("stat error", st.url(info.key), err)
 			return err
 		}
-		return fmt.Errorf("null response")
+		info = full
 	}
+	rd, err := st.open(info.key, 0, -1)
+	if err != nil {
+		log.Println("get error", st.url(info.key), err)
+		return err
+	}
+	defer rd.Close()
 	hdr := new(tar.Header)
-	hdr.Name = bkt.Name + "/" + key.Key
+	hdr.Name = storagename(st, info.key)
 	hdr.Mode = 0644
+	hdr.Size = info.size
+	hdr.ModTime = info.lastmod
 	hdr.Xattrs = make(map[string]string)
-	for k, v := range rsp.Header {
+	for k, v := range info.header {
 		vv := strings.Join(v, " ")
 		hdr.Xattrs["s3.header."+k] = vv
 		switch strings.ToLower(k) {
-		case "last-modified":
-			if hdr.ModTime, err = time.Parse(time.RFC1123, vv); err != nil {
-				log.Println("time.parse(lastmod)", vv, err)
-			}
 		case "date", "x-amz-date":
 			if hdr.AccessTime, err = time.Parse(time.RFC1123, vv); err != nil {
 				log.Println("time.parse(date)", vv, err)
 			}
 		}
 	}
-	var rd io.Reader
-	if rsp.ContentLength != -1 {
-		rd = rsp.Body
-		hdr.Size = rsp.ContentLength
-	} else {
-		if bt, err := ioutil.ReadAll(rsp.Body); err == nil {
-			rd = bytes.NewReader(bt)
-			hdr.Size = int64(len(bt))
-		} else {
-			log.Println("read", err)
-			return err
-		}
-	}
 	if err = wr.WriteHeader(hdr); err != nil {
 		log.Println("header write", err)
 		return err
@@ -818,63 +1372,83 @@ func save2tar(wr *tar.Writer, bkt *s3.Bucket, key s3.Key) error {
 	return nil
 }
 
-func tarsave(c *cli.Context) {
-	setup(c)
+func tarsave(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
 	var out io.Writer
 	out = os.Stdout
 	if c.String("file") != "" {
 		fp, err := os.Create(c.String("file"))
 		if err != nil {
-			log.Println("open file", err)
-			return
+			return err
 		}
 		defer fp.Close()
 		out = fp
 	}
 	if c.Bool("gzip") {
-		gzwr := gzip.NewWriter(out)
-		defer gzwr.Close()
-		defer gzwr.Flush()
-		out = gzwr
-	}
-	wr := tar.NewWriter(out)
-	for _, arg := range c.Args() {
-		bkt, prefix, err := url2bktpath(s3cl, arg)
-		if err != nil {
-			log.Println("invalid argument:", arg)
-			continue
-		}
-		var marker string
-		for {
-			rsp, err := bkt.List(prefix, "", marker, 1000)
-			if err != nil {
-				log.Println("error List", err)
-				break
-			}
-			for _, k := range rsp.Contents {
-				if err = save2tar(wr, bkt, k); err != nil {
-					log.Println("save error", err)
-					break
-				}
-			}
-			marker = rsp.NextMarker
-			if !rsp.IsTruncated {
-				break
+		gzwr := gzip.NewWriter(out)
+		defer gzwr.Close()
+		defer gzwr.Flush()
+		out = gzwr
+	}
+	wr := tar.NewWriter(out)
+	defer wr.Close()
+	defer wr.Flush()
+	fail := newfailures()
+	for _, arg := range c.Args() {
+		st, dir, err := openstorage(arg)
+		if err != nil {
+			return usageerr("invalid url: %s %v", arg, err)
+		}
+		broken := false
+		err = st.walk(dir, func(rel string, info objinfo) error {
+			if !pathflt.match(rel) {
+				return nil
 			}
+			err := save2tar(wr, st, info)
+			fail.add(st.url(info.key), err)
+			broken = err != nil
+			return err
+		})
+		if broken {
+			// tar stream is broken
+			return fail.result("tar")
+		}
+		if err != nil {
+			fail.add(arg, err)
 		}
 	}
-	wr.Flush()
-	wr.Close()
+	return fail.result("tar")
 }
 
 type SyncEntry struct {
-	From string
-	To   string
+	From   string
+	To     string
+	Size   int64
+	src    storage
+	srckey string
+	dst    storage
+	dstkey string
+}
+
+func syncentry(src storage, srckey string, dst storage, dstkey string, size int64) *SyncEntry {
+	return &SyncEntry{From: src.url(srckey), To: dst.url(dstkey), Size: size,
+		src: src, srckey: srckey, dst: dst, dstkey: dstkey}
+}
+
+type SyncOption struct {
+	Dry           bool
+	Split         int64
+	SplitParallel int
+	Mime          *mimedetector
+	StoreMD5      bool
+	Fail          *failures
 }
 
 var pbar *pb.ProgressBar
 
-func sync_routine(ch chan *SyncEntry, wg *sync.WaitGroup, dry bool) {
+func sync_routine(ch chan *SyncEntry, wg *sync.WaitGroup, opt SyncOption) {
 	defer wg.Done()
 	for {
 		ent := <-ch
@@ -882,96 +1456,89 @@ func sync_routine(ch chan *SyncEntry, wg *sync.WaitGroup, dry bool) {
 			ch <- nil
 			break
 		}
-		if dry {
-			log.Println("copy", ent)
+		if opt.Dry {
+			log.Println("copy", ent.From, "=>", ent.To)
 			continue
 		}
-		srcbkt, srckey, srcerr := url2bktpath(s3cl, ent.From)
-		dstbkt, dstkey, dsterr := url2bktpath(s3cl, ent.To)
-		if srcerr == nil && dsterr == nil {
-			// remote copy
-			// log.Println("cp", ent)
-			res, err := dstbkt.PutCopy(dstkey, s3.Private, s3.CopyOptions{}, fmt.Sprintf("/%s/%s", srcbkt.Name, srckey))
-			if err != nil {
-				log.Println("putcopy", res, err)
-			}
-			pbar.Increment()
-		} else if srcerr == nil && dsterr != nil {
-			// sync from s3
-			// log.Println("get", ent)
-			outf, err := os.Create(ent.To)
-			if err != nil {
-				err = os.MkdirAll(filepath.Dir(ent.To), 0777)
-				if err != nil {
-					log.Println("mkdir failed", err)
-				}
-				outf, err = os.Create(ent.To)
-			}
-			// st := time.Now()
-			rd := reader_s3(s3cl, ent.From, make(http.Header))
-			ncp, _ := io.Copy(outf, rd)
-			outf.Close()
-			rd.Close()
-			pbar.Add64(ncp)
-			// log.Println("finished", time.Since(st), ncp)
-		} else if srcerr != nil && dsterr == nil {
-			// sync to s3
-			// log.Println("put", ent)
-			// st := time.Now()
-			if ifp, err := os.Open(ent.From); err == nil {
-				fi, _ := ifp.Stat()
-				dstbkt.PutReader(dstkey, ifp, fi.Size(), "application/octet-stream", s3.Private, s3.Options{})
-				ifp.Close()
-				// log.Println("finished", time.Since(st), fi.Size())
-				pbar.Add64(fi.Size())
-			} else {
-				log.Println("open failed", err)
-			}
-		} else {
-			// sync local?
-		}
+		opt.Fail.add(ent.From, transfer(ent.dst, ent.dstkey, ent.src, ent.srckey, ent.Size, opt))
+		pbar.Add64(ent.Size)
+	}
+}
+
+func syncoption(c *cli.Context) (SyncOption, error) {
+	opt := SyncOption{
+		Dry:           c.Bool("dry-run"),
+		Split:         int64(c.Int("split")),
+		SplitParallel: c.Int("split-parallel"),
+		StoreMD5:      c.Bool("store-md5"),
+		Fail:          newfailures(),
+	}
+	mimedet, err := newmimedetector(c)
+	if err != nil {
+		return opt, usageerr("mime map: %v", err)
+	}
+	opt.Mime = mimedet
+	if opt.Split > 0 && opt.Split < minpartsize {
+		log.Println("split size too small, use", minpartsize)
+		opt.Split = minpartsize
+	}
+	if encrypting() && opt.Split%csesegment != 0 {
+		// parts are encrypted by segments
+		opt.Split = csealign(opt.Split)
+		log.Println("split size aligned to encryption segment, use", opt.Split)
 	}
+	return opt, nil
 }
 
-func synccmd(c *cli.Context) {
-	setup(c)
+func synccmd(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
 	check_content := !c.Bool("size-only")
 	do_del := c.Bool("delete")
-	src := c.Args().Get(0)
-	dst := c.Args().Get(1)
-	_, _, srcerr := url2bktpath(s3cl, src)
-	_, _, dsterr := url2bktpath(s3cl, dst)
+	if len(c.Args()) != 2 {
+		return usageerr("sync needs src and dst")
+	}
+	srcurl := withprofile(c.Args().Get(0), c.String("src-profile"))
+	dsturl := withprofile(c.Args().Get(1), c.String("dst-profile"))
+	src, srcdir, err := openstorage(srcurl)
+	if err != nil {
+		return usageerr("invalid url: %s %v", srcurl, err)
+	}
+	dst, dstdir, err := openstorage(dsturl)
+	if err != nil {
+		return usageerr("invalid url: %s %v", dsturl, err)
+	}
+	opt, err := syncoption(c)
+	if err != nil {
+		return err
+	}
 	var wg sync.WaitGroup
 	ch := make(chan *SyncEntry, c.Int("parallel"))
 	log.Println("boot routine", c.Int("parallel"))
 	for i := 0; i < c.Int("parallel"); i++ {
 		wg.Add(1)
-		go sync_routine(ch, &wg, c.Bool("dry-run"))
-	}
-	defer wg.Wait()
-	if srcerr == nil && dsterr != nil {
-		log.Println("syncfrom")
-		syncfrom(src, dst, check_content, do_del, ch, c.Bool("dry-run"))
-	} else if srcerr != nil && dsterr == nil {
-		log.Println("syncto")
-		syncto(dst, src, check_content, do_del, ch, c.Bool("dry-run"))
-	} else if srcerr == nil && dsterr == nil {
-		log.Println("syncremote")
-		syncremote(src, dst, check_content, do_del, ch, c.Bool("dry-run"))
-	} else {
-		log.Fatal("src and dst are not s3 url ", src, dst)
+		go sync_routine(ch, &wg, opt)
 	}
+	err = syncdirs(src, srcdir, dst, dstdir, check_content, do_del, ch, opt)
 	ch <- nil
 	log.Println("wait finish")
+	wg.Wait()
 	if pbar != nil {
-		defer pbar.Finish()
+		pbar.Finish()
+	}
+	if err != nil {
+		return err
 	}
+	return opt.Fail.result("sync")
 }
 
 type entry struct {
 	size    int64
 	cksum   string
 	lastmod time.Time
+	st      storage
+	key     string
 }
 
 func filemd5(fn string) (string, error) {
@@ -985,31 +1552,11 @@ func filemd5(fn string) (string, error) {
 	}
 }
 
-func listlocal(basedir string) map[string]entry {
-	rst := map[string]entry{}
-	if _, err := os.Stat(basedir); os.IsNotExist(err) {
-		return rst
-	}
-	filepath.Walk(basedir, func(pathname string, info os.FileInfo, err error) error {
-		if !strings.HasPrefix(pathname, basedir) {
-			log.Println("invalid path?", pathname, basedir)
-			return err
-		}
-		pathname = strings.TrimPrefix(pathname, basedir)
-		pathname = strings.TrimPrefix(pathname, "/")
-		if info.Mode().IsRegular() {
-			rst[pathname] = entry{size: info.Size(), lastmod: info.ModTime()}
-		}
-		return err
-	})
-	return rst
-}
-
-func lists3(s3url string, delimiter string) map[string]entry {
+func lists3(s3url string, delimiter string) (map[string]entry, error) {
 	rst := map[string]entry{}
 	bkt, prefix, err := url2bktpath(s3cl, s3url)
 	if err != nil {
-		log.Fatal("invalid url:", err)
+		return nil, usageerr("invalid url: %s %v", s3url, err)
 	}
 	prefix = strings.TrimSuffix(prefix, delimiter)
 	if prefix != "" {
@@ -1017,10 +1564,10 @@ func lists3(s3url string, delimiter string) map[string]entry {
 	}
 	var marker string
 	for {
-		rsp, err := bkt.List(prefix, "", marker, 1000)
+		rsp, err := listpage(bkt, prefix, "", marker)
 		if err != nil {
-			log.Println("error List", err)
-			break
+			// partial list is dangerous for sync --delete
+			return nil, err
 		}
 		// log.Printf("list result: %+v", rsp)
 		for _, k := range rsp.Contents {
@@ -1029,28 +1576,38 @@ func lists3(s3url string, delimiter string) map[string]entry {
 			if (strings.HasSuffix(keystr, "_$folder$") || strings.HasSuffix(keystr, "/")) && k.Size == 0 {
 				continue
 			}
-			rst[keystr] = entry{size: k.Size, cksum: strings.Trim(k.ETag, "\""), lastmod: lm}
+			if !pathflt.match(keystr) {
+				continue
+			}
+			rst[keystr] = entry{size: k.Size, cksum: strings.Trim(k.ETag, "\""), lastmod: lm, st: &s3storage{bkt: bkt}, key: k.Key}
 		}
 		marker = rsp.NextMarker
 		if !rsp.IsTruncated {
 			break
 		}
 	}
-	return rst
+	return rst, nil
 }
 
-func changelist(basedir string, src, dst map[string]entry, check_content bool) (to_update []string, to_del []string, updatesz int64) {
+func changelist(src, dst map[string]entry, check_content bool, partsz int64) (to_update []string, to_del []string, updatesz int64) {
 	to_update = []string{}
 	to_del = []string{}
 	for k, s := range src {
 		if d, ok := dst[k]; ok && s.size == d.size {
 			if check_content {
-				if s.cksum == "" {
-					s.cksum, _ = filemd5(filepath.Join(basedir, k))
+				var match bool
+				if s.cksum == "" && d.cksum == "" {
+					ssum, serr := filemd5(s.key)
+					dsum, derr := filemd5(d.key)
+					match = serr == nil && derr == nil && ssum == dsum
+				} else if s.cksum == "" {
+					match = localmatch(s.key, s, d, partsz)
 				} else if d.cksum == "" {
-					d.cksum, _ = filemd5(filepath.Join(basedir, k))
+					match = localmatch(d.key, d, s, partsz)
+				} else {
+					match = remotematch(s, d)
 				}
-				if s.cksum == d.cksum {
+				if match {
 					log.Println("md5 match", k, s.cksum)
 					// pass
 					continue
@@ -1075,198 +1632,104 @@ func changelist(basedir string, src, dst map[string]entry, check_content bool) (
 	return
 }
 
-func syncto(s3url, basedir string, check_content, do_del bool, ch chan *SyncEntry, dry bool) {
-	// list localdir
-	src := listlocal(basedir)
-	log.Println("local", len(src), "files")
-	// list s3
-	dst := lists3(s3url, "/")
-	log.Println("s3", len(dst), "files")
-	to_update, to_del, usize := changelist(basedir, src, dst, check_content)
-	pbar = pb.New64(usize)
-	pbar.ShowSpeed = true
-	pbar.SetUnits(pb.U_BYTES)
-	pbar.Start()
-	// put
-	bkt, prefix, err := url2bktpath(s3cl, s3url)
+func syncdirs(src storage, srcdir string, dst storage, dstdir string, check_content, do_del bool, ch chan *SyncEntry, opt SyncOption) error {
+	srcents, err := listentries(src, srcdir)
 	if err != nil {
-		log.Println("url error", err)
-	}
-	log.Println("put", len(to_update), "files", len(to_del))
-	for _, k := range to_update {
-		dstname := fmt.Sprintf("s3://%s/%s", bkt.Name, filepath.Join(prefix, k))
-		srcname := filepath.Join(basedir, k)
-		ch <- &SyncEntry{From: srcname, To: dstname}
-	}
-	if !do_del {
-		return
-	}
-	// del
-	log.Println("del", len(to_del), "objects")
-	if dry {
-		return
-	}
-	s3d := s3.Delete{}
-	s3d.Quiet = true
-	for _, k := range to_del {
-		delname := filepath.Join(prefix, k)
-		s3d.Objects = append(s3d.Objects, s3.Object{Key: delname})
-		log.Println("del", bkt.Name, delname)
+		return err
 	}
-	if len(s3d.Objects) != 0 {
-		log.Println("emit del")
-		bkt.DelMulti(s3d)
+	log.Println("src", src.url(srcdir), len(srcents), "files")
+	dstents, err := listentries(dst, dstdir)
+	if err != nil {
+		// partial list is dangerous for sync --delete
+		return err
 	}
-}
-
-func syncfrom(s3url, basedir string, check_content, do_del bool, ch chan *SyncEntry, dry bool) {
-	// list localdir
-	dst := listlocal(basedir)
-	log.Println("local", len(dst), "files")
-	// list s3
-	src := lists3(s3url, "/")
-	log.Println("s3", len(src), "files")
-	to_update, to_del, usize := changelist(basedir, src, dst, check_content)
+	log.Println("dst", dst.url(dstdir), len(dstents), "files")
+	to_update, to_del, usize := changelist(srcents, dstents, check_content, opt.Split)
 	pbar = pb.New64(usize)
 	pbar.ShowSpeed = true
 	pbar.SetUnits(pb.U_BYTES)
 	pbar.Start()
-	// get
-	bkt, prefix, err := url2bktpath(s3cl, s3url)
-	if err != nil {
-		log.Println("url error", err)
-	}
-	log.Println("get", len(to_update), "files", len(to_del))
+	log.Println("copy", len(to_update), "files", len(to_del))
 	for _, k := range to_update {
-		dstname := filepath.Join(basedir, k)
-		srcname := filepath.Join(prefix, k)
-		us := fmt.Sprintf("s3://%s/%s", bkt.Name, srcname)
-		ch <- &SyncEntry{From: us, To: dstname}
+		ch <- syncentry(src, srcents[k].key, dst, dst.join(dstdir, k), srcents[k].size)
 	}
 	if !do_del {
-		return
+		return nil
 	}
-	// unlink
-	log.Println("unlink", to_del)
-	if dry {
-		return
+	// delete
+	log.Println("del", len(to_del), "objects")
+	if opt.Dry || len(to_del) == 0 {
+		return nil
 	}
+	keys := []string{}
 	for _, k := range to_del {
-		delname := filepath.Join(basedir, k)
-		os.Remove(delname)
+		keys = append(keys, dstents[k].key)
+		log.Println("del", dst.url(dstents[k].key))
 	}
+	return dst.remove(keys)
 }
 
-func syncremote(s3url_src, s3url_dst string, check_content, do_del bool, ch chan *SyncEntry, dry bool) {
-	// list s3_src
-	src := lists3(s3url_src, "/")
-	log.Println("s3src", len(src), "files")
-	// list s3_dst
-	dst := lists3(s3url_dst, "/")
-	log.Println("s3dst", len(dst), "files")
-	to_update, to_del, _ := changelist("", src, dst, check_content)
-	pbar = pb.New(len(to_update))
-	pbar.ShowCounters = true
-	pbar.Start()
-	// putcopy
-	log.Println("putcopy", to_update, "files", len(to_del))
-	for _, k := range to_update {
-		dsturl := fmt.Sprintf("%s/%s", s3url_dst, k)
-		srcurl := fmt.Sprintf("%s/%s", s3url_src, k)
-		ch <- &SyncEntry{From: srcurl, To: dsturl}
+func setup(c *cli.Context) error {
+	verbose = c.GlobalBool("verbose")
+	retrysetup(c)
+	if err := outputsetup(c); err != nil {
+		return err
 	}
-	if !do_del {
-		return
+	if err := ssesetup(c); err != nil {
+		return err
 	}
-	// delete
-	log.Println("del", to_del)
-	if dry {
-		return
+	if err := csesetup(c); err != nil {
+		return err
 	}
-	s3d := s3.Delete{}
-	s3d.Quiet = true
-	dstbkt, dstprefix, _ := url2bktpath(s3cl, s3url_dst)
-	for _, k := range to_del {
-		delname := filepath.Join(dstprefix, k)
-		s3d.Objects = append(s3d.Objects, s3.Object{Key: delname})
-		log.Println("del", dstbkt.Name, delname)
+	if err := headersetup(c); err != nil {
+		return err
 	}
-	if len(s3d.Objects) != 0 {
-		log.Println("emit del")
-		dstbkt.DelMulti(s3d)
+	if err := classsetup(c); err != nil {
+		return err
 	}
-}
-
-func setup(c *cli.Context) {
-	var reg aws.Region
-	var akey, skey string
-	verbose = c.GlobalBool("verbose")
-	if fp, err := os.Open(c.GlobalString("config")); err == nil {
-		dec := json.NewDecoder(fp)
-		var conf Config
-		err = dec.Decode(&conf)
-		if err != nil {
-			log.Fatal("json decode %+v %v", conf, err)
-		}
-		if conf.Debug {
-			verbose = true
-		}
-		akey = conf.AccessKey
-		skey = conf.SecretKey
-		reg.Name = "customized"
-		reg.S3Endpoint = conf.StorageAPI
-		if !conf.Force_path_style {
-			u, _ := url.Parse(reg.S3Endpoint)
-			u.Host = "${bucket}." + u.Host
-			reg.S3BucketEndpoint = u.String()
-			log.Println("not force_path_style:", reg.S3BucketEndpoint)
-		}
-		reg.S3LowercaseBucket = true
-	} else if conf, err := ini.LoadFile(c.GlobalString("s3cfg")); err == nil {
-		if v, ok := conf.Get("default", "verbosity"); ok && v == "DEBUG" {
-			verbose = true
-		}
-		if v, ok := conf.Get("default", "bucket_location"); ok {
-			reg = aws.Regions[v]
-		} else {
-			reg.Name = "customized"
-			if reg.S3Endpoint, ok = conf.Get("default", "host_base"); ok {
-				if ssl, ok := conf.Get("default", "use_https"); ok && ssl == "False" {
-					reg.S3Endpoint = "http://" + reg.S3Endpoint + "/"
-				} else {
-					reg.S3Endpoint = "https://" + reg.S3Endpoint + "/"
-				}
-			}
-			reg.S3LowercaseBucket = true
-		}
-		akey, _ = conf.Get("default", "access_key")
-		skey, _ = conf.Get("default", "secret_key")
+	restoresetup(c)
+	versionsetup(c)
+	if flt, err := newpathfilter(c); err == nil {
+		pathflt = flt
+	} else {
+		return usageerr("filter: %v", err)
+	}
+	prof, err := loadprofile(c, c.GlobalString("profile"))
+	if err != nil {
+		return err
+	}
+	if prof.debug {
+		verbose = true
 	}
 	if c.GlobalString("access_key") != "" {
-		akey = c.GlobalString("access_key")
+		prof.akey = c.GlobalString("access_key")
 	}
 	if c.GlobalString("secret_key") != "" {
-		skey = c.GlobalString("secret_key")
+		prof.skey = c.GlobalString("secret_key")
 	}
 	if c.GlobalString("region") != "" {
-		reg = aws.Regions[c.GlobalString("region")]
+		prof.reg = aws.Regions[c.GlobalString("region")]
 	}
 	if c.GlobalString("endpoint") != "" {
-		reg.Name = "customized"
-		reg.S3Endpoint = c.GlobalString("endpoint")
+		prof.reg.Name = "customized"
+		prof.reg.S3Endpoint = c.GlobalString("endpoint")
 	}
 	if c.GlobalBool("force_path_style") {
-		u, _ := url.Parse(reg.S3Endpoint)
+		u, _ := url.Parse(prof.reg.S3Endpoint)
 		u.Host = "${bucket}." + u.Host
-		reg.S3BucketEndpoint = u.String()
+		prof.reg.S3BucketEndpoint = u.String()
+	}
+	if err := credsetup(c, &prof); err != nil {
+		return err
 	}
-	if auth, err := aws.GetAuth(akey, skey, "", time.Now().Add(time.Hour)); err == nil {
-		s3cl = s3.New(auth, reg)
+	clientsetup(c)
+	if s3cl, err = newclient(prof); err != nil {
+		return err
 	}
+	return signsetup(c, prof)
 }
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+func newapp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "s3cmd"
 	app.Usage = "AWS S3 API Client"
@@ -1320,13 +1783,20 @@ func main() {
 			Usage: "Show Progress Bar",
 		},
 	}
+	app.Flags = append(app.Flags, profileflags(homedir)...)
+	app.Flags = append(app.Flags, credflags...)
+	app.Flags = append(app.Flags, sseflags...)
+	app.Flags = append(app.Flags, cseflags...)
+	app.Flags = append(app.Flags, signflags...)
+	app.Flags = append(app.Flags, retryflags...)
+	app.Flags = append(app.Flags, outputflags...)
 	app.Commands = []cli.Command{
 		{
 			Name:      "list",
 			ShortName: "ls",
 			Usage:     "list objects or buckets",
 			Action:    ls,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
 					Name:  "long,l",
 					Usage: "use long listing format",
@@ -1334,7 +1804,11 @@ func main() {
 				cli.BoolFlag{
 					Name: "recursive,R",
 				},
-			},
+				cli.BoolFlag{
+					Name:  "versions",
+					Usage: "list all versions and delete markers",
+				},
+			}, filterflags...),
 		}, {
 			Name:      "list-url",
 			ShortName: "url",
@@ -1365,28 +1839,29 @@ func main() {
 			ShortName: "write",
 			Usage:     "put file into bucket",
 			Action:    put,
-			Flags: []cli.Flag{
+			Flags: append(append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "content-type,t",
 					Value: "binary/octet-stream",
-					Usage: "set content type",
+					Usage: "set default content type",
 				},
-			},
+			}, append(recursiveflags, classflags...)...), append(append(mimeflags, filterflags...), append(headerflags, headerruleflags...)...)...),
 		}, {
 			Name:      "get",
 			ShortName: "read",
 			Usage:     "get file from bucket",
 			Action:    get,
+			Flags:     append(append(append(recursiveflags, filterflags...), restoreflags...), versionflags...),
 		}, {
 			Name:      "cat",
 			ShortName: "dd",
 			Usage:     "read file from bucket",
 			Action:    cat,
-			Flags: []cli.Flag{
+			Flags: append(append(append([]cli.Flag{
 				cli.BoolFlag{
 					Name: "recursive,R",
 				},
-			},
+			}, filterflags...), restoreflags...), versionflags...),
 		}, {
 			Name:      "getrange",
 			ShortName: "readrange",
@@ -1411,33 +1886,65 @@ func main() {
 			ShortName: "rm",
 			Usage:     "delete object",
 			Action:    del,
-			Flags: []cli.Flag{
+			Flags: append(append([]cli.Flag{
 				cli.BoolFlag{
 					Name: "recursive,R",
 				},
-			},
+			}, filterflags...), cli.StringFlag{
+				Name:  "version-id",
+				Usage: "delete this version permanently",
+			}),
 		}, {
 			Name:      "copy",
 			ShortName: "cp",
-			Usage:     "copy object",
+			Usage:     "copy object between s3 and local",
 			Action:    cp,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "content-type,t",
+					Value: "binary/octet-stream",
+					Usage: "set default content type",
+				},
+				cli.IntFlag{
+					Name:  "split",
+					Value: 0,
+					Usage: "do multipart transfer larger than this size",
+				},
+				cli.IntFlag{
+					Name:  "split-parallel",
+					Value: 4,
+					Usage: "parallel parts per object",
+				},
+				cli.BoolFlag{
+					Name:  "store-md5",
+					Usage: "store md5 of multipart uploaded file in metadata",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run,n",
+					Usage: "show what would be copied",
+				},
+			}, append(append(append(mimeflags, classflags...), copyprofileflags...), versionflags...)...),
 		}, {
 			Name:      "putmulti",
 			ShortName: "pm",
 			Usage:     "put object with multipart upload",
 			Action:    putmulti,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.IntFlag{
 					Name:  "split",
 					Value: 16 * 1024 * 1024,
 					Usage: "split size",
 				},
+				cli.BoolFlag{
+					Name:  "store-md5",
+					Usage: "store md5 of file in metadata",
+				},
 				cli.StringFlag{
 					Name:  "content-type,t",
 					Value: "binary/octet-stream",
-					Usage: "set content type",
+					Usage: "set default content type",
 				},
-			},
+			}, append(append(mimeflags, headerflags...), classflags...)...),
 		}, {
 			Name:      "merge",
 			ShortName: "join",
@@ -1472,6 +1979,7 @@ func main() {
 			Name:   "head",
 			Usage:  "dump header",
 			Action: head,
+			Flags:  versionflags,
 		}, {
 			Name:      "listmulti",
 			ShortName: "lm",
@@ -1512,19 +2020,209 @@ func main() {
 			Name:   "setacl",
 			Usage:  "set acl",
 			Action: setacl,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "acl,a",
+					Usage: "canned acl (private, public-read, ...)",
+				},
+				cli.StringSliceFlag{
+					Name:  "grant,g",
+					Usage: "add grant PERMISSION:GRANTEE (GRANTEE: id=ID, email=ADDR, uri=URI, all-users, authenticated-users)",
+				},
+				cli.StringSliceFlag{
+					Name:  "revoke",
+					Usage: "remove grant [PERMISSION:]GRANTEE",
+				},
+				cli.BoolFlag{
+					Name: "recursive,R",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run,n",
+					Usage: "show new acl, do not set",
+				},
+			},
+		}, {
+			Name:   "setmeta",
+			Usage:  "rewrite metadata and headers of objects in place",
+			Action: setmeta,
+			Flags: append(append([]cli.Flag{
+				cli.BoolFlag{
+					Name: "recursive,R",
+				},
+				cli.BoolFlag{
+					Name:  "replace",
+					Usage: "replace user metadata instead of merging",
+				},
+				cli.StringSliceFlag{
+					Name:  "remove-meta",
+					Usage: "remove user metadata key (repeatable)",
+				},
+				cli.IntFlag{
+					Name:  "split",
+					Value: 1024 * 1024 * 1024,
+					Usage: "part size of multipart copy larger than 5GB",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run,n",
+					Usage: "show new headers, do not copy",
+				},
+			}, append(headerflags, headerruleflags...)...), append(filterflags, classflags...)...),
+		}, {
+			Name:   "transition",
+			Usage:  "copy objects under prefix into another storage class",
+			Action: transition,
+			Flags: append(append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "older-than",
+					Usage: "only objects modified before this age (30d, 12h)",
+				},
+				cli.StringFlag{
+					Name:  "newer-than",
+					Usage: "only objects modified within this age",
+				},
+				cli.Int64Flag{
+					Name:  "min-size",
+					Usage: "only objects of this size or larger",
+				},
+				cli.Int64Flag{
+					Name:  "max-size",
+					Usage: "only objects of this size or smaller",
+				},
+				cli.IntFlag{
+					Name:  "split",
+					Value: 1024 * 1024 * 1024,
+					Usage: "part size of multipart copy larger than 5GB",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run,n",
+					Usage: "show objects to transition",
+				},
+			}, classflags...), filterflags...),
+		}, {
+			Name:   "restore",
+			Usage:  "restore archived objects (GLACIER, DEEP_ARCHIVE) for reading",
+			Action: restore,
+			Flags: append(append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "recursive,R",
+					Usage: "restore archived objects under prefix",
+				},
+				cli.IntFlag{
+					Name:  "days",
+					Value: 1,
+					Usage: "days to keep restored copy",
+				},
+				cli.StringFlag{
+					Name:  "tier",
+					Value: "Standard",
+					Usage: "retrieval tier: " + strings.Join(restoretiers, ", "),
+				},
+				cli.BoolFlag{
+					Name:  "dry-run,n",
+					Usage: "show objects to restore",
+				},
+			}, restoreflags...), filterflags...),
+		}, {
+			Name:   "restore-status",
+			Usage:  "show restore status of objects",
+			Action: restorestatus,
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name: "recursive,R",
+				},
+			}, filterflags...),
+		}, {
+			Name:   "versioning",
+			Usage:  "versioning enable|suspend|status s3://bucket",
+			Action: versioning,
+		}, {
+			Name:  "lifecycle",
+			Usage: "lifecycle get|put|delete, rules are YAML or JSON (.json) file",
+			Subcommands: []cli.Command{
+				{
+					Name:      "get",
+					Usage:     "show lifecycle rules of bucket",
+					ArgsUsage: "s3://bucket",
+					Action:    lifecycleget,
+				}, {
+					Name:      "put",
+					Usage:     "validate rule file and set lifecycle configuration",
+					ArgsUsage: "rules.yaml s3://bucket",
+					Action:    lifecycleput,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run,n",
+							Usage: "show xml without sending",
+						},
+					},
+				}, {
+					Name:      "delete",
+					Usage:     "delete lifecycle configuration of bucket",
+					ArgsUsage: "s3://bucket",
+					Action:    lifecycledelete,
+				},
+			},
+		}, {
+			Name:   "rollback",
+			Usage:  "restore objects under prefix to their versions at a time",
+			Action: rollback,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "at",
+					Usage: "time to restore: RFC3339, YYYY-MM-DD[ HH:MM:SS] UTC, or age (30d, 12h)",
+				},
+				cli.IntFlag{
+					Name:  "split",
+					Value: 1024 * 1024 * 1024,
+					Usage: "part size of multipart copy larger than 5GB",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run,n",
+					Usage: "show objects to copy and delete",
+				},
+			}, filterflags...),
+		}, {
+			Name:   "undelete",
+			Usage:  "remove latest delete marker to restore object",
+			Action: undelete,
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "recursive,R",
+					Usage: "undelete all deleted objects under prefix",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run,n",
+					Usage: "show objects to undelete",
+				},
+			}, filterflags...),
 		}, {
 			Name:   "getacl",
 			Usage:  "get acl",
 			Action: getacl,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name: "recursive,R",
+				},
+			},
 		}, {
 			Name:   "mv",
 			Usage:  "move object",
 			Action: mv,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name: "recursive,R",
+				},
+				cli.IntFlag{
+					Name:  "split",
+					Value: 1024 * 1024 * 1024,
+					Usage: "part size of multipart copy",
+				},
+			},
 		}, {
 			Name:   "sync",
 			Usage:  "sync directory tree",
 			Action: synccmd,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "content-type,t",
 					Value: "binary/octet-stream",
@@ -1533,7 +2231,16 @@ func main() {
 				cli.IntFlag{
 					Name:  "split",
 					Value: 0,
-					Usage: "do multipart upload",
+					Usage: "do multipart upload/download larger than this size",
+				},
+				cli.IntFlag{
+					Name:  "split-parallel",
+					Value: 4,
+					Usage: "parallel ranged get per object",
+				},
+				cli.BoolFlag{
+					Name:  "store-md5",
+					Usage: "store md5 of multipart uploaded file in metadata",
 				},
 				cli.BoolFlag{
 					Name:  "delete,d",
@@ -1551,12 +2258,12 @@ func main() {
 					Usage: "parallel upload/download",
 					Value: 1,
 				},
-			},
+			}, append(append(append(mimeflags, filterflags...), classflags...), append(append(headerflags, headerruleflags...), copyprofileflags...)...)...),
 		}, {
 			Name:   "tar",
 			Usage:  "download to tar archive",
 			Action: tarsave,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
 					Name:  "gzip,z",
 					Usage: "compress output",
@@ -1568,12 +2275,24 @@ func main() {
 					Name:  "file,f",
 					Usage: "output file",
 				},
-			},
+			}, filterflags...),
 		},
 	}
+	for i := range app.Commands {
+		app.Commands[i].OnUsageError = onusageerr
+	}
+	return app
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	app := newapp()
 	if len(os.Args) == 1 {
 		cmdrepl.CmdRepl("s3cmd> ", app)
-	} else {
-		app.Run(os.Args)
+	} else if err := app.Run(os.Args); err != nil {
+		if _, ok := err.(exitError); !ok {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		os.Exit(exitcode(err))
 	}
 }
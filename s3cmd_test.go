@@ -0,0 +1,1657 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/wtnb75/go-s3cmd/fakes3"
+)
+
+var fake *fakes3.Server
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	fake = fakes3.Start()
+	code := m.Run()
+	fake.Close()
+	os.Exit(code)
+}
+
+// run command against fake server, returns stdout
+func s3cmd(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	argv := []string{"s3cmd", "--config", "/nonexistent/credential.json", "--s3cfg", "/nonexistent/.s3cfg",
+		"--aws_credentials", "/nonexistent/credentials", "--aws_config", "/nonexistent/config",
+		"--access_key", "AKID", "--secret_key", "SECRET", "--endpoint", fake.URL, "--retry", "1"}
+	if len(args) != 0 && strings.HasPrefix(args[0], "--") {
+		// global options first
+		for len(args) != 0 && strings.HasPrefix(args[0], "--") {
+			argv = append(argv, args[0], args[1])
+			args = args[2:]
+		}
+	}
+	return runapp(t, append(argv, args...)...)
+}
+
+func runapp(t *testing.T, argv ...string) (string, error) {
+	t.Helper()
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = wr
+	done := make(chan []byte)
+	go func() {
+		buf, _ := ioutil.ReadAll(rd)
+		done <- buf
+	}()
+	err = newapp().Run(argv)
+	os.Stdout = stdout
+	wr.Close()
+	out := <-done
+	rd.Close()
+	return string(out), err
+}
+
+func mustrun(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := s3cmd(t, args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return out
+}
+
+func mkbucket(t *testing.T) string {
+	t.Helper()
+	name := strings.ToLower(regexp.MustCompile("[^a-zA-Z0-9]+").ReplaceAllString(t.Name(), "-"))
+	mustrun(t, "mb", "s3://"+name)
+	return name
+}
+
+func randdata(size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(buf)
+	return buf
+}
+
+func writefile(t *testing.T, fn string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putdata(t *testing.T, bkt, key string, data []byte) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "data")
+	writefile(t, fn, data)
+	mustrun(t, "put", fn, "s3://"+bkt+"/"+key)
+}
+
+func content(t *testing.T, bkt, key string) []byte {
+	t.Helper()
+	data, _, ok := fake.Object(bkt, key)
+	if !ok {
+		t.Fatalf("s3://%s/%s not found", bkt, key)
+	}
+	return data
+}
+
+func checkkeys(t *testing.T, bkt string, expected ...string) {
+	t.Helper()
+	keys := fake.Objects(bkt)
+	sort.Strings(expected)
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("keys of %s: %v, expected %v", bkt, keys, expected)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	bkt := mkbucket(t)
+	if out := mustrun(t, "ls"); !strings.Contains(out, "s3://"+bkt) {
+		t.Errorf("bucket not listed: %s", out)
+	}
+	if _, err := s3cmd(t, "mb", "s3://"+bkt); err == nil {
+		t.Error("mb existing bucket succeeded")
+	}
+	putdata(t, bkt, "a", []byte("a"))
+	if _, err := s3cmd(t, "rb", "s3://"+bkt); err == nil {
+		t.Error("rb non-empty bucket succeeded")
+	}
+	mustrun(t, "del", "s3://"+bkt+"/a")
+	mustrun(t, "rb", "s3://"+bkt)
+	if fake.Objects(bkt) != nil {
+		t.Error("bucket not removed")
+	}
+	mustrun(t, "mb", "s3://"+bkt)
+	mustrun(t, "info", "s3://"+bkt+"/")
+}
+
+func TestPutGet(t *testing.T) {
+	bkt := mkbucket(t)
+	data := randdata(1000)
+	dir := t.TempDir()
+	writefile(t, filepath.Join(dir, "file.html"), []byte("<html><body>hello</body></html>"))
+	writefile(t, filepath.Join(dir, "file.bin"), data)
+	mustrun(t, "put", filepath.Join(dir, "file.html"), filepath.Join(dir, "file.bin"), "s3://"+bkt+"/dir/")
+	checkkeys(t, bkt, "dir/file.bin", "dir/file.html")
+	if _, hdr, _ := fake.Object(bkt, "dir/file.html"); !strings.HasPrefix(hdr.Get("Content-Type"), "text/html") {
+		t.Errorf("content type: %s", hdr.Get("Content-Type"))
+	}
+	if _, err := s3cmd(t, "put", dir, "s3://"+bkt+"/x"); err == nil {
+		t.Error("put directory succeeded")
+	}
+	if out := mustrun(t, "cat", "s3://"+bkt+"/dir/file.bin"); out != string(data) {
+		t.Error("cat content mismatch")
+	}
+	if out := mustrun(t, "getrange", "--range", "10-19", "s3://"+bkt+"/dir/file.bin"); out != string(data[10:20]) {
+		t.Errorf("getrange: %q", out)
+	}
+	if out := mustrun(t, "head", "s3://"+bkt+"/dir/file.bin"); !strings.Contains(out, "Content-Length: 1000") {
+		t.Errorf("head: %s", out)
+	}
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(t.TempDir())
+	mustrun(t, "get", "s3://"+bkt+"/dir/file.bin")
+	if got, err := ioutil.ReadFile("file.bin"); err != nil || !bytes.Equal(got, data) {
+		t.Error("get content mismatch", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	bkt := mkbucket(t)
+	putdata(t, bkt, "a", []byte("a"))
+	mustrun(t, "exists", "s3://"+bkt+"/a")
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"exists", "s3://" + bkt + "/nokey"}, exitNotFound},
+		{[]string{"cat", "s3://" + bkt + "/nokey"}, exitNotFound},
+		{[]string{"cat", "s3://" + bkt + "/a", "s3://" + bkt + "/nokey"}, exitNotFound},
+		{[]string{"ls", "--nosuchflag"}, exitUsage},
+		{[]string{"cp", "s3://" + bkt + "/a"}, exitUsage},
+		{[]string{"setacl", "--acl", "bogus", "s3://" + bkt + "/a"}, exitUsage},
+		{[]string{"--output", "xml", "ls"}, exitUsage},
+		{[]string{"ls", "s3://nosuchbucket/"}, exitNotFound},
+	}
+	for _, c := range cases {
+		if _, err := s3cmd(t, c.args...); exitcode(err) != c.code {
+			t.Errorf("%v: exit %d, expected %d (%v)", c.args, exitcode(err), c.code, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	bkt := mkbucket(t)
+	for _, k := range []string{"a.txt", "d/b.txt", "d/c.log", "d/e/f.txt"} {
+		putdata(t, bkt, k, []byte(k))
+	}
+	out := mustrun(t, "ls", "s3://"+bkt+"/")
+	if !strings.Contains(out, "DIR  s3://"+bkt+"/d/") || !strings.Contains(out, "s3://"+bkt+"/a.txt") || strings.Contains(out, "b.txt") {
+		t.Errorf("ls: %s", out)
+	}
+	out = mustrun(t, "ls", "-R", "--exclude", "*.log", "s3://"+bkt+"/d/")
+	if !strings.Contains(out, "d/e/f.txt") || strings.Contains(out, "c.log") {
+		t.Errorf("ls -R: %s", out)
+	}
+	out = mustrun(t, "--output", "json", "ls", "s3://"+bkt+"/d/")
+	var recs []record
+	if err := json.Unmarshal([]byte(out), &recs); err != nil {
+		t.Fatal(err, out)
+	}
+	if len(recs) != 3 || !recs[0].Prefix || recs[0].Key != "d/e/" || recs[1].Key != "d/b.txt" || recs[1].Size != 7 {
+		t.Errorf("json: %+v", recs)
+	}
+	out = mustrun(t, "--output", "ndjson", "la")
+	var n int
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var rec record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err, line)
+		}
+		if rec.Bucket == bkt {
+			n += 1
+		}
+	}
+	if n != 4 {
+		t.Errorf("ndjson la: %s", out)
+	}
+	out = mustrun(t, "--output", "csv", "du", "s3://"+bkt+"/d/")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], bkt+",d/,23,") {
+		t.Errorf("csv du: %s", out)
+	}
+	if out = mustrun(t, "da"); !regexp.MustCompile(`\s+\d+\s+4 s3://` + bkt + `\n`).MatchString(out) {
+		t.Errorf("da: %s", out)
+	}
+	if out = mustrun(t, "list-url", "-R", "s3://"+bkt+"/d/"); !strings.Contains(out, fake.URL+"/"+bkt+"/d/b.txt?") {
+		t.Errorf("list-url: %s", out)
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	bkt := mkbucket(t)
+	cl := s3cl.Bucket(bkt)
+	for i := 0; i < 1100; i++ {
+		key := fmt.Sprintf("d%d/k%04d", i%3, i)
+		if err := cl.Put(key, []byte("x"), "text/plain", s3.Private, s3.Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := lists3("s3://"+bkt+"/", "/")
+	if err != nil || len(res) != 1100 {
+		t.Errorf("lists3: %d %v", len(res), err)
+	}
+	if out := mustrun(t, "du", "s3://"+bkt+"/"); !strings.Contains(out, "1100 s3://"+bkt+"/") {
+		t.Errorf("du: %s", out)
+	}
+	if out := mustrun(t, "ls", "s3://"+bkt+"/"); strings.Count(out, "DIR") != 3 {
+		t.Errorf("ls: %s", out)
+	}
+}
+
+func TestCopyMove(t *testing.T) {
+	bkt := mkbucket(t)
+	putdata(t, bkt, "src/a", []byte("aaa"))
+	putdata(t, bkt, "src/sub/b", []byte("bbb"))
+	mustrun(t, "cp", "s3://"+bkt+"/src/a", "s3://"+bkt+"/copy/a")
+	if string(content(t, bkt, "copy/a")) != "aaa" {
+		t.Error("cp content mismatch")
+	}
+	mustrun(t, "mv", "-R", "s3://"+bkt+"/src/", "s3://"+bkt+"/moved/")
+	checkkeys(t, bkt, "copy/a", "moved/a", "moved/sub/b")
+	mustrun(t, "mv", "s3://"+bkt+"/copy/a", "s3://"+bkt+"/renamed")
+	checkkeys(t, bkt, "moved/a", "moved/sub/b", "renamed")
+	if _, err := s3cmd(t, "mv", "s3://"+bkt+"/nokey", "s3://"+bkt+"/x"); exitcode(err) != exitNotFound {
+		t.Error("mv missing key:", err)
+	}
+	// multipart copy
+	data := randdata(12 * mib)
+	putdata(t, bkt, "big", data)
+	if _, err := putcopy_multi(s3cl.Bucket(bkt), "bigcopy", s3cl.Bucket(bkt), "big", "", int64(len(data)), 5*mib); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content(t, bkt, "bigcopy"), data) {
+		t.Error("multipart copy content mismatch")
+	}
+	// mv by multipart copy keeps headers
+	defer func(v int64) { maxcopysize = v }(maxcopysize)
+	maxcopysize = 5 * mib
+	fn := filepath.Join(t.TempDir(), "big")
+	writefile(t, fn, data)
+	mustrun(t, "put", "--meta", "owner=me", "--header", "Content-Type: text/x-big", fn, "s3://"+bkt+"/bigsrc")
+	mustrun(t, "mv", "--split", "5242880", "s3://"+bkt+"/bigsrc", "s3://"+bkt+"/bigmoved")
+	got, hdr, _ := fake.Object(bkt, "bigmoved")
+	if !bytes.Equal(got, data) || hdr.Get("Content-Type") != "text/x-big" || hdr.Get("X-Amz-Meta-Owner") != "me" {
+		t.Error("mv multipart headers:", hdr)
+	}
+	if _, _, ok := fake.Object(bkt, "bigsrc"); ok {
+		t.Error("mv multipart left source")
+	}
+	// md5 of content is not etag of multipart copy
+	sum, _ := filemd5(fn)
+	if err := verifycopy(s3cl.Bucket(bkt), "bigmoved", int64(len(data)), sum); err == nil {
+		t.Error("verifycopy with etag of other object")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	bkt := mkbucket(t)
+	for _, k := range []string{"a", "d/b", "d/c.log", "d/e/f"} {
+		putdata(t, bkt, k, []byte(k))
+	}
+	mustrun(t, "del", "-R", "--include", "*.log", "s3://"+bkt+"/d/")
+	checkkeys(t, bkt, "a", "d/b", "d/e/f")
+	mustrun(t, "del", "-R", "s3://"+bkt+"/d/")
+	checkkeys(t, bkt, "a")
+	// errors of each key in DeleteObjects
+	for _, k := range []string{"p/a", "p/b", "p/c"} {
+		putdata(t, bkt, k, []byte(k))
+	}
+	fake.FailDelete(bkt, "p/b", "InternalError")
+	if _, err := s3cmd(t, "del", "-R", "s3://"+bkt+"/p/"); exitcode(err) != exitPartial || !strings.Contains(err.Error(), "1 of 3 failed") {
+		t.Error("del -R partial failure:", err)
+	}
+	checkkeys(t, bkt, "a", "p/b")
+	fake.FailDelete(bkt, "p/b", "AccessDenied")
+	if _, err := s3cmd(t, "del", "-R", "s3://"+bkt+"/p/"); exitcode(err) != exitAuth {
+		t.Error("del -R denied:", err)
+	}
+	fake.FailDelete(bkt, "p/b", "")
+	mustrun(t, "del", "-R", "s3://"+bkt+"/p/")
+	checkkeys(t, bkt, "a")
+}
+
+func TestMultipart(t *testing.T) {
+	bkt := mkbucket(t)
+	data := randdata(11 * mib)
+	fn := filepath.Join(t.TempDir(), "big")
+	writefile(t, fn, data)
+	mustrun(t, "putmulti", "--split", "5242880", "--store-md5", fn, "s3://"+bkt+"/big")
+	_, hdr, _ := fake.Object(bkt, "big")
+	if etagparts(strings.Trim(hdr.Get("ETag"), `"`)) != 3 {
+		t.Errorf("etag: %s", hdr.Get("ETag"))
+	}
+	if sum, _ := filemd5(fn); hdr.Get("X-Amz-Meta-Md5") != sum {
+		t.Errorf("md5 meta: %s", hdr.Get("X-Amz-Meta-Md5"))
+	}
+	if !bytes.Equal(content(t, bkt, "big"), data) {
+		t.Error("content mismatch")
+	}
+	// all part sizes in one read
+	sums, err := filemultimd5(fn, []int64{8 * mib, 5 * mib, 5*mib + 1})
+	if err != nil || sums[1] != strings.Trim(hdr.Get("ETag"), `"`) {
+		t.Errorf("multipart md5 %v != %s %v", sums, hdr.Get("ETag"), err)
+	}
+	if etagparts(sums[0]) != 2 || etagparts(sums[2]) != 3 || sums[2] == sums[1] {
+		t.Errorf("multipart md5 of other part sizes: %v", sums)
+	}
+	// unfinished uploads
+	multi, err := s3cl.Bucket(bkt).InitMulti("unfinished", "text/plain", s3.Private, s3.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = multi.PutPart(1, bytes.NewReader([]byte("part"))); err != nil {
+		t.Fatal(err)
+	}
+	if out := mustrun(t, "listmulti", "-l", "s3://"+bkt+"/"); !strings.Contains(out, "s3://"+bkt+"/unfinished  "+multi.UploadId) || !strings.Contains(out, "current size: 4") {
+		t.Errorf("listmulti: %s", out)
+	}
+	mustrun(t, "cleanmulti", "s3://"+bkt+"/")
+	if out := mustrun(t, "listmulti", "s3://"+bkt+"/"); out != "" {
+		t.Errorf("listmulti after clean: %s", out)
+	}
+	// failed upload is aborted
+	if err := putmultipart(s3cl.Bucket(bkt), "seekfail", seekfail{bytes.NewReader(data)}, 5*mib, "text/plain", putopts{}); err == nil {
+		t.Error("putmultipart with seek error")
+	}
+	if out := mustrun(t, "listmulti", "s3://"+bkt+"/"); out != "" {
+		t.Errorf("listmulti after seek error: %s", out)
+	}
+}
+
+type seekfail struct {
+	*bytes.Reader
+}
+
+func (seekfail) Seek(int64, int) (int64, error) {
+	return 0, errors.New("seek failed")
+}
+
+func TestMerge(t *testing.T) {
+	bkt := mkbucket(t)
+	big := randdata(6 * mib)
+	putdata(t, bkt, "parts/1", []byte("first"))
+	putdata(t, bkt, "parts/2", big)
+	putdata(t, bkt, "parts/3", []byte("last"))
+	mustrun(t, "merge", "s3://"+bkt+"/merged", "s3://"+bkt+"/parts/")
+	expected := append(append([]byte("first"), big...), []byte("last")...)
+	if got := content(t, bkt, "merged"); !bytes.Equal(got, expected) {
+		t.Errorf("merged size %d, expected %d", len(got), len(expected))
+	}
+}
+
+func TestAcl(t *testing.T) {
+	bkt := mkbucket(t)
+	putdata(t, bkt, "a", []byte("a"))
+	us := "s3://" + bkt + "/a"
+	mustrun(t, "setacl", "--acl", "public-read", us)
+	out := mustrun(t, "getacl", us)
+	if !strings.Contains(out, "READ") || !strings.Contains(out, allusers) {
+		t.Errorf("getacl: %s", out)
+	}
+	mustrun(t, "setacl", "--grant", "write:id=someone", "--revoke", "all-users", us)
+	var res []struct {
+		URL string
+		Acl struct {
+			AccessControlList struct{ Grant []aclgrant }
+		}
+	}
+	if err := json.Unmarshal([]byte(mustrun(t, "--output", "json", "getacl", us)), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].URL != us || len(res[0].Acl.AccessControlList.Grant) != 2 {
+		t.Fatalf("getacl json: %+v", res)
+	}
+	g := res[0].Acl.AccessControlList.Grant[1]
+	if g.Permission != "WRITE" || g.Grantee.ID != "someone" {
+		t.Errorf("grant: %+v", g)
+	}
+	if out := mustrun(t, "--output", "csv", "getacl", us); !strings.Contains(out, "WRITE:id=someone") {
+		t.Errorf("getacl csv: %s", out)
+	}
+	if _, err := s3cmd(t, "getacl", "--json", us); exitcode(err) != exitUsage {
+		t.Error("getacl --json:", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	bkt := mkbucket(t)
+	src := t.TempDir()
+	writefile(t, filepath.Join(src, "a"), []byte("aaa"))
+	writefile(t, filepath.Join(src, "sub/b"), []byte("bbb"))
+	writefile(t, filepath.Join(src, "big"), randdata(11*mib))
+	mustrun(t, "sync", "--split", "5242880", "-p", "2", src, "s3://"+bkt+"/tree")
+	checkkeys(t, bkt, "tree/a", "tree/big", "tree/sub/b")
+	// update, delete
+	writefile(t, filepath.Join(src, "a"), []byte("AAA"))
+	os.Remove(filepath.Join(src, "sub/b"))
+	mustrun(t, "sync", "--split", "5242880", "--delete", src, "s3://"+bkt+"/tree")
+	checkkeys(t, bkt, "tree/a", "tree/big")
+	if string(content(t, bkt, "tree/a")) != "AAA" {
+		t.Error("sync did not update")
+	}
+	// download
+	dst := t.TempDir()
+	mustrun(t, "sync", "--split", "5242880", "s3://"+bkt+"/tree", dst)
+	for _, k := range []string{"a", "big"} {
+		got, err := ioutil.ReadFile(filepath.Join(dst, k))
+		if err != nil || !bytes.Equal(got, content(t, bkt, "tree/"+k)) {
+			t.Error("sync from s3 mismatch", k, err)
+		}
+	}
+	// remote
+	mustrun(t, "sync", "s3://"+bkt+"/tree", "s3://"+bkt+"/copy")
+	checkkeys(t, bkt, "copy/a", "copy/big", "tree/a", "tree/big")
+}
+
+func TestSyncSplit(t *testing.T) {
+	bkt := mkbucket(t)
+	src := t.TempDir()
+	big := randdata(11 * mib)
+	writefile(t, filepath.Join(src, "big"), big)
+	writefile(t, filepath.Join(src, "small"), []byte("small"))
+	mustrun(t, "sync", "--split", "5242880", src, "s3://"+bkt+"/split")
+	mustrun(t, "sync", src, "s3://"+bkt+"/whole")
+	for k, n := range map[string]int{"split/big": 3, "split/small": 0, "whole/big": 0} {
+		_, hdr, _ := fake.Object(bkt, k)
+		if etagparts(strings.Trim(hdr.Get("ETag"), `"`)) != n {
+			t.Errorf("%s: etag %s, expected %d parts", k, hdr.Get("ETag"), n)
+		}
+	}
+	// ranged parallel download
+	dst := t.TempDir()
+	mustrun(t, "sync", "--split", "5242880", "--split-parallel", "3", "s3://"+bkt+"/split", dst)
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "big")); err != nil || !bytes.Equal(got, big) {
+		t.Error("ranged download mismatch", err)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	bkt := mkbucket(t)
+	us := "s3://" + bkt + "/"
+	src := t.TempDir()
+	files := map[string][]byte{"style.css": []byte("body {}"), "page": []byte("<!DOCTYPE html><html></html>"),
+		"blob.unknownext": randdata(100), "doc.custom": []byte("custom")}
+	for k, v := range files {
+		writefile(t, filepath.Join(src, k), v)
+	}
+	mimemap := filepath.Join(t.TempDir(), "mime.types")
+	writefile(t, mimemap, []byte("# overrides\ntext/x-custom custom\n"))
+	mustrun(t, "sync", "--mime-map", mimemap, "--content-type", "application/x-fallback", src, us+"sync")
+	for k, want := range map[string]string{"style.css": "text/css", "page": "text/html", "blob.unknownext": "application/x-fallback", "doc.custom": "text/x-custom"} {
+		if _, hdr, _ := fake.Object(bkt, "sync/"+k); !strings.HasPrefix(hdr.Get("Content-Type"), want) {
+			t.Errorf("sync %s: %s, expected %s", k, hdr.Get("Content-Type"), want)
+		}
+	}
+	mustrun(t, "put", filepath.Join(src, "page"), us+"put/page")
+	mustrun(t, "put", "--no-mime-detect", "--content-type", "text/plain", filepath.Join(src, "style.css"), us+"put/style.css")
+	for k, want := range map[string]string{"put/page": "text/html", "put/style.css": "text/plain"} {
+		if _, hdr, _ := fake.Object(bkt, k); !strings.HasPrefix(hdr.Get("Content-Type"), want) {
+			t.Errorf("put %s: %s, expected %s", k, hdr.Get("Content-Type"), want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	bkt := mkbucket(t)
+	us := "s3://" + bkt + "/"
+	src := t.TempDir()
+	for _, k := range []string{"a.parquet", "b.tmp", ".git/config", "sub/c.parquet", "sub/d.txt", "logs/e.log"} {
+		writefile(t, filepath.Join(src, k), []byte(k))
+	}
+	excludes := filepath.Join(t.TempDir(), "excludes")
+	writefile(t, excludes, []byte("# generated\nlogs/\n"))
+	mustrun(t, "sync", "--exclude", "*.tmp", "--exclude", ".git/", "--exclude-from", excludes, src, us+"s")
+	checkkeys(t, bkt, "s/a.parquet", "s/sub/c.parquet", "s/sub/d.txt")
+	mustrun(t, "sync", "--include", "*.parquet", src, us+"p")
+	mustrun(t, "sync", "--rinclude", `\.txt$`, src, us+"r")
+	checkkeys(t, bkt, "p/a.parquet", "p/sub/c.parquet", "r/sub/d.txt", "s/a.parquet", "s/sub/c.parquet", "s/sub/d.txt")
+	if out := mustrun(t, "ls", "-R", "--rexclude", "parquet", us+"s/"); strings.Contains(out, "parquet") || !strings.Contains(out, "d.txt") {
+		t.Errorf("ls --rexclude: %s", out)
+	}
+	// flag values of previous run are not kept
+	if out := mustrun(t, "ls", "-R", us+"s/"); !strings.Contains(out, "a.parquet") {
+		t.Errorf("ls after --rexclude: %s", out)
+	}
+	if out := mustrun(t, "cat", "-R", "--include", "*.txt", us+"s/"); out != "sub/d.txt" {
+		t.Errorf("cat -R --include: %q", out)
+	}
+	fn := filepath.Join(t.TempDir(), "out.tar")
+	mustrun(t, "tar", "--exclude", "sub/", "-f", fn, us+"s/")
+	fp, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	rd := tar.NewReader(fp)
+	names := []string{}
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != bkt+"/s/a.parquet" {
+		t.Errorf("tar --exclude: %v", names)
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	bkt := mkbucket(t)
+	src := t.TempDir()
+	files := map[string][]byte{"a": []byte("a"), "x/b": []byte("bb"), "x/y/c": randdata(100)}
+	for k, v := range files {
+		writefile(t, filepath.Join(src, k), v)
+	}
+	mustrun(t, "put", "-R", src, "s3://"+bkt+"/up")
+	checkkeys(t, bkt, "up/a", "up/x/b", "up/x/y/c")
+	dst := t.TempDir()
+	mustrun(t, "get", "-R", "s3://"+bkt+"/up/x", dst)
+	for k, v := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, strings.TrimPrefix(k, "x/")))
+		if strings.HasPrefix(k, "x/") && (err != nil || !bytes.Equal(got, v)) {
+			t.Error("get -R mismatch", k, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a")); err == nil {
+		t.Error("get -R downloaded outside prefix")
+	}
+}
+
+func TestTar(t *testing.T) {
+	bkt := mkbucket(t)
+	putdata(t, bkt, "t/a", []byte("aaa"))
+	putdata(t, bkt, "t/b", []byte("bbbb"))
+	fn := filepath.Join(t.TempDir(), "out.tar")
+	mustrun(t, "tar", "-f", fn, "s3://"+bkt+"/t/")
+	fp, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	rd := tar.NewReader(fp)
+	names := []string{}
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != bkt+"/t/a,"+bkt+"/t/b" {
+		t.Errorf("tar entries: %v", names)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	bkt := mkbucket(t)
+	src := t.TempDir()
+	big := randdata(11 * mib)
+	writefile(t, filepath.Join(src, "a"), []byte("aaa"))
+	writefile(t, filepath.Join(src, "sub/big"), big)
+	// local to local
+	dst := t.TempDir()
+	mustrun(t, "sync", "--split", "5242880", "file://"+src, dst)
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "sub/big")); err != nil || !bytes.Equal(got, big) {
+		t.Error("local sync mismatch", err)
+	}
+	os.Remove(filepath.Join(src, "a"))
+	mustrun(t, "sync", "--delete", src, dst)
+	if _, err := os.Stat(filepath.Join(dst, "a")); err == nil {
+		t.Error("local sync --delete")
+	}
+	// cp across backends
+	mustrun(t, "cp", "--split", "5242880", filepath.Join(src, "sub/big"), "s3://"+bkt+"/big")
+	if !bytes.Equal(content(t, bkt, "big"), big) {
+		t.Error("cp to s3 mismatch")
+	}
+	mustrun(t, "cp", "s3://"+bkt+"/big", dst)
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "big")); err != nil || !bytes.Equal(got, big) {
+		t.Error("cp from s3 mismatch", err)
+	}
+	// merge local files to s3
+	writefile(t, filepath.Join(src, "m/1"), []byte("head"))
+	writefile(t, filepath.Join(src, "m/2"), big)
+	mustrun(t, "merge", "s3://"+bkt+"/merged", filepath.Join(src, "m"))
+	if got := content(t, bkt, "merged"); !bytes.Equal(got, append([]byte("head"), big...)) {
+		t.Errorf("merged size %d", len(got))
+	}
+	// tar local tree
+	fn := filepath.Join(t.TempDir(), "out.tar")
+	mustrun(t, "tar", "-f", fn, filepath.Join(src, "m"))
+	fp, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	hdr, err := tar.NewReader(fp).Next()
+	if err != nil || hdr.Name != strings.TrimPrefix(filepath.ToSlash(filepath.Join(src, "m/1")), "/") || hdr.Size != 4 {
+		t.Errorf("tar entry: %+v %v", hdr, err)
+	}
+}
+
+// multipart upload failing every part
+type failmulti struct {
+	puts    int
+	aborted bool
+}
+
+func (m *failmulti) put(n int, offset int64, rd io.Reader, size int64) error {
+	m.puts += 1
+	return errors.New("put failed")
+}
+
+func (m *failmulti) copy(n int, offset int64, src storage, srckey string, size int64) error {
+	return errcross
+}
+
+func (m *failmulti) complete() error {
+	return nil
+}
+
+func (m *failmulti) abort() error {
+	m.aborted = true
+	return nil
+}
+
+type failstorage struct {
+	*filestorage
+	mu *failmulti
+}
+
+func (st *failstorage) initmulti(key, ctyp string, size int64, opts putopts) (multiupload, error) {
+	return st.mu, nil
+}
+
+func TestMultiTransferFail(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "big")
+	writefile(t, fn, randdata(30*mib))
+	dst := &failstorage{&filestorage{}, &failmulti{}}
+	if err := multitransfer(dst, "x", &filestorage{}, fn, 30*mib, 5*mib, 1, "", putopts{}); err == nil {
+		t.Error("multitransfer with failed part")
+	}
+	if dst.mu.puts != 1 || !dst.mu.aborted {
+		t.Errorf("parts after error: %d, aborted %v", dst.mu.puts, dst.mu.aborted)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	bkt := mkbucket(t)
+	putdata(t, bkt, "a", []byte("a"))
+	dir := t.TempDir()
+	host := strings.TrimPrefix(fake.URL, "http://")
+	writefile(t, filepath.Join(dir, "s3cfg"), []byte(`[default]
+host_base = 127.0.0.1:1
+use_https = False
+[prod]
+host_base = `+host+`
+use_https = False
+access_key = AKID
+secret_key = SECRET
+`))
+	writefile(t, filepath.Join(dir, "credential.json"), []byte(`{"storage_api": "http://127.0.0.1:1",
+"profiles": {"onprem": {"access_key_id": "AKID", "secret_access_key": "SECRET", "storage_api": "`+fake.URL+`", "force_path_style": true}}}`))
+	writefile(t, filepath.Join(dir, "credentials"), []byte("[staging]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n"))
+	writefile(t, filepath.Join(dir, "config"), []byte("[profile staging]\nregion = us-east-1\nendpoint_url = "+fake.URL+"\n"))
+	run := func(cfg string, args ...string) error {
+		argv := []string{"s3cmd", "--config", "/nonexistent/credential.json", "--s3cfg", filepath.Join(dir, "s3cfg"),
+			"--aws_credentials", filepath.Join(dir, "credentials"), "--aws_config", filepath.Join(dir, "config"), "--retry", "1"}
+		if cfg != "" {
+			argv = append(argv, "--config", cfg)
+		}
+		_, err := runapp(t, append(argv, args...)...)
+		return err
+	}
+	us := "s3://" + bkt + "/a"
+	if err := run("", "exists", us); err == nil {
+		t.Error("default profile should not reach server")
+	}
+	for _, prof := range []string{"prod", "staging"} {
+		if err := run("", "--profile", prof, "exists", us); err != nil {
+			t.Error("profile", prof, err)
+		}
+	}
+	t.Setenv("AWS_PROFILE", "prod")
+	if err := run("", "exists", us); err != nil {
+		t.Error("AWS_PROFILE", err)
+	}
+	if err := run(filepath.Join(dir, "credential.json"), "--profile", "onprem", "exists", us); err != nil {
+		t.Error("json profile", err)
+	}
+	if err := run("", "--profile", "nosuch", "exists", us); exitcode(err) != exitUsage {
+		t.Error("unknown profile", err)
+	}
+	// no region in aws config
+	writefile(t, filepath.Join(dir, "credentials"), []byte("[noregion]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n"))
+	for env, region := range map[string]string{"": "us-east-1", "eu-west-1": "eu-west-1", "xx-new-1": "xx-new-1"} {
+		t.Setenv("AWS_REGION", env)
+		prof := profile{name: "noregion"}
+		if found, err := awsprofile(filepath.Join(dir, "credentials"), filepath.Join(dir, "config"), &prof); !found || err != nil {
+			t.Fatal("awsprofile", found, err)
+		}
+		if prof.region != region || prof.reg.S3Endpoint == "" {
+			t.Errorf("AWS_REGION=%s: region %s endpoint %q", env, prof.region, prof.reg.S3Endpoint)
+		}
+	}
+}
+
+func TestCrossProfile(t *testing.T) {
+	bkt := mkbucket(t)
+	small := randdata(1000)
+	big := randdata(11 * mib)
+	putdata(t, bkt, "tree/small", small)
+	putdata(t, bkt, "tree/big", big)
+	other := fakes3.Start()
+	defer other.Close()
+	other.Keys = map[string]string{"AKID2": "SECRET2"}
+	dir := t.TempDir()
+	writefile(t, filepath.Join(dir, "s3cfg"), []byte(`[other]
+host_base = `+strings.TrimPrefix(other.URL, "http://")+`
+use_https = False
+signature_v2 = False
+access_key = AKID2
+secret_key = SECRET2
+`))
+	cfg := []string{"--s3cfg", filepath.Join(dir, "s3cfg")}
+	run := func(args ...string) error {
+		_, err := s3cmd(t, append(cfg, args...)...)
+		return err
+	}
+	if err := run("mb", "s3://other@dst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("cp", "s3://"+bkt+"/tree/small", "s3://other@dst/small"); err != nil {
+		t.Error("cp:", err)
+	}
+	if err := run("cp", "--split", "5242880", "--dst-profile", "other", "s3://"+bkt+"/tree/big", "s3://dst/big"); err != nil {
+		t.Error("cp multipart:", err)
+	}
+	for k, v := range map[string][]byte{"small": small, "big": big} {
+		if data, _, ok := other.Object("dst", k); !ok || !bytes.Equal(data, v) {
+			t.Error("cp content mismatch", k)
+		}
+	}
+	if err := run("sync", "--dst-profile", "other", "s3://"+bkt+"/tree", "s3://dst/tree"); err != nil {
+		t.Error("sync:", err)
+	}
+	if data, _, ok := other.Object("dst", "tree/big"); !ok || !bytes.Equal(data, big) {
+		t.Error("sync content mismatch")
+	}
+	// back to default profile
+	if err := run("sync", "--src-profile", "other", "s3://dst/tree", "s3://"+bkt+"/back"); err != nil {
+		t.Error("sync back:", err)
+	}
+	checkkeys(t, bkt, "back/big", "back/small", "tree/big", "tree/small")
+	// headers and metadata of source are kept by streaming copy
+	hdrs := []string{"--meta", "owner=me", "--header", "Content-Type: text/x-page", "--header", "Cache-Control: no-cache",
+		"--header", "Content-Disposition: attachment"}
+	for k, data := range map[string][]byte{"page": small, "bigpage": big} {
+		fn := filepath.Join(dir, k)
+		writefile(t, fn, data)
+		mustrun(t, append(append([]string{"putmulti", "--split", "5242880"}, hdrs...), fn, "s3://"+bkt+"/"+k)...)
+		if err := run("cp", "--split", "5242880", "--dst-profile", "other", "s3://"+bkt+"/"+k, "s3://dst/"+k); err != nil {
+			t.Error("cp headers:", err)
+		}
+		_, hdr, _ := other.Object("dst", k)
+		for h, v := range map[string]string{"Content-Type": "text/x-page", "Cache-Control": "no-cache",
+			"Content-Disposition": "attachment", "X-Amz-Meta-Owner": "me"} {
+			if hdr.Get(h) != v {
+				t.Error("cp headers", k, h, hdr.Get(h))
+			}
+		}
+	}
+	// ciphertext is copied with data key and keyed digest of source
+	master := filepath.Join(dir, "master")
+	writefile(t, master, randdata(32))
+	mustrun(t, "--encrypt-key", master, "put", filepath.Join(dir, "page"), "s3://"+bkt+"/enc/page")
+	mustrun(t, "--encrypt-key", master, "putmulti", "--split", "5242880", filepath.Join(dir, "bigpage"), "s3://"+bkt+"/enc/bigpage")
+	for i := 0; i < 2; i++ {
+		if err := run("--encrypt-key", master, "sync", "--split", "5242880", "--dst-profile", "other", "s3://"+bkt+"/enc", "s3://dst/enc"); err != nil {
+			t.Error("sync encrypted:", err)
+		}
+		if i == 0 {
+			if err := run("setmeta", "--meta", "mark=1", "s3://other@dst/enc/bigpage"); err != nil {
+				t.Error("setmeta:", err)
+			}
+		}
+	}
+	for k, data := range map[string][]byte{"page": small, "bigpage": big} {
+		src, shdr, _ := fake.Object(bkt, "enc/"+k)
+		got, hdr, _ := other.Object("dst", "enc/"+k)
+		if !bytes.Equal(got, src) || hdr.Get("X-Amz-Meta-S3cmd-Cse-Mac") != shdr.Get("X-Amz-Meta-S3cmd-Cse-Mac") {
+			t.Error("encrypted copy", k, hdr)
+		}
+		if out, err := s3cmd(t, append(cfg, "--encrypt-key", master, "cat", "s3://other@dst/enc/"+k)...); err != nil || out != string(data) {
+			t.Error("cat encrypted copy", k, len(out), err)
+		}
+	}
+	if _, hdr, _ := other.Object("dst", "enc/bigpage"); hdr.Get("X-Amz-Meta-Mark") != "1" {
+		t.Error("sync copied unchanged encrypted object")
+	}
+	if err := run("ls", "s3://nosuch@dst/"); exitcode(err) != exitUsage {
+		t.Error("unknown profile", err)
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	srv := fakes3.Start()
+	defer srv.Close()
+	srv.Keys = map[string]string{"AKID": "SECRET"}
+	srv.Roles = map[string]fakes3.Role{
+		"arn:aws:iam::123456789012:role/s3":  {ExternalId: "ext"},
+		"arn:aws:iam::123456789012:role/mfa": {TokenCode: "123456"},
+		"arn:aws:iam::123456789012:role/web": {WebIdentityToken: "jwt"},
+	}
+	srv.MFA = map[string]string{"arn:aws:iam::123456789012:mfa/user": "123456"}
+	dir := t.TempDir()
+	run := func(args ...string) error {
+		argv := []string{"s3cmd", "--config", "/nonexistent/credential.json", "--s3cfg", "/nonexistent/.s3cfg",
+			"--aws_credentials", "/nonexistent/credentials", "--aws_config", "/nonexistent/config",
+			"--endpoint", srv.URL, "--sts_endpoint", srv.URL, "--retry", "1", "--signature", "v4"}
+		_, err := runapp(t, append(argv, args...)...)
+		return err
+	}
+	if err := run("--access_key", "AKID", "--secret_key", "SECRET", "--role_arn", "arn:aws:iam::123456789012:role/mfa",
+		"--mfa_serial", "arn:aws:iam::123456789012:mfa/user", "--mfa_token", "123456", "mb", "s3://role"); err != nil {
+		t.Fatal(err)
+	}
+	// mfa session and assumed role
+	if srv.Sessions() != 2 {
+		t.Error("sessions", srv.Sessions())
+	}
+	// credentials expiring soon are refreshed before each request, while other workers sign (go test -race)
+	role := []string{"--access_key", "AKID", "--secret_key", "SECRET", "--role_arn", "arn:aws:iam::123456789012:role/s3", "--external_id", "ext"}
+	writefile(t, filepath.Join(dir, "a"), []byte("aaa"))
+	writefile(t, filepath.Join(dir, "b"), []byte("bbb"))
+	for i := 0; i < 16; i++ {
+		writefile(t, filepath.Join(dir, "many", strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+	before := srv.Sessions()
+	if err := run(append(role, "--role_duration", "60s", "sync", "--parallel", "8", dir, "s3://role/tree")...); err != nil {
+		t.Error("sync:", err)
+	}
+	if n := srv.Sessions() - before; n < 2 {
+		t.Error("not refreshed", n)
+	}
+	if data, _, ok := srv.Object("role", "tree/b"); !ok || string(data) != "bbb" {
+		t.Error("sync content mismatch")
+	}
+	if data, _, ok := srv.Object("role", "tree/many/15"); !ok || string(data) != "15" {
+		t.Error("parallel sync content mismatch")
+	}
+	// refresh assumes mfa role by mfa session, code is not asked again
+	before = srv.Sessions()
+	if err := run("--access_key", "AKID", "--secret_key", "SECRET", "--role_arn", "arn:aws:iam::123456789012:role/mfa",
+		"--mfa_serial", "arn:aws:iam::123456789012:mfa/user", "--mfa_token", "123456", "--role_duration", "60s",
+		"sync", dir, "s3://role/mfa"); err != nil {
+		t.Error("mfa sync:", err)
+	}
+	if n := srv.Sessions() - before; n < 3 {
+		t.Error("mfa role not refreshed", n)
+	}
+	if err := run("--access_key", "AKID", "--secret_key", "SECRET", "--role_arn", "arn:aws:iam::123456789012:role/mfa",
+		"--mfa_serial", "arn:aws:iam::123456789012:mfa/user", "--mfa_token", "000000", "ls", "s3://role/"); exitcode(err) != exitAuth {
+		t.Error("wrong mfa code:", err)
+	}
+	if err := run("--access_key", "AKID", "--secret_key", "SECRET", "--role_arn", "arn:aws:iam::123456789012:role/s3",
+		"--external_id", "wrong", "ls", "s3://role/"); exitcode(err) != exitAuth {
+		t.Error("wrong external id:", err)
+	}
+	writefile(t, filepath.Join(dir, "token"), []byte("jwt\n"))
+	writefile(t, filepath.Join(dir, "config"), []byte("[profile web]\nrole_arn = arn:aws:iam::123456789012:role/web\n"+
+		"web_identity_token_file = "+filepath.Join(dir, "token")+"\n"))
+	if err := run("--aws_config", filepath.Join(dir, "config"), "--profile", "web", "ls", "s3://role/"); err != nil {
+		t.Error("web identity:", err)
+	}
+	if err := run("--role_arn", "arn:aws:iam::123456789012:role/web", "--web_identity_token_file", filepath.Join(dir, "a"),
+		"ls", "s3://role/"); exitcode(err) != exitAuth {
+		t.Error("wrong web identity token:", err)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	bkt := mkbucket(t)
+	dir := t.TempDir()
+	key1, key2 := filepath.Join(dir, "key1"), filepath.Join(dir, "key2")
+	writefile(t, key1, randdata(32))
+	writefile(t, key2, []byte(base64.StdEncoding.EncodeToString(randdata(64)[32:])+"\n"))
+	small := randdata(1000)
+	big := randdata(6 * mib)
+	writefile(t, filepath.Join(dir, "small"), small)
+	writefile(t, filepath.Join(dir, "big"), big)
+	us := "s3://" + bkt + "/"
+	mustrun(t, "--sse-c-key", key1, "put", filepath.Join(dir, "small"), us+"c/small")
+	mustrun(t, "--sse-c-key", key1, "cp", "--split", "5242880", filepath.Join(dir, "big"), us+"c/big")
+	mustrun(t, "--sse-c-key", key1, "--signature", "v4", "--payload", "chunked", "cp", "--split", "5242880",
+		filepath.Join(dir, "big"), us+"c/chunked")
+	if _, hdr, _ := fake.Object(bkt, "c/big"); hdr.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "AES256" {
+		t.Error("multipart not encrypted", hdr)
+	}
+	if _, err := s3cmd(t, "cat", us+"c/small"); exitcode(err) != exitFailure {
+		t.Error("cat without key:", err)
+	}
+	if _, err := s3cmd(t, "--sse-c-key", key2, "cat", us+"c/small"); exitcode(err) != exitAuth {
+		t.Error("cat with wrong key:", err)
+	}
+	for k, v := range map[string][]byte{"small": small, "big": big, "chunked": big} {
+		if out, err := s3cmd(t, "--sse-c-key", key1, "cat", us+"c/"+k); err != nil || out != string(v) {
+			t.Error("cat", k, len(out), err)
+		}
+	}
+	// server side copy with new key, ranged read of multipart copy
+	mustrun(t, "--sse-c-source-key", key1, "--sse-c-key", key2, "cp", us+"c/small", us+"c2/small")
+	mustrun(t, "--sse-c-key", key1, "merge", us+"c/merged", us+"c/big", us+"c/small")
+	if out, err := s3cmd(t, "--sse-c-key", key2, "cat", us+"c2/small"); err != nil || out != string(small) {
+		t.Error("copy with new key", len(out), err)
+	}
+	if out, err := s3cmd(t, "--sse-c-key", key1, "cat", us+"c/merged"); err != nil || out != string(big)+string(small) {
+		t.Error("merge", len(out), err)
+	}
+	// copy plain object to encrypted
+	putdata(t, bkt, "plain", small)
+	mustrun(t, "--sse-c-source-key", "none", "--sse-c-key", key1, "cp", us+"plain", us+"c/plain")
+	// sse-s3, sse-kms
+	mustrun(t, "--sse", "AES256", "put", filepath.Join(dir, "small"), us+"s3")
+	mustrun(t, "--sse", "aws:kms", "--sse-kms-key-id", "mykey", "cp", us+"s3", us+"kms")
+	for k, v := range map[string]string{"s3": "AES256", "kms": "aws:kms"} {
+		if _, hdr, _ := fake.Object(bkt, k); hdr.Get("X-Amz-Server-Side-Encryption") != v {
+			t.Error("sse", k, hdr)
+		}
+	}
+	if _, hdr, _ := fake.Object(bkt, "kms"); hdr.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "mykey" {
+		t.Error("kms key id", hdr)
+	}
+	for _, opts := range [][]string{{"--sse", "des"}, {"--sse", "AES256", "--sse-c-key", key1}, {"--sse-kms-key-id", "k"}} {
+		if _, err := s3cmd(t, append(opts, "put", filepath.Join(dir, "small"), us+"x")...); exitcode(err) != exitUsage {
+			t.Error(opts, err)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	bkt := mkbucket(t)
+	dir := t.TempDir()
+	master := filepath.Join(dir, "master")
+	writefile(t, master, randdata(32))
+	src := filepath.Join(dir, "src")
+	small := randdata(100*1024 + 7)
+	big := randdata(11 * mib)
+	writefile(t, filepath.Join(src, "small"), small)
+	writefile(t, filepath.Join(src, "big"), big)
+	writefile(t, filepath.Join(src, "empty"), nil)
+	us := "s3://" + bkt + "/"
+	run := func(args ...string) string {
+		return mustrun(t, append([]string{"--encrypt-key", master}, args...)...)
+	}
+	run("put", filepath.Join(src, "small"), us+"put/small")
+	run("sync", "--split", "5242880", src, us+"sync")
+	for _, k := range []string{"put/small", "sync/small", "sync/big"} {
+		data, hdr, _ := fake.Object(bkt, k)
+		if bytes.Contains(data, small[:1024]) || bytes.Contains(data, big[:1024]) || hdr.Get("X-Amz-Meta-S3cmd-Cse-Key") == "" {
+			t.Error("not encrypted", k, hdr)
+		}
+		// md5 of content is not visible to the server
+		if hdr.Get("X-Amz-Meta-Md5") != "" || hdr.Get("X-Amz-Meta-S3cmd-Cse-Mac") == "" {
+			t.Error("md5 of content", k, hdr)
+		}
+	}
+	if out := run("cat", us+"sync/big"); out != string(big) {
+		t.Error("cat multipart", len(out))
+	}
+	if out := run("getrange", "--range", "65530-200000", us+"put/small"); out != string(small[65530:]) {
+		t.Error("getrange", len(out))
+	}
+	if out, err := s3cmd(t, "cat", us+"put/small"); err != nil || out == string(small) {
+		t.Error("cat without key", err)
+	}
+	// unchanged objects are not uploaded again
+	before, _, _ := fake.Object(bkt, "sync/big")
+	run("sync", "--split", "5242880", src, us+"sync")
+	if after, _, _ := fake.Object(bkt, "sync/big"); !bytes.Equal(before, after) {
+		t.Error("sync uploaded unchanged object")
+	}
+	// mv keeps data key of multipart copy
+	func() {
+		defer func(v int64) { maxcopysize = v }(maxcopysize)
+		maxcopysize = 5 * mib
+		run("cp", us+"sync/big", us+"mv/big")
+		run("mv", "--split", "5242880", us+"mv/big", us+"mv/moved")
+	}()
+	if out := run("cat", us+"mv/moved"); out != string(big) {
+		t.Error("cat after mv", len(out))
+	}
+	// copies of encrypted objects are compared by keyed digest
+	func() {
+		defer func(v int64) { maxcopysize = v }(maxcopysize)
+		maxcopysize = 5 * mib
+		run("sync", us+"sync", us+"copy")
+		mustrun(t, "setmeta", "--meta", "mark=1", us+"copy/big")
+		run("sync", us+"sync", us+"copy")
+	}()
+	if _, hdr, _ := fake.Object(bkt, "copy/big"); hdr.Get("X-Amz-Meta-Mark") != "1" {
+		t.Error("sync copied unchanged encrypted object")
+	}
+	dst := t.TempDir()
+	run("sync", "--split", "5242880", us+"sync", dst)
+	for k, v := range map[string][]byte{"small": small, "big": big, "empty": nil} {
+		if got, err := ioutil.ReadFile(filepath.Join(dst, k)); err != nil || !bytes.Equal(got, v) {
+			t.Error("sync download", k, len(got), err)
+		}
+	}
+	fn := filepath.Join(dir, "out.tar")
+	run("tar", "-f", fn, us+"put/")
+	fp, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	rd := tar.NewReader(fp)
+	if _, err := rd.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(rd); err != nil || !bytes.Equal(got, small) {
+		t.Error("tar content", len(got), err)
+	}
+	// passphrase
+	pass := []string{"--encrypt-passphrase", "secret"}
+	mustrun(t, append(pass, "putmulti", "--split", "5242880", filepath.Join(src, "big"), us+"pass/big")...)
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(t.TempDir())
+	mustrun(t, append(pass, "get", us+"pass/big")...)
+	if got, err := ioutil.ReadFile("big"); err != nil || !bytes.Equal(got, big) {
+		t.Error("get with passphrase", len(got), err)
+	}
+	for _, opts := range [][]string{{"--encrypt-passphrase", "wrong"}, {"--encrypt-key", master}} {
+		if _, err := s3cmd(t, append(opts, "cat", us+"pass/big")...); exitcode(err) != exitFailure {
+			t.Error(opts, "decrypted:", err)
+		}
+	}
+	if _, err := s3cmd(t, "--encrypt-key", master, "--encrypt-passphrase", "secret", "ls", us); exitcode(err) != exitUsage {
+		t.Error("both keys:", err)
+	}
+}
+
+// RFC 7914 11. test vectors of PBKDF2-HMAC-SHA256
+func TestKdf(t *testing.T) {
+	defer func() { cseopt.passphrase, cseopt.keks = "", map[string][]byte{} }()
+	for _, v := range []struct {
+		pass, salt string
+		iter       int
+		kek        string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	} {
+		cseopt.passphrase, cseopt.keks = v.pass, map[string][]byte{}
+		kek, err := csekek(fmt.Sprintf("pbkdf2-sha256:%d:%s", v.iter, base64.StdEncoding.EncodeToString([]byte(v.salt))))
+		if err != nil || hex.EncodeToString(kek) != v.kek {
+			t.Errorf("kek of %s: %x %v", v.pass, kek, err)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	bkt := mkbucket(t)
+	dir := t.TempDir()
+	us := "s3://" + bkt + "/"
+	expires := "Thu, 01 Dec 2033 16:00:00 GMT"
+	writefile(t, filepath.Join(dir, "small"), randdata(100))
+	writefile(t, filepath.Join(dir, "big"), randdata(6*mib))
+	mustrun(t, "put", "--meta", "owner=me", "--header", "Cache-Control: max-age=60", "--header", "Expires: "+expires,
+		"--header", "Content-Type: text/x-custom", "--header", "x-amz-meta-color: red", filepath.Join(dir, "small"), us+"small")
+	mustrun(t, "putmulti", "--split", "5242880", "--header", "Content-Disposition: attachment", "--header", "Expires: "+expires,
+		filepath.Join(dir, "big"), us+"big")
+	for k, want := range map[string]map[string]string{
+		"small": {"Cache-Control": "max-age=60", "Expires": expires, "Content-Type": "text/x-custom",
+			"X-Amz-Meta-Owner": "me", "X-Amz-Meta-Color": "red"},
+		"big": {"Content-Disposition": "attachment", "Expires": expires},
+	} {
+		_, hdr, _ := fake.Object(bkt, k)
+		for h, v := range want {
+			if hdr.Get(h) != v {
+				t.Error(k, h, hdr.Get(h))
+			}
+		}
+	}
+	// rules by glob, override --header
+	site := filepath.Join(dir, "site")
+	for _, k := range []string{"index.html", "app.js", "assets/style.css", "img/logo.png"} {
+		writefile(t, filepath.Join(site, k), []byte(k))
+	}
+	rules := filepath.Join(dir, "rules")
+	writefile(t, rules, []byte("# cache\n*.js Cache-Control: max-age=31536000\nindex.html Cache-Control: no-cache\nassets/*.css Content-Encoding: gzip\n"))
+	mustrun(t, "sync", "--header", "Cache-Control: max-age=3600", "--header-rules", rules, site, us+"site")
+	for k, want := range map[string][2]string{
+		"index.html":       {"no-cache", ""},
+		"app.js":           {"max-age=31536000", ""},
+		"assets/style.css": {"max-age=3600", "gzip"},
+		"img/logo.png":     {"max-age=3600", ""},
+	} {
+		_, hdr, _ := fake.Object(bkt, "site/"+k)
+		if hdr.Get("Cache-Control") != want[0] || hdr.Get("Content-Encoding") != want[1] {
+			t.Error(k, hdr)
+		}
+	}
+	writefile(t, rules, []byte("*.js Expires: "+expires+"\n"))
+	mustrun(t, "sync", "--header-rules", rules, site, us+"expires")
+	for k, want := range map[string]string{"app.js": expires, "index.html": ""} {
+		if _, hdr, _ := fake.Object(bkt, "expires/"+k); hdr.Get("Expires") != want || hdr.Get("X-Amz-Meta-Expires") != "" {
+			t.Error("expires rule", k, hdr)
+		}
+	}
+	writefile(t, rules, []byte("*.js X-Foo: bar\n"))
+	for _, opts := range [][]string{{"--header", "X-Foo: bar"}, {"--header", "nocolon"}, {"--meta", "novalue"}, {"--header-rules", rules}} {
+		if _, err := s3cmd(t, append(append([]string{"sync"}, opts...), site, us+"x")...); exitcode(err) != exitUsage {
+			t.Error(opts, err)
+		}
+	}
+}
+
+func TestSetmeta(t *testing.T) {
+	bkt := mkbucket(t)
+	dir := t.TempDir()
+	us := "s3://" + bkt + "/"
+	data := randdata(1000)
+	writefile(t, filepath.Join(dir, "a.js"), data)
+	writefile(t, filepath.Join(dir, "b.html"), data)
+	mustrun(t, "put", "--meta", "a=1", "--header", "Cache-Control: max-age=60", filepath.Join(dir, "a.js"), filepath.Join(dir, "b.html"), us+"d/")
+	mustrun(t, "setacl", "--acl", "public-read", us+"d/a.js")
+	check := func(key string, want map[string]string) {
+		t.Helper()
+		got, hdr, _ := fake.Object(bkt, key)
+		if !bytes.Equal(got, data) {
+			t.Error(key, "content changed")
+		}
+		for k, v := range want {
+			if hdr.Get(k) != v {
+				t.Error(key, k, hdr.Get(k))
+			}
+		}
+	}
+	// merge
+	mustrun(t, "setmeta", "--meta", "b=2", "--header", "Content-Type: text/plain", us+"d/a.js")
+	check("d/a.js", map[string]string{"X-Amz-Meta-A": "1", "X-Amz-Meta-B": "2", "Cache-Control": "max-age=60", "Content-Type": "text/plain"})
+	if out := mustrun(t, "getacl", us+"d/a.js"); !strings.Contains(out, allusers) {
+		t.Error("acl not kept", out)
+	}
+	// replace, remove
+	mustrun(t, "setmeta", "--replace", "--meta", "c=3", us+"d/a.js")
+	check("d/a.js", map[string]string{"X-Amz-Meta-A": "", "X-Amz-Meta-B": "", "X-Amz-Meta-C": "3", "Cache-Control": "max-age=60"})
+	mustrun(t, "setmeta", "--remove-meta", "c", us+"d/a.js")
+	check("d/a.js", map[string]string{"X-Amz-Meta-C": ""})
+	// dry-run, recursive with rules
+	rules := filepath.Join(dir, "rules")
+	writefile(t, rules, []byte("*.html Cache-Control: no-cache\n"))
+	out := mustrun(t, "setmeta", "-R", "-n", "--header-rules", rules, us+"d/")
+	if !strings.Contains(out, us+"d/b.html\n") || !strings.Contains(out, "Cache-Control: no-cache") {
+		t.Errorf("dry-run: %s", out)
+	}
+	check("d/b.html", map[string]string{"Cache-Control": "max-age=60"})
+	mustrun(t, "setmeta", "-R", "--header-rules", rules, us+"d/")
+	check("d/b.html", map[string]string{"Cache-Control": "no-cache", "X-Amz-Meta-A": "1"})
+	check("d/a.js", map[string]string{"Cache-Control": "max-age=60"})
+	// content metadata of encryption is kept
+	master := filepath.Join(dir, "master")
+	writefile(t, master, randdata(32))
+	mustrun(t, "--encrypt-key", master, "put", filepath.Join(dir, "a.js"), us+"enc")
+	mustrun(t, "setmeta", "--replace", us+"enc")
+	if out := mustrun(t, "--encrypt-key", master, "cat", us+"enc"); out != string(data) {
+		t.Error("encrypted object broken")
+	}
+	if _, err := s3cmd(t, "setmeta", us+"enc"); exitcode(err) != exitUsage {
+		t.Error("no change:", err)
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	bkt := mkbucket(t)
+	dir := t.TempDir()
+	us := "s3://" + bkt + "/"
+	writefile(t, filepath.Join(dir, "small"), randdata(100))
+	writefile(t, filepath.Join(dir, "big"), randdata(6*mib))
+	mustrun(t, "put", "--storage-class", "standard_ia", filepath.Join(dir, "small"), us+"put")
+	mustrun(t, "putmulti", "--split", "5242880", "--storage-class", "ONEZONE_IA", filepath.Join(dir, "big"), us+"putmulti")
+	mustrun(t, "sync", "--storage-class", "GLACIER_IR", dir, us+"sync")
+	mustrun(t, "cp", "--storage-class", "INTELLIGENT_TIERING", us+"put", us+"cp")
+	mustrun(t, "put", filepath.Join(dir, "small"), us+"std")
+	for k, v := range map[string]string{"put": "STANDARD_IA", "putmulti": "ONEZONE_IA", "sync/big": "GLACIER_IR", "cp": "INTELLIGENT_TIERING"} {
+		if _, hdr, _ := fake.Object(bkt, k); hdr.Get("X-Amz-Storage-Class") != v {
+			t.Error(k, hdr.Get("X-Amz-Storage-Class"))
+		}
+	}
+	out := mustrun(t, "ls", "-l", us)
+	for _, s := range []string{"STANDARD_IA", "ONEZONE_IA", "STANDARD "} {
+		if !strings.Contains(out, s) {
+			t.Errorf("ls -l without %s: %s", s, out)
+		}
+	}
+	// filters, dry-run
+	if out := mustrun(t, "transition", "--storage-class", "GLACIER", "--older-than", "1d", us); strings.Contains(out, "transition") {
+		t.Error("older-than:", out)
+	}
+	out = mustrun(t, "transition", "-n", "--storage-class", "GLACIER", "--min-size", "1000", "--newer-than", "1h", us)
+	if !strings.Contains(out, us+"putmulti ONEZONE_IA => GLACIER") || !strings.Contains(out, us+"sync/big") || strings.Contains(out, us+"put ") {
+		t.Error("transition -n:", out)
+	}
+	if _, hdr, _ := fake.Object(bkt, "putmulti"); hdr.Get("X-Amz-Storage-Class") != "ONEZONE_IA" {
+		t.Error("dry-run changed class")
+	}
+	putdata(t, bkt, "deep", []byte("deep"))
+	mustrun(t, "setmeta", "--meta", "k=v", us+"deep")
+	mustrun(t, "transition", "--storage-class", "DEEP_ARCHIVE", "--max-size", "10", us)
+	for k, v := range map[string]string{"deep": "DEEP_ARCHIVE", "put": "STANDARD_IA", "putmulti": "ONEZONE_IA"} {
+		if _, hdr, _ := fake.Object(bkt, k); hdr.Get("X-Amz-Storage-Class") != v {
+			t.Error("transition", k, hdr.Get("X-Amz-Storage-Class"))
+		}
+	}
+	if _, hdr, _ := fake.Object(bkt, "deep"); hdr.Get("X-Amz-Meta-K") != "v" {
+		t.Error("transition lost metadata", hdr)
+	}
+	// archived objects need restore
+	if _, err := s3cmd(t, "transition", "--storage-class", "STANDARD", us+"deep"); exitcode(err) != exitFailure {
+		t.Error("transition of archived object:", err)
+	}
+	mustrun(t, "restore", us+"deep")
+	mustrun(t, "transition", "--storage-class", "STANDARD", us+"deep")
+	if _, hdr, _ := fake.Object(bkt, "deep"); hdr.Get("X-Amz-Storage-Class") != "STANDARD" {
+		t.Error("transition of restored object", hdr.Get("X-Amz-Storage-Class"))
+	}
+	if _, err := s3cmd(t, "put", "--storage-class", "COLD", filepath.Join(dir, "small"), us+"x"); exitcode(err) != exitUsage {
+		t.Error("invalid class:", err)
+	}
+	if _, err := s3cmd(t, "transition", us); exitcode(err) != exitUsage {
+		t.Error("transition without class:", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	bkt := mkbucket(t)
+	us := "s3://" + bkt + "/"
+	putdata(t, bkt, "cold/a", []byte("aaa"))
+	putdata(t, bkt, "cold/b", []byte("bbb"))
+	putdata(t, bkt, "warm", []byte("warm"))
+	mustrun(t, "transition", "--storage-class", "GLACIER", us+"cold/")
+	if _, err := s3cmd(t, "cat", us+"cold/a"); exitcode(err) != exitFailure {
+		t.Error("cat archived:", err)
+	}
+	if out := mustrun(t, "restore-status", "-R", us); !strings.Contains(out, us+"cold/a GLACIER archived") || !strings.Contains(out, us+"warm STANDARD available") {
+		t.Error("restore-status:", out)
+	}
+	if out := mustrun(t, "restore", "-n", "-R", us); !strings.Contains(out, us+"cold/b days=1 tier=Standard") || strings.Contains(out, "warm") {
+		t.Error("restore -n:", out)
+	}
+	if _, hdr, _ := fake.Object(bkt, "cold/a"); hdr.Get("X-Amz-Restore") != "" {
+		t.Error("dry-run restored", hdr)
+	}
+	fake.RestoreDelay = 300 * time.Millisecond
+	defer func() { fake.RestoreDelay = 0 }()
+	mustrun(t, "restore", us+"cold/a")
+	if out := mustrun(t, "restore-status", us+"cold/a"); !strings.Contains(out, "restoring") {
+		t.Error("restore-status ongoing:", out)
+	}
+	// in progress is not an error
+	mustrun(t, "restore", us+"cold/a")
+	if _, err := s3cmd(t, "cat", "--wait", "--wait-interval", "50ms", "--wait-timeout", "100ms", us+"cold/a"); exitcode(err) != exitTimeout {
+		t.Error("wait timeout:", err)
+	}
+	if _, err := s3cmd(t, "cat", "--wait", us+"cold/b"); err == nil || !strings.Contains(err.Error(), "1 of 1") {
+		t.Error("wait without restore:", err)
+	}
+	if out := mustrun(t, "cat", "--wait", "--wait-interval", "50ms", us+"cold/a"); out != "aaa" {
+		t.Errorf("cat --wait: %q", out)
+	}
+	mustrun(t, "restore", "-R", "--wait", "--wait-interval", "50ms", "--tier", "bulk", "--days", "2", us+"cold/")
+	dir := t.TempDir()
+	mustrun(t, "get", "-R", us+"cold/", dir)
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "b")); err != nil || string(got) != "bbb" {
+		t.Error("get restored:", string(got), err)
+	}
+	if out := mustrun(t, "restore-status", us+"cold/b"); !strings.Contains(out, "restored until") {
+		t.Error("restore-status restored:", out)
+	}
+	out := mustrun(t, "--output", "csv", "restore-status", us+"cold/b", us+"warm")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[0], ",restore,restore_expiry") ||
+		!strings.Contains(lines[1], ",restored,") || strings.HasSuffix(lines[1], ",restored,") || !strings.HasSuffix(lines[2], ",available,") {
+		t.Errorf("restore-status csv: %s", out)
+	}
+	if _, err := s3cmd(t, "restore", us+"warm"); exitcode(err) != exitFailure {
+		t.Error("restore of standard object:", err)
+	}
+	if _, err := s3cmd(t, "restore", "--tier", "fast", us+"cold/a"); exitcode(err) != exitUsage {
+		t.Error("invalid tier:", err)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	bkt := mkbucket(t)
+	us := "s3://" + bkt + "/"
+	if out := mustrun(t, "versioning", "status", us); !strings.Contains(out, "Disabled") {
+		t.Error("status:", out)
+	}
+	if out := mustrun(t, "versioning", "enable", us); !strings.Contains(out, "Enabled") {
+		t.Error("enable:", out)
+	}
+	putdata(t, bkt, "k", []byte("v1"))
+	putdata(t, bkt, "k", []byte("v22"))
+	putdata(t, bkt, "dir/a", []byte("a"))
+	versions := func() []record {
+		t.Helper()
+		recs := []record{}
+		if err := json.Unmarshal([]byte(mustrun(t, "--output", "json", "ls", "-R", "--versions", us)), &recs); err != nil {
+			t.Fatal(err)
+		}
+		return recs
+	}
+	recs := versions()
+	if len(recs) != 3 || recs[1].Key != "k" || !recs[1].IsLatest || recs[2].IsLatest || recs[2].Size != 2 {
+		t.Fatalf("ls --versions: %+v", recs)
+	}
+	v1, v2 := recs[2].VersionId, recs[1].VersionId
+	if out := mustrun(t, "cat", "--version-id", v1, us+"k"); out != "v1" {
+		t.Errorf("cat --version-id: %q", out)
+	}
+	if out := mustrun(t, "head", "--version-id", v1, us+"k"); !strings.Contains(out, "Content-Length: 2") {
+		t.Error("head --version-id:", out)
+	}
+	mustrun(t, "cp", "--version-id", v1, us+"k", us+"old")
+	if got := content(t, bkt, "old"); string(got) != "v1" {
+		t.Errorf("cp --version-id: %q", got)
+	}
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(t.TempDir())
+	mustrun(t, "get", "--version-id", v1, us+"k")
+	if got, err := ioutil.ReadFile("k"); err != nil || string(got) != "v1" {
+		t.Error("get --version-id:", string(got), err)
+	}
+	mustrun(t, "cp", "--version-id", v1, us+"k", "local")
+	if got, err := ioutil.ReadFile("local"); err != nil || string(got) != "v1" {
+		t.Error("cp --version-id to local:", string(got), err)
+	}
+	if _, err := s3cmd(t, "cat", "--version-id", "nosuchversion", us+"k"); exitcode(err) != exitNotFound {
+		t.Error("cat of missing version:", err)
+	}
+	if _, err := s3cmd(t, "cat", "-R", "--version-id", v1, us); exitcode(err) != exitUsage {
+		t.Error("version-id with -R:", err)
+	}
+	// delete marker
+	mustrun(t, "del", us+"k")
+	mustrun(t, "del", "-R", us+"dir/")
+	checkkeys(t, bkt, "old")
+	if out := mustrun(t, "ls", "-R", "--versions", us); !strings.Contains(out, "DELETED") || !strings.Contains(out, v1) {
+		t.Error("ls --versions after delete:", out)
+	}
+	out := mustrun(t, "--output", "csv", "ls", "-R", "--versions", us+"k")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); !strings.HasSuffix(lines[0], ",version_id,is_latest,delete_marker") ||
+		!strings.Contains(out, ","+v1+",false,false\n") || !strings.Contains(out, ",true,true\n") {
+		t.Errorf("ls --versions csv: %s", out)
+	}
+	if out := mustrun(t, "undelete", "-n", "-R", us); !strings.Contains(out, "undelete "+us+"k ") || !strings.Contains(out, "undelete "+us+"dir/a ") {
+		t.Error("undelete -n:", out)
+	}
+	checkkeys(t, bkt, "old")
+	mustrun(t, "undelete", us+"k")
+	checkkeys(t, bkt, "k", "old")
+	if got := content(t, bkt, "k"); string(got) != "v22" {
+		t.Errorf("undelete: %q", got)
+	}
+	if _, err := s3cmd(t, "undelete", us+"k"); exitcode(err) != exitFailure {
+		t.Error("undelete of live key:", err)
+	}
+	mustrun(t, "undelete", "-R", us+"dir/")
+	checkkeys(t, bkt, "dir/a", "k", "old")
+	mustrun(t, "del", "--version-id", v2, us+"k")
+	if got := content(t, bkt, "k"); string(got) != "v1" {
+		t.Errorf("del --version-id: %q", got)
+	}
+	if out := mustrun(t, "info", us); !strings.Contains(out, "Versioning: Enabled") {
+		t.Error("info:", out)
+	}
+	if out := mustrun(t, "versioning", "suspend", us); !strings.Contains(out, "Suspended") {
+		t.Error("suspend:", out)
+	}
+	if _, err := s3cmd(t, "versioning", "on", us); exitcode(err) != exitUsage {
+		t.Error("invalid action:", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	bkt := mkbucket(t)
+	us := "s3://" + bkt + "/"
+	mustrun(t, "versioning", "enable", us)
+	putdata(t, bkt, "app/k1", []byte("old1"))
+	putdata(t, bkt, "app/k2", []byte("old2"))
+	putdata(t, bkt, "other", []byte("other"))
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(10 * time.Millisecond)
+	putdata(t, bkt, "app/k1", []byte("new1"))
+	mustrun(t, "del", us+"app/k2")
+	putdata(t, bkt, "app/k3", []byte("new3"))
+	mustrun(t, "del", us+"other")
+	out := mustrun(t, "rollback", "-n", "--at", at, us+"app/")
+	for _, s := range []string{"copy " + us + "app/k1 ", "copy " + us + "app/k2 ", "delete " + us + "app/k3"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("rollback -n without %s: %s", s, out)
+		}
+	}
+	checkkeys(t, bkt, "app/k1", "app/k3")
+	mustrun(t, "rollback", "--at", at, us+"app/")
+	checkkeys(t, bkt, "app/k1", "app/k2")
+	for k, v := range map[string]string{"app/k1": "old1", "app/k2": "old2"} {
+		if got := content(t, bkt, k); string(got) != v {
+			t.Errorf("%s: %q", k, got)
+		}
+	}
+	if out := mustrun(t, "rollback", "--at", at, us+"app/"); out != "" {
+		t.Error("second rollback:", out)
+	}
+	// nothing existed a day ago
+	if out := mustrun(t, "rollback", "-n", "--at", "1d", us); !strings.Contains(out, "delete "+us+"app/k1") || strings.Contains(out, "other") {
+		t.Error("rollback to 1d:", out)
+	}
+	if _, err := s3cmd(t, "rollback", "--at", "yesterday", us); exitcode(err) != exitUsage {
+		t.Error("invalid time:", err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	bkt := mkbucket(t)
+	us := "s3://" + bkt
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.yaml")
+	writefile(t, rules, []byte(`rules:
+  - id: logs
+    prefix: logs/
+    transitions:
+      - {days: 30, class: STANDARD_IA}
+      - {days: 90, class: GLACIER}
+    expire_days: 365
+    abort_multipart_days: 7
+  - id: tmp
+    status: disabled
+    tags: {tmp: "yes"}
+    expire_date: 2030-01-01
+`))
+	if _, err := s3cmd(t, "lifecycle", "get", us); exitcode(err) != exitNotFound {
+		t.Error("get without configuration:", err)
+	}
+	out := mustrun(t, "lifecycle", "put", "-n", rules, us)
+	for _, s := range []string{"<Prefix>logs/</Prefix>", "<StorageClass>GLACIER</StorageClass>", "<DaysAfterInitiation>7</DaysAfterInitiation>",
+		"<Key>tmp</Key>", "<Status>Disabled</Status>", "<Date>2030-01-01T00:00:00Z</Date>"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("put -n without %s: %s", s, out)
+		}
+	}
+	if _, err := s3cmd(t, "lifecycle", "get", us); exitcode(err) != exitNotFound {
+		t.Error("put -n sent configuration:", err)
+	}
+	if out := mustrun(t, "lifecycle", "put", rules, us); !strings.Contains(out, "2 rules") {
+		t.Error("put:", out)
+	}
+	out = mustrun(t, "lifecycle", "get", us)
+	back := filepath.Join(dir, "back.yaml")
+	writefile(t, back, []byte(out))
+	if out2 := mustrun(t, "lifecycle", "put", "-n", back, us); out2 != mustrun(t, "lifecycle", "put", "-n", rules, us) {
+		t.Error("get is not same as put:", out)
+	}
+	for _, f := range []string{"ndjson", "csv"} {
+		if _, err := s3cmd(t, "--output", f, "lifecycle", "get", us); exitcode(err) != exitUsage {
+			t.Error("lifecycle get --output", f, err)
+		}
+	}
+	var got struct {
+		Rules []map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(mustrun(t, "--output", "json", "lifecycle", "get", us)), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Rules) != 2 || got.Rules[0]["expire_days"] != 365.0 || got.Rules[1]["expire_date"] != "2030-01-01" {
+		t.Error("get json:", got)
+	}
+	jsonrules := filepath.Join(dir, "rules.json")
+	writefile(t, jsonrules, []byte(`{"rules": [{"prefix": "old/", "noncurrent_expire_days": 10}]}`))
+	mustrun(t, "lifecycle", "put", jsonrules, us)
+	if out := mustrun(t, "lifecycle", "get", us); !strings.Contains(out, "noncurrent_expire_days: 10") || strings.Contains(out, "logs/") {
+		t.Error("put json:", out)
+	}
+	for _, bad := range []string{
+		"rules:\n  - transitions: [{days: 10, class: STANDARD_IA}]\n",
+		"rules:\n  - expire_days: 10\n    unknown: 1\n",
+		"rules:\n  - transitions: [{days: 100, class: GLACIER}]\n    expire_days: 100\n",
+		"rules:\n  - tags: {a: b}\n    abort_multipart_days: 1\n",
+		"rules:\n  - prefix: a/\n",
+		"rules:\n  - transitions: [{days: 1, class: COLD}]\n",
+	} {
+		fn := filepath.Join(dir, "bad.yaml")
+		writefile(t, fn, []byte(bad))
+		if _, err := s3cmd(t, "lifecycle", "put", fn, us); exitcode(err) != exitUsage {
+			t.Errorf("invalid rules %q: %v", bad, err)
+		}
+	}
+	mustrun(t, "lifecycle", "delete", us)
+	if _, err := s3cmd(t, "lifecycle", "get", us); exitcode(err) != exitNotFound {
+		t.Error("get after delete:", err)
+	}
+}
+
+func TestSigV4(t *testing.T) {
+	srv := fakes3.Start()
+	defer srv.Close()
+	srv.Keys = map[string]string{"AKID": "SECRET"}
+	run := func(args ...string) (string, error) {
+		argv := []string{"s3cmd", "--config", "/nonexistent/credential.json", "--s3cfg", "/nonexistent/.s3cfg",
+			"--aws_credentials", "/nonexistent/credentials", "--aws_config", "/nonexistent/config",
+			"--access_key", "AKID", "--endpoint", srv.URL, "--retry", "1", "--signature", "v4", "--sign-region", "eu-central-1"}
+		return runapp(t, append(argv, args...)...)
+	}
+	if _, err := run("--secret_key", "SECRET", "mb", "s3://sigv4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("--secret_key", "WRONG", "ls", "s3://sigv4/"); exitcode(err) != exitAuth {
+		t.Error("wrong secret:", err)
+	}
+	if _, err := runapp(t, "s3cmd", "--config", "/nonexistent/credential.json", "--s3cfg", "/nonexistent/.s3cfg",
+		"--access_key", "AKID", "--secret_key", "SECRET", "--endpoint", srv.URL, "--retry", "1", "ls", "s3://sigv4/"); exitcode(err) != exitAuth {
+		t.Error("v2 accepted:", err)
+	}
+	dir := t.TempDir()
+	small := randdata(100 * 1024)
+	big := randdata(11 * mib)
+	writefile(t, filepath.Join(dir, "small key"), small)
+	writefile(t, filepath.Join(dir, "big"), big)
+	for _, payload := range []string{"signed", "unsigned", "chunked"} {
+		opts := []string{"--secret_key", "SECRET", "--payload", payload}
+		if _, err := run(append(opts, "put", filepath.Join(dir, "small key"), "s3://sigv4/"+payload+"/small key")...); err != nil {
+			t.Error(payload, "put:", err)
+		}
+		if _, err := run(append(opts, "cp", "--split", "5242880", filepath.Join(dir, "big"), "s3://sigv4/"+payload+"/big")...); err != nil {
+			t.Error(payload, "cp:", err)
+		}
+		if out, err := run(append(opts, "cat", "s3://sigv4/"+payload+"/small key")...); err != nil || out != string(small) {
+			t.Error(payload, "cat:", len(out), err)
+		}
+		if data, _, ok := srv.Object("sigv4", payload+"/big"); !ok || !bytes.Equal(data, big) {
+			t.Error(payload, "multipart content mismatch")
+		}
+		// last part is shorter than --split
+		if _, err := run(append(opts, "putmulti", "--split", "5242880", filepath.Join(dir, "big"), "s3://sigv4/"+payload+"/putmulti")...); err != nil {
+			t.Error(payload, "putmulti:", err)
+		}
+		if _, err := run(append(opts, "sync", "--split", "5242880", dir, "s3://sigv4/"+payload+"/sync")...); err != nil {
+			t.Error(payload, "sync:", err)
+		}
+		for _, k := range []string{"putmulti", "sync/big"} {
+			data, hdr, ok := srv.Object("sigv4", payload+"/"+k)
+			if !ok || !bytes.Equal(data, big) {
+				t.Error(payload, k, "content mismatch")
+			} else if etagparts(strings.Trim(hdr.Get("ETag"), `"`)) != 3 {
+				t.Error(payload, k, "etag", hdr.Get("ETag"))
+			}
+		}
+	}
+	if _, err := run("--secret_key", "SECRET", "getacl", "s3://sigv4/signed/big"); err != nil {
+		t.Error("getacl:", err)
+	}
+	out, err := run("--secret_key", "SECRET", "list-url", "s3://sigv4/unsigned/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range strings.Fields(out) {
+		rsp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != 200 || (!bytes.Equal(data, small) && !bytes.Equal(data, big)) {
+			t.Error("presigned get:", u, rsp.Status)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+	"github.com/wtnb75/go-s3cmd/sigv4"
+)
+
+var signflags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "signature",
+		Usage:  "signature version v2 or v4 (default: from config or region)",
+		EnvVar: "S3CMD_SIGNATURE",
+	},
+	cli.StringFlag{
+		Name:  "sign-region",
+		Usage: "region name in v4 signature (for custom endpoint)",
+	},
+	cli.StringFlag{
+		Name:  "payload",
+		Usage: "v4 upload payload: signed, unsigned or chunked (default: signed)",
+	},
+}
+
+// signed: hash whole body, unsigned: UNSIGNED-PAYLOAD, chunked: aws-chunked
+var payloadmode = "signed"
+
+func signsetup(c *cli.Context, prof profile) error {
+	if c.GlobalString("signature") != "" {
+		prof.signature = c.GlobalString("signature")
+	}
+	if c.GlobalString("sign-region") != "" {
+		prof.region = c.GlobalString("sign-region")
+	}
+	payloadmode = prof.payload
+	if c.GlobalString("payload") != "" {
+		payloadmode = c.GlobalString("payload")
+	}
+	switch payloadmode {
+	case "":
+		payloadmode = "signed"
+	case "signed", "unsigned", "chunked":
+	default:
+		return usageerr("invalid payload: %s", payloadmode)
+	}
+	return signclient(s3cl, prof)
+}
+
+// signature version and v4 region of client
+func signclient(cl *s3.S3, prof profile) error {
+	sig := prof.signature
+	if sig == "" {
+		sig = "v2"
+		if cl.Region.EC2Endpoint.Signer == aws.V4Signature {
+			sig = "v4"
+		}
+	}
+	switch sig {
+	case "v2":
+		cl.Signature = aws.V2Signature
+		return nil
+	case "v4":
+	default:
+		return usageerr("invalid signature: %s", sig)
+	}
+	region := prof.region
+	if region == "" {
+		if _, ok := aws.Regions[cl.Region.Name]; ok {
+			region = cl.Region.Name
+		} else {
+			region = "us-east-1"
+		}
+	}
+	// goamz uses Region.Name in credential scope
+	cl.Region.Name = region
+	cl.Signature = aws.V4Signature
+	log.Println("signature v4", prof.name, region, payloadmode)
+	return nil
+}
+
+// v4 signer for our own requests. nil for v2. call in authed
+func v4signer(cl *s3.S3) *sigv4.Signer {
+	if cl.Signature != aws.V4Signature {
+		return nil
+	}
+	return sigv4.New(cl.Auth.AccessKey, cl.Auth.SecretKey, cl.Auth.Token(), cl.Region.Name)
+}
+
+// upload without buffering body in memory
+func streaming(cl *s3.S3) bool {
+	return cl.Signature == aws.V4Signature && payloadmode != "signed"
+}
+
+// url of key, addressing same as goamz
+func objurl(bkt *s3.Bucket, key string, params url.Values) (*url.URL, error) {
+	base := bkt.S3BucketEndpoint
+	p := "/" + key
+	if base == "" {
+		base = bkt.S3Endpoint
+		p = "/" + bkt.Name + p
+	} else {
+		base = strings.Replace(base, "${bucket}", bkt.Name, -1)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = sigv4.URIEncode(u.Path, false)
+	u.RawQuery = params.Encode()
+	return u, nil
+}
+
+func presignurl(bkt *s3.Bucket, key string, expires time.Time) (us string) {
+	authed(func() error {
+		signer := v4signer(bkt.S3)
+		if signer == nil {
+			us = bkt.SignedURL(key, expires)
+			return nil
+		}
+		u, err := objurl(bkt, key, nil)
+		if err != nil {
+			log.Println("url", bkt.Name, key, err)
+			return err
+		}
+		signer.Presign(&http.Request{Method: "GET", URL: u, Header: http.Header{}}, time.Until(expires))
+		us = u.String()
+		return nil
+	})
+	return
+}
+
+func s3error(rsp *http.Response) error {
+	s3err := &s3.Error{}
+	xml.NewDecoder(rsp.Body).Decode(s3err)
+	s3err.StatusCode = rsp.StatusCode
+	if s3err.Message == "" {
+		s3err.Message = rsp.Status
+	}
+	return s3err
+}
+
+// headers of PutReader and raw headers of opts
+func putheaders(ctyp string, opts putopts) http.Header {
+	hdr := http.Header{}
+	hdr.Set("Content-Type", ctyp)
+	hdr.Set("x-amz-acl", string(s3.Private))
+	if opts.SSE {
+		hdr.Set("x-amz-server-side-encryption", string(s3.S3Managed))
+	} else if opts.SSEKMS {
+		hdr.Set("x-amz-server-side-encryption", string(s3.KMSManaged))
+		if opts.SSEKMSKeyId != "" {
+			hdr.Set("x-amz-server-side-encryption-aws-kms-key-id", opts.SSEKMSKeyId)
+		}
+	} else if opts.SSECustomerAlgorithm != "" && opts.SSECustomerKey != "" && opts.SSECustomerKeyMD5 != "" {
+		hdr.Set("x-amz-server-side-encryption-customer-algorithm", opts.SSECustomerAlgorithm)
+		hdr.Set("x-amz-server-side-encryption-customer-key", opts.SSECustomerKey)
+		hdr.Set("x-amz-server-side-encryption-customer-key-MD5", opts.SSECustomerKeyMD5)
+	}
+	for k, v := range map[string]string{
+		"Content-Encoding":                opts.ContentEncoding,
+		"Cache-Control":                   opts.CacheControl,
+		"Content-MD5":                     opts.ContentMD5,
+		"Content-Disposition":             opts.ContentDisposition,
+		"x-amz-website-redirect-location": opts.RedirectLocation,
+		"x-amz-storage-class":             string(opts.StorageClass),
+	} {
+		if v != "" {
+			hdr.Set(k, v)
+		}
+	}
+	for k, v := range opts.Meta {
+		hdr[http.CanonicalHeaderKey("x-amz-meta-"+k)] = v
+	}
+	for k, v := range opts.header {
+		hdr[k] = v
+	}
+	return hdr
+}
+
+// query string auth of v2
+func v2url(bkt *s3.Bucket, method, key string, params url.Values, hdr http.Header) string {
+	uv := url.Values{}
+	for k, v := range params {
+		uv[k] = v
+	}
+	signhdr := http.Header{}
+	for k, v := range hdr {
+		signhdr[k] = v
+	}
+	return bkt.SignedURLWithMethod(method, key, time.Now().Add(time.Hour), uv, signhdr)
+}
+
+// PUT with v4 UNSIGNED-PAYLOAD or aws-chunked body, v2 query string auth
+func putstream(bkt *s3.Bucket, key string, params url.Values, hdr http.Header, rd io.Reader, size int64) (*http.Response, error) {
+	signer := v4signer(bkt.S3)
+	var us string
+	if signer == nil {
+		us = v2url(bkt, "PUT", key, params, hdr)
+	} else {
+		u, err := objurl(bkt, key, params)
+		if err != nil {
+			return nil, err
+		}
+		us = u.String()
+	}
+	req, err := http.NewRequest("PUT", us, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req.ContentLength = size
+	body := rd
+	switch {
+	case signer == nil:
+	case payloadmode == "chunked":
+		enc := "aws-chunked"
+		if ce := req.Header.Get("Content-Encoding"); ce != "" {
+			enc += "," + ce
+		}
+		req.Header.Set("Content-Encoding", enc)
+		req.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(size, 10))
+		req.ContentLength = sigv4.ChunkedLength(size)
+		t, seed := signer.Sign(req, sigv4.StreamingPayload)
+		body = signer.ChunkedBody(rd, t, seed)
+	default:
+		signer.Sign(req, sigv4.UnsignedPayload)
+	}
+	req.Body = ioutil.NopCloser(body)
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode >= 300 {
+		defer rsp.Body.Close()
+		return nil, s3error(rsp)
+	}
+	return rsp, nil
+}
+
+func putpartstream(multi *s3.Multi, n int, rs io.ReadSeeker, size int64, hdr http.Header) (s3.Part, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return s3.Part{}, err
+	}
+	params := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {multi.UploadId}}
+	rsp, err := putstream(multi.Bucket, multi.Key, params, hdr, rs, size)
+	if err != nil {
+		return s3.Part{}, err
+	}
+	rsp.Body.Close()
+	return s3.Part{N: n, ETag: rsp.Header.Get("ETag"), Size: size}, nil
+}
+
+// request signed with v4 header
+func signedrequest(signer *sigv4.Signer, method string, u *url.URL, hdr http.Header, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	signer.Sign(req, sigv4.PayloadHash(body))
+	return req, nil
+}
@@ -0,0 +1,236 @@
+// Package sigv4 signs S3 requests with AWS Signature Version 4.
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+package sigv4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Algorithm        = "AWS4-HMAC-SHA256"
+	UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	EmptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	TimeFormat       = "20060102T150405Z"
+	// data size of each aws-chunked chunk
+	ChunkSize = 64 * 1024
+)
+
+// clock of Sign and Presign, replaced in tests
+var now = time.Now
+
+type Signer struct {
+	AccessKey string
+	SecretKey string
+	Token     string
+	Region    string
+	Service   string
+}
+
+func New(akey, skey, token, region string) *Signer {
+	return &Signer{AccessKey: akey, SecretKey: skey, Token: token, Region: region, Service: "s3"}
+}
+
+// PayloadHash is hex sha256 of body
+func PayloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// URIEncode escapes all but unreserved characters (and '/' unless encslash)
+func URIEncode(s string, encslash bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encslash) {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func CanonicalQuery(q url.Values) string {
+	keys := []string{}
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := []string{}
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			res = append(res, URIEncode(k, true)+"="+URIEncode(v, true))
+		}
+	}
+	return strings.Join(res, "&")
+}
+
+func (s *Signer) Scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.Region + "/" + s.Service + "/aws4_request"
+}
+
+func hmacsha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *Signer) key(t time.Time) []byte {
+	k := hmacsha256([]byte("AWS4"+s.SecretKey), t.Format("20060102"))
+	k = hmacsha256(k, s.Region)
+	k = hmacsha256(k, s.Service)
+	return hmacsha256(k, "aws4_request")
+}
+
+func host(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// Signature of req. headers are lowercase signed header names
+func (s *Signer) Signature(req *http.Request, t time.Time, headers []string, payload string) string {
+	sort.Strings(headers)
+	vals := map[string][]string{}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		vals[lk] = append(vals[lk], v...)
+	}
+	canon := []string{}
+	for _, h := range headers {
+		v := strings.Join(vals[h], ",")
+		if h == "host" {
+			v = host(req)
+		}
+		canon = append(canon, h+":"+strings.TrimSpace(v))
+	}
+	p := req.URL.Path
+	if p == "" {
+		p = "/"
+	}
+	creq := strings.Join([]string{
+		req.Method,
+		URIEncode(p, false),
+		CanonicalQuery(req.URL.Query()),
+		strings.Join(canon, "\n") + "\n",
+		strings.Join(headers, ";"),
+		payload,
+	}, "\n")
+	sts := strings.Join([]string{Algorithm, t.Format(TimeFormat), s.Scope(t), PayloadHash([]byte(creq))}, "\n")
+	return hex.EncodeToString(hmacsha256(s.key(t), sts))
+}
+
+// Sign sets Authorization header with all headers of req signed.
+// payload is PayloadHash of body, UnsignedPayload or StreamingPayload.
+// returns signing time and signature (seed of aws-chunked body)
+func (s *Signer) Sign(req *http.Request, payload string) (time.Time, string) {
+	t := now().UTC()
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", t.Format(TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Token)
+	}
+	req.URL.RawPath = URIEncode(req.URL.Path, false)
+	headers := []string{"host"}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); lk != "host" {
+			headers = append(headers, lk)
+		}
+	}
+	sig := s.Signature(req, t, headers, payload)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, s.AccessKey, s.Scope(t), strings.Join(headers, ";"), sig))
+	return t, sig
+}
+
+// Presign adds query string authentication to req.URL, valid for expires
+func (s *Signer) Presign(req *http.Request, expires time.Duration) {
+	t := now().UTC()
+	q := req.URL.Query()
+	q.Set("X-Amz-Algorithm", Algorithm)
+	q.Set("X-Amz-Credential", s.AccessKey+"/"+s.Scope(t))
+	q.Set("X-Amz-Date", t.Format(TimeFormat))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if s.Token != "" {
+		q.Set("X-Amz-Security-Token", s.Token)
+	}
+	req.URL.RawPath = URIEncode(req.URL.Path, false)
+	req.URL.RawQuery = CanonicalQuery(q)
+	sig := s.Signature(req, t, []string{"host"}, UnsignedPayload)
+	req.URL.RawQuery += "&X-Amz-Signature=" + sig
+}
+
+// ChunkSignature of a aws-chunked chunk following prev
+func (s *Signer) ChunkSignature(t time.Time, prev string, data []byte) string {
+	sts := strings.Join([]string{Algorithm + "-PAYLOAD", t.Format(TimeFormat), s.Scope(t), prev, EmptySHA256, PayloadHash(data)}, "\n")
+	return hex.EncodeToString(hmacsha256(s.key(t), sts))
+}
+
+func chunkheader(n int64, sig string) string {
+	return strconv.FormatInt(n, 16) + ";chunk-signature=" + sig + "\r\n"
+}
+
+// ChunkedLength is Content-Length of aws-chunked body of size
+func ChunkedLength(size int64) int64 {
+	sig := strings.Repeat("0", 64)
+	full := size / ChunkSize
+	total := full * (int64(len(chunkheader(ChunkSize, sig))) + ChunkSize + 2)
+	if rest := size % ChunkSize; rest != 0 {
+		total += int64(len(chunkheader(rest, sig))) + rest + 2
+	}
+	return total + int64(len(chunkheader(0, sig))) + 2
+}
+
+type chunkreader struct {
+	s     *Signer
+	t     time.Time
+	prev  string
+	rd    io.Reader
+	chunk []byte
+	buf   bytes.Buffer
+	done  bool
+}
+
+// ChunkedBody encodes rd as aws-chunked. t and seed are from Sign with StreamingPayload
+func (s *Signer) ChunkedBody(rd io.Reader, t time.Time, seed string) io.Reader {
+	return &chunkreader{s: s, t: t, prev: seed, rd: rd, chunk: make([]byte, ChunkSize)}
+}
+
+func (c *chunkreader) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(c.rd, c.chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			return 0, err
+		}
+		data := c.chunk[:n]
+		c.prev = c.s.ChunkSignature(c.t, c.prev, data)
+		c.buf.WriteString(chunkheader(int64(n), c.prev))
+		c.buf.Write(data)
+		c.buf.WriteString("\r\n")
+		c.done = n == 0
+	}
+	return c.buf.Read(p)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+var sseflags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "sse",
+		Usage:  "server side encryption of uploads: AES256 or aws:kms",
+		EnvVar: "S3CMD_SSE",
+	},
+	cli.StringFlag{
+		Name:  "sse-kms-key-id",
+		Usage: "kms key id of aws:kms",
+	},
+	cli.StringFlag{
+		Name:  "sse-c-key",
+		Usage: "file of customer key (SSE-C), 32 bytes raw or base64",
+	},
+	cli.StringFlag{
+		Name:  "sse-c-source-key",
+		Usage: "customer key file of reads and copy source, none for not encrypted (default: --sse-c-key)",
+	},
+}
+
+// encryption of writes, customer keys of writes and reads
+var sseopt struct {
+	mode   string
+	kmskey string
+	ckey   []byte
+	srckey []byte
+}
+
+const (
+	ssecprefix     = "x-amz-server-side-encryption-customer-"
+	copyssecprefix = "x-amz-copy-source-server-side-encryption-customer-"
+)
+
+func readkeyfile(fn string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: key must be 32 bytes", fn)
+	}
+	return key, nil
+}
+
+func ssesetup(c *cli.Context) error {
+	sseopt.mode = c.GlobalString("sse")
+	sseopt.kmskey = c.GlobalString("sse-kms-key-id")
+	sseopt.ckey, sseopt.srckey = nil, nil
+	switch sseopt.mode {
+	case "", string(s3.S3Managed), string(s3.KMSManaged):
+	default:
+		return usageerr("invalid sse: %s", sseopt.mode)
+	}
+	if sseopt.kmskey != "" && sseopt.mode != string(s3.KMSManaged) {
+		return usageerr("sse-kms-key-id needs --sse aws:kms")
+	}
+	if fn := c.GlobalString("sse-c-key"); fn != "" {
+		if sseopt.mode != "" {
+			return usageerr("sse and sse-c-key are exclusive")
+		}
+		key, err := readkeyfile(fn)
+		if err != nil {
+			return usageerr("sse-c-key: %v", err)
+		}
+		sseopt.ckey, sseopt.srckey = key, key
+	}
+	switch fn := c.GlobalString("sse-c-source-key"); fn {
+	case "":
+	case "none":
+		sseopt.srckey = nil
+	default:
+		key, err := readkeyfile(fn)
+		if err != nil {
+			return usageerr("sse-c-source-key: %v", err)
+		}
+		sseopt.srckey = key
+	}
+	return nil
+}
+
+func keymd5(key []byte) string {
+	sum := md5.Sum(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// encryption of PutObject, InitMulti and CopyObject
+func sseoptions(opts s3.Options) s3.Options {
+	switch {
+	case sseopt.ckey != nil:
+		opts.SSECustomerAlgorithm = "AES256"
+		opts.SSECustomerKey = base64.StdEncoding.EncodeToString(sseopt.ckey)
+		opts.SSECustomerKeyMD5 = keymd5(sseopt.ckey)
+	case sseopt.mode == string(s3.S3Managed):
+		opts.SSE = true
+	case sseopt.mode == string(s3.KMSManaged):
+		opts.SSEKMS = true
+		opts.SSEKMSKeyId = sseopt.kmskey
+	}
+	return opts
+}
+
+func customerheaders(hdr http.Header, prefix string, key []byte) {
+	if key == nil {
+		return
+	}
+	hdr.Set(prefix+"algorithm", "AES256")
+	hdr.Set(prefix+"key", base64.StdEncoding.EncodeToString(key))
+	hdr.Set(prefix+"key-MD5", keymd5(key))
+}
+
+// headers of GET and HEAD
+func readheaders(hdr http.Header) http.Header {
+	res := http.Header{}
+	for k, v := range hdr {
+		res[k] = v
+	}
+	customerheaders(res, ssecprefix, sseopt.srckey)
+	return res
+}
+
+// UploadPart with SSE-C
+func putpart(multi *s3.Multi, n int, rs io.ReadSeeker, size int64) (s3.Part, error) {
+	hdr := http.Header{}
+	customerheaders(hdr, ssecprefix, sseopt.ckey)
+	if streaming(multi.Bucket.S3) {
+		return putpartstream(multi, n, rs, size, hdr)
+	}
+	if len(hdr) == 0 {
+		return multi.PutPart(n, rs)
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return s3.Part{}, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(rs, size))
+	if err != nil {
+		return s3.Part{}, err
+	}
+	params := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {multi.UploadId}}
+	rsp, err := s3do(multi.Bucket, "PUT", multi.Key, params, hdr, body)
+	if err != nil {
+		return s3.Part{}, err
+	}
+	rsp.Body.Close()
+	return s3.Part{N: n, ETag: rsp.Header.Get("ETag"), Size: size}, nil
+}
+
+// CopyObject. goamz can not send customer key and version of copy source
+func copyobject(bkt *s3.Bucket, key string, opts s3.CopyOptions, source, vid string) (*s3.CopyObjectResult, error) {
+	opts.Options = sseoptions(opts.Options)
+	if sseopt.ckey == nil && sseopt.srckey == nil && vid == "" {
+		return bkt.PutCopy(key, s3.Private, opts, source)
+	}
+	hdr := putheaders(opts.ContentType, putopts{Options: opts.Options})
+	if opts.ContentType == "" {
+		hdr.Del("Content-Type")
+	}
+	if opts.MetadataDirective != "" {
+		hdr.Set("x-amz-metadata-directive", opts.MetadataDirective)
+	}
+	res := &s3.CopyObjectResult{}
+	return res, copyraw(bkt, key, nil, hdr, source, vid, res)
+}
+
+// UploadPartCopy, customer keys of source and upload
+func copypart(multi *s3.Multi, n int, opts s3.CopyOptions, source, vid string) (s3.Part, error) {
+	if sseopt.ckey == nil && sseopt.srckey == nil && vid == "" {
+		_, part, err := multi.PutPartCopy(n, opts, source)
+		return part, err
+	}
+	hdr := http.Header{}
+	customerheaders(hdr, ssecprefix, sseopt.ckey)
+	if opts.CopySourceOptions != "" {
+		hdr.Set("x-amz-copy-source-range", opts.CopySourceOptions)
+	}
+	params := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {multi.UploadId}}
+	res := &s3.CopyObjectResult{}
+	if err := copyraw(multi.Bucket, multi.Key, params, hdr, source, vid, res); err != nil {
+		return s3.Part{}, err
+	}
+	return s3.Part{N: n, ETag: res.ETag}, nil
+}
+
+func copyraw(bkt *s3.Bucket, key string, params url.Values, hdr http.Header, source, vid string, res *s3.CopyObjectResult) error {
+	hdr.Set("x-amz-copy-source", copysource(source, vid))
+	customerheaders(hdr, copyssecprefix, sseopt.srckey)
+	rsp, err := s3do(bkt, "PUT", key, params, hdr, nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	// copy may fail after 200 OK
+	if bytes.Contains(body, []byte("<Error>")) {
+		return s3error(&http.Response{StatusCode: http.StatusInternalServerError, Status: rsp.Status,
+			Body: ioutil.NopCloser(bytes.NewReader(body))})
+	}
+	return xml.Unmarshal(body, res)
+}
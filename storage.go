@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// object attributes common to all backends
+type objinfo struct {
+	key     string
+	size    int64
+	etag    string
+	lastmod time.Time
+	header  http.Header
+}
+
+// storage backend. keys are backend specific (s3 key, local path)
+type storage interface {
+	url(key string) string
+	join(dir, rel string) string
+	// all objects under dir. rel is slash separated
+	walk(dir string, fn func(rel string, info objinfo) error) error
+	stat(key string) (objinfo, error)
+	// length < 0: to the end
+	open(key string, offset, length int64) (io.ReadCloser, error)
+	write(key string, rd io.Reader, size int64, ctyp string, opts putopts) error
+	// server side copy. errcross if src is not in same storage
+	copy(dstkey string, src storage, srckey string, size, partsz int64) error
+	remove(keys []string) error
+	// size of the whole object
+	initmulti(key, ctyp string, size int64, opts putopts) (multiupload, error)
+}
+
+type multiupload interface {
+	put(n int, offset int64, rd io.Reader, size int64) error
+	copy(n int, offset int64, src storage, srckey string, size int64) error
+	complete() error
+	abort() error
+}
+
+var errcross = errors.New("copy across storages")
+
+// s3://bucket/key, file:///path or local path
+func openstorage(us string) (storage, string, error) {
+	u, err := url.Parse(us)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// local path (or windows drive letter)
+		return &filestorage{}, us, nil
+	}
+	switch u.Scheme {
+	case "s3", "dag":
+		bkt, key, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return nil, "", err
+		}
+		return s3store(bkt), key, nil
+	case "file":
+		return &filestorage{}, filepath.FromSlash(u.Path), nil
+	}
+	return nil, "", fmt.Errorf("unsupported scheme: %s", u.Scheme)
+}
+
+func listentries(st storage, dir string) (map[string]entry, error) {
+	rst := map[string]entry{}
+	err := st.walk(dir, func(rel string, info objinfo) error {
+		if pathflt.match(rel) {
+			rst[rel] = entry{size: info.size, cksum: info.etag, lastmod: info.lastmod, st: st, key: info.key}
+		}
+		return nil
+	})
+	return rst, err
+}
+
+// objects under dir, or dir itself if it is an object
+func expand(st storage, dir string) ([]objinfo, error) {
+	res := []objinfo{}
+	err := st.walk(dir, func(rel string, info objinfo) error {
+		if pathflt.match(rel) {
+			res = append(res, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		info, err := st.stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].key < res[j].key })
+	return res, nil
+}
+
+func storagemd5(st storage, key string) string {
+	if _, ok := st.(*filestorage); ok {
+		sum, err := filemd5(key)
+		if err != nil {
+			log.Println("md5", key, err)
+		}
+		return sum
+	}
+	info, err := st.stat(key)
+	if err != nil {
+		log.Println("stat", st.url(key), err)
+		return ""
+	}
+	if sum := info.header.Get("x-amz-meta-" + metamd5); sum != "" {
+		return sum
+	}
+	if etagparts(info.etag) == 0 {
+		return info.etag
+	}
+	return ""
+}
+
+// seekable reader for retry. buffer in memory if needed
+func seekable(rd io.Reader) (io.ReadSeeker, error) {
+	if rs, ok := rd.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf), nil
+}
+
+// part size of streaming copy from remote source
+const streampartsize = 64 * 1024 * 1024
+
+// parts in a multipart upload
+const maxparts = 10000
+
+// copy object from src to dst. multipart when larger than opt.Split
+func transfer(dst storage, dstkey string, src storage, srckey string, size int64, opt SyncOption) error {
+	partsz := opt.Split
+	if partsz <= 0 && size > maxcopysize {
+		partsz = 1024 * mib
+	}
+	if err := dst.copy(dstkey, src, srckey, size, partsz); err != errcross {
+		return err
+	}
+	info, err := src.stat(srckey)
+	if err != nil {
+		return err
+	}
+	dst, src, raw := cipherstorages(dst, src, info)
+	if raw {
+		size = cipherlen(info.size)
+	}
+	if _, local := src.(*filestorage); !local && opt.Split <= 0 && size > streampartsize {
+		// parts of remote source are buffered in memory
+		partsz = streampartsize
+	}
+	rd, err := src.open(srckey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	ctyp, opts := headeroptions(sourceheaders(info.header, raw), "", putopts{})
+	if ctyp == "" {
+		rs, _ := rd.(io.ReadSeeker)
+		ctyp = opt.Mime.typeof(srckey, rs)
+	}
+	_, encrypt := dst.(*cryptstorage)
+	multi := partsz > 0 && size > partsz
+	// etag of encrypted object is not md5 of content
+	if !raw && (opt.StoreMD5 && multi || encrypt) {
+		if sum := storagemd5(src, srckey); sum != "" {
+			opts.Meta = copymeta(opts.Meta)
+			opts.Meta[metamd5] = []string{sum}
+		}
+	}
+	ctyp, opts = uploadoptions(srckey, ctyp, opts)
+	if multi {
+		return multitransfer(dst, dstkey, src, srckey, size, partsz, opt.SplitParallel, ctyp, opts)
+	}
+	return dst.write(dstkey, rd, size, ctyp, opts)
+}
+
+// headers and user metadata kept by streaming copy, like server side copy.
+// storage class, encryption and content digests are of the destination,
+// unless content is copied as is (raw)
+func sourceheaders(hdr http.Header, raw bool) http.Header {
+	res := pickheaders(hdr)
+	for k := range res {
+		if k == "X-Amz-Storage-Class" || strings.HasPrefix(k, "X-Amz-Server-Side-Encryption") || !raw && keptmeta(k) {
+			delete(res, k)
+		}
+	}
+	return res
+}
+
+// parallel ranged read and part write
+func multitransfer(dst storage, dstkey string, src storage, srckey string, size, partsz int64, parallel int, ctyp string, opts putopts) error {
+	if partsz < minpartsize {
+		partsz = minpartsize
+	}
+	for (size+partsz-1)/partsz > maxparts {
+		partsz *= 2
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	mu, err := dst.initmulti(dstkey, ctyp, size, opts)
+	if err != nil {
+		return err
+	}
+	type part struct {
+		n      int
+		offset int64
+	}
+	parts := make(chan part)
+	// closed on first error, remaining parts are skipped
+	failed := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var lasterr error
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+				length := partsz
+				if p.offset+length > size {
+					length = size - p.offset
+				}
+				err := transferpart(mu, p.n, p.offset, src, srckey, length)
+				if err != nil {
+					log.Println("part", p.n, src.url(srckey), err)
+					mtx.Lock()
+					lasterr = err
+					mtx.Unlock()
+					once.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
+	n := 0
+send:
+	for offset := int64(0); offset < size || n == 0; offset += partsz {
+		n += 1
+		select {
+		case parts <- part{n, offset}:
+		case <-failed:
+			break send
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if lasterr == nil {
+		lasterr = mu.complete()
+	}
+	if lasterr != nil {
+		if aerr := mu.abort(); aerr != nil {
+			log.Println("abort multi failed", aerr)
+		}
+	}
+	return lasterr
+}
+
+func transferpart(mu multiupload, n int, offset int64, src storage, srckey string, length int64) error {
+	rd, err := src.open(srckey, offset, length)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return mu.put(n, offset, rd, length)
+}
+
+// tar entry name: url without scheme
+func storagename(st storage, key string) string {
+	u := st.url(key)
+	if idx := strings.Index(u, "://"); idx != -1 {
+		u = u[idx+3:]
+	}
+	return strings.TrimPrefix(filepath.ToSlash(u), "/")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// local filesystem. key is os path
+type filestorage struct{}
+
+func (st *filestorage) url(key string) string {
+	return key
+}
+
+func (st *filestorage) join(dir, rel string) string {
+	return filepath.Join(dir, filepath.FromSlash(rel))
+}
+
+func (st *filestorage) walk(dir string, fn func(rel string, info objinfo) error) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	dir = filepath.Clean(dir)
+	return filepath.Walk(dir, func(pathname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(pathname, dir), string(filepath.Separator))
+		return fn(filepath.ToSlash(rel), objinfo{key: pathname, size: info.Size(), lastmod: info.ModTime()})
+	})
+}
+
+func (st *filestorage) stat(key string) (objinfo, error) {
+	fi, err := os.Stat(key)
+	if err != nil {
+		return objinfo{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return objinfo{}, fmt.Errorf("not a regular file: %s", key)
+	}
+	return objinfo{key: key, size: fi.Size(), lastmod: fi.ModTime()}, nil
+}
+
+type sectionfile struct {
+	*io.SectionReader
+	fp *os.File
+}
+
+func (s sectionfile) Close() error {
+	return s.fp.Close()
+}
+
+func (st *filestorage) open(key string, offset, length int64) (io.ReadCloser, error) {
+	fp, err := os.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 && length < 0 {
+		return fp, nil
+	}
+	if length < 0 {
+		fi, err := fp.Stat()
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		length = fi.Size() - offset
+	}
+	return sectionfile{io.NewSectionReader(fp, offset, length), fp}, nil
+}
+
+func createfile(key string) (*os.File, error) {
+	fp, err := os.Create(key)
+	if err != nil {
+		if err := os.MkdirAll(filepath.Dir(key), 0777); err != nil {
+			return nil, err
+		}
+		fp, err = os.Create(key)
+	}
+	return fp, err
+}
+
+func (st *filestorage) write(key string, rd io.Reader, size int64, ctyp string, opts putopts) error {
+	fp, err := createfile(key)
+	if err != nil {
+		return err
+	}
+	ncp, err := io.Copy(fp, rd)
+	if err == nil && size >= 0 && ncp != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (st *filestorage) copy(dstkey string, src storage, srckey string, size, partsz int64) error {
+	if _, ok := src.(*filestorage); !ok {
+		return errcross
+	}
+	rd, err := src.open(srckey, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return st.write(dstkey, rd, size, "", putopts{})
+}
+
+func (st *filestorage) remove(keys []string) error {
+	var lasterr error
+	for _, k := range keys {
+		if err := os.Remove(k); err != nil {
+			log.Println("remove", k, err)
+			lasterr = err
+		}
+	}
+	return lasterr
+}
+
+// parts are written at its offset
+type filemulti struct {
+	key string
+	fp  *os.File
+}
+
+func (st *filestorage) initmulti(key, ctyp string, size int64, opts putopts) (multiupload, error) {
+	fp, err := createfile(key)
+	if err != nil {
+		return nil, err
+	}
+	return &filemulti{key: key, fp: fp}, nil
+}
+
+func (m *filemulti) put(n int, offset int64, rd io.Reader, size int64) error {
+	ncp, err := io.Copy(io.NewOffsetWriter(m.fp, offset), rd)
+	if err == nil && ncp != size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (m *filemulti) copy(n int, offset int64, src storage, srckey string, size int64) error {
+	return errcross
+}
+
+func (m *filemulti) complete() error {
+	return m.fp.Close()
+}
+
+func (m *filemulti) abort() error {
+	m.fp.Close()
+	return os.Remove(m.key)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+)
+
+type s3storage struct {
+	bkt *s3.Bucket
+	// version of reads and copy source, current version if empty
+	vid string
+}
+
+func (st *s3storage) url(key string) string {
+	return fmt.Sprintf("s3://%s/%s", st.bkt.Name, key)
+}
+
+func (st *s3storage) join(dir, rel string) string {
+	if dir == "" {
+		return rel
+	}
+	if rel == "" {
+		return dir
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + rel
+}
+
+func (st *s3storage) walk(dir string, fn func(rel string, info objinfo) error) error {
+	prefix := strings.TrimSuffix(dir, "/")
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+	var marker string
+	for {
+		rsp, err := listpage(st.bkt, prefix, "", marker)
+		if err != nil {
+			return err
+		}
+		for _, k := range rsp.Contents {
+			rel := strings.TrimPrefix(k.Key, prefix)
+			if (strings.HasSuffix(rel, "_$folder$") || strings.HasSuffix(rel, "/")) && k.Size == 0 {
+				continue
+			}
+			lm, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", k.LastModified)
+			info := objinfo{key: k.Key, size: k.Size, etag: strings.Trim(k.ETag, "\""), lastmod: lm}
+			if err := fn(rel, info); err != nil {
+				return err
+			}
+		}
+		marker = rsp.NextMarker
+		if !rsp.IsTruncated {
+			return nil
+		}
+	}
+}
+
+func (st *s3storage) stat(key string) (objinfo, error) {
+	rsp, err := headversion(st.bkt, key, st.vid)
+	if err != nil {
+		return objinfo{}, err
+	}
+	lm, _ := time.Parse(http.TimeFormat, rsp.Header.Get("Last-Modified"))
+	return objinfo{key: key, size: rsp.ContentLength, etag: strings.Trim(rsp.Header.Get("ETag"), "\""),
+		lastmod: lm, header: rsp.Header}, nil
+}
+
+// ranged GET, reconnect from current offset on error
+type s3reader struct {
+	bkt    *s3.Bucket
+	key    string
+	vid    string
+	offset int64
+	end    int64
+	body   io.ReadCloser
+	tries  int
+}
+
+func (r *s3reader) connect() error {
+	hdr := http.Header{}
+	if r.end >= 0 {
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.end-1))
+	} else if r.offset != 0 {
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	}
+	rsp, err := getresponse(r.bkt, r.key, r.vid, hdr)
+	if err != nil {
+		return err
+	}
+	if r.end < 0 && rsp.ContentLength >= 0 {
+		r.end = r.offset + rsp.ContentLength
+	}
+	r.body = rsp.Body
+	return nil
+}
+
+func (r *s3reader) Read(p []byte) (int, error) {
+	for {
+		if r.end >= 0 && r.offset >= r.end {
+			return 0, io.EOF
+		}
+		if r.body == nil {
+			if err := r.connect(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF && r.end >= 0 && r.offset < r.end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			// recovered, each error has all attempts
+			r.tries = 0
+		}
+		if err == nil || err == io.EOF || !retryable(err) || r.tries+1 >= retrypol.attempts {
+			return n, err
+		}
+		r.body.Close()
+		r.body = nil
+		wait := retrypol.backoff(r.tries)
+		r.tries += 1
+		log.Println("retry get", r.bkt.Name, r.key, "offset", r.offset, "after", wait, err)
+		time.Sleep(wait)
+		if n != 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *s3reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+func (st *s3storage) open(key string, offset, length int64) (io.ReadCloser, error) {
+	r := &s3reader{bkt: st.bkt, key: key, vid: st.vid, offset: offset, end: -1}
+	if length >= 0 {
+		r.end = offset + length
+	}
+	// connect on first read
+	return r, nil
+}
+
+func (st *s3storage) write(key string, rd io.Reader, size int64, ctyp string, opts putopts) error {
+	if rs, ok := rd.(io.ReadSeeker); ok {
+		return putreader(st.bkt, key, rs, size, ctyp, opts)
+	}
+	// not seekable, no retry
+	opts.Options = sseoptions(opts.Options)
+	if streaming(st.bkt.S3) || len(opts.header) != 0 {
+		rsp, err := putstream(st.bkt, key, nil, putheaders(ctyp, opts), rd, size)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+	return st.bkt.PutReader(key, rd, size, ctyp, s3.Private, opts.Options)
+}
+
+func (st *s3storage) copy(dstkey string, src storage, srckey string, size, partsz int64) error {
+	ss, ok := src.(*s3storage)
+	if !ok || !sameendpoint(ss.bkt.S3, st.bkt.S3) {
+		return errcross
+	}
+	if partsz <= 0 {
+		partsz = maxcopysize
+	}
+	_, err := copyobj(st.bkt, dstkey, ss.bkt, srckey, ss.vid, size, partsz)
+	if err != nil && ss.bkt.S3 != st.bkt.S3 && (autherror(err) || notfound(err)) {
+		// destination credentials cannot read source
+		log.Println("server side copy failed, stream", ss.url(srckey), err)
+		return errcross
+	}
+	return err
+}
+
+// server side copy is possible only on the same endpoint
+func sameendpoint(a, b *s3.S3) bool {
+	return a == b || (a.S3Endpoint == b.S3Endpoint && a.S3BucketEndpoint == b.S3BucketEndpoint)
+}
+
+func (st *s3storage) remove(keys []string) error {
+	objs := []s3.Object{}
+	for _, k := range keys {
+		objs = append(objs, s3.Object{Key: k})
+	}
+	errs := delmulti(st.bkt, objs)
+	var lasterr error
+	for _, k := range keys {
+		if err := errs[k]; err != nil {
+			log.Println("delete", st.url(k), err)
+			lasterr = err
+		}
+	}
+	return lasterr
+}
+
+type s3multi struct {
+	st    *s3storage
+	multi *s3.Multi
+	mu    sync.Mutex
+	parts []s3.Part
+}
+
+func (st *s3storage) initmulti(key, ctyp string, size int64, opts putopts) (multiupload, error) {
+	multi, err := initmultipart(st.bkt, key, ctyp, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &s3multi{st: st, multi: multi}, nil
+}
+
+func (m *s3multi) add(part s3.Part) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parts = append(m.parts, part)
+}
+
+func (m *s3multi) put(n int, offset int64, rd io.Reader, size int64) error {
+	rs, err := seekable(rd)
+	if err != nil {
+		return err
+	}
+	var part s3.Part
+	err = retry(fmt.Sprintf("put part %s n=%d", m.st.url(m.multi.Key), n), func() (err error) {
+		part, err = putpart(m.multi, n, rs, size)
+		return
+	})
+	if err == nil {
+		m.add(part)
+	}
+	return err
+}
+
+func (m *s3multi) copy(n int, offset int64, src storage, srckey string, size int64) error {
+	ss, ok := src.(*s3storage)
+	if !ok || !sameendpoint(ss.bkt.S3, m.st.bkt.S3) {
+		return errcross
+	}
+	var part s3.Part
+	err := retry(fmt.Sprintf("copy part %s n=%d", ss.url(srckey), n), func() (err error) {
+		part, err = copypart(m.multi, n, s3.CopyOptions{}, path.Join(ss.bkt.Name, srckey), ss.vid)
+		return
+	})
+	if err != nil && ss.bkt.S3 != m.st.bkt.S3 && (autherror(err) || notfound(err)) {
+		log.Println("server side part copy failed, stream", ss.url(srckey), err)
+		return errcross
+	}
+	if err == nil {
+		m.add(part)
+	}
+	return err
+}
+
+func (m *s3multi) complete() error {
+	m.mu.Lock()
+	parts := append([]s3.Part{}, m.parts...)
+	m.mu.Unlock()
+	sort.Slice(parts, func(i, j int) bool { return parts[i].N < parts[j].N })
+	return retry("complete "+m.st.url(m.multi.Key), func() error {
+		return m.multi.Complete(parts)
+	})
+}
+
+func (m *s3multi) abort() error {
+	return authed(m.multi.Abort)
+}
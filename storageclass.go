@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+var storageclasses = []string{
+	"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING",
+	"GLACIER", "GLACIER_IR", "DEEP_ARCHIVE", "OUTPOSTS", "EXPRESS_ONEZONE",
+}
+
+var classflags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "storage-class",
+		Usage: "storage class of uploads and copies: " + strings.Join(storageclasses, ", "),
+	},
+}
+
+// storage class of writes, default of bucket if empty
+var classopt s3.StorageClass
+
+func classsetup(c *cli.Context) error {
+	classopt = ""
+	sc := strings.ToUpper(c.String("storage-class"))
+	if sc == "" {
+		return nil
+	}
+	for _, v := range storageclasses {
+		if v == sc {
+			classopt = s3.StorageClass(sc)
+			return nil
+		}
+	}
+	return usageerr("invalid storage class %s, choose from %s", sc, strings.Join(storageclasses, ","))
+}
+
+// listing omits class of STANDARD
+func keyclass(k s3.Key) string {
+	if k.StorageClass == "" {
+		return string(s3.StandardStorage)
+	}
+	return k.StorageClass
+}
+
+// copy of archived object fails with InvalidObjectState until restored
+func checkrestored(bkt *s3.Bucket, key string) error {
+	rsp, err := headobj(bkt, key)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	switch st, _ := restorestate(rsp.Header); st {
+	case "archived":
+		return fmt.Errorf("%s object is not restored, run restore first", rsp.Header.Get("x-amz-storage-class"))
+	case "restoring":
+		return fmt.Errorf("%s object is being restored, retry after restore finishes", rsp.Header.Get("x-amz-storage-class"))
+	}
+	return nil
+}
+
+// 30d or time.ParseDuration
+func parseage(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid age: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// filter of transition
+type keyfilter struct {
+	older, newer     time.Duration
+	minsize, maxsize int64
+}
+
+func (f keyfilter) match(k s3.Key, now time.Time) bool {
+	lm, err := time.Parse("2006-01-02T15:04:05.000Z07:00", k.LastModified)
+	if err != nil {
+		log.Println("last modified", k.Key, k.LastModified, err)
+		return false
+	}
+	switch {
+	case f.older > 0 && now.Sub(lm) < f.older:
+	case f.newer > 0 && now.Sub(lm) >= f.newer:
+	case k.Size < f.minsize:
+	case f.maxsize > 0 && k.Size > f.maxsize:
+	default:
+		return true
+	}
+	return false
+}
+
+func transition(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if classopt == "" {
+		return usageerr("transition needs --storage-class")
+	}
+	if len(c.Args()) == 0 {
+		return usageerr("transition needs url")
+	}
+	flt := keyfilter{minsize: c.Int64("min-size"), maxsize: c.Int64("max-size")}
+	var err error
+	if s := c.String("older-than"); s != "" {
+		if flt.older, err = parseage(s); err != nil {
+			return usageerr("older-than: %v", err)
+		}
+	}
+	if s := c.String("newer-than"); s != "" {
+		if flt.newer, err = parseage(s); err != nil {
+			return usageerr("newer-than: %v", err)
+		}
+	}
+	partsz := int64(c.Int("split"))
+	if partsz < minpartsize {
+		partsz = minpartsize
+	}
+	now := time.Now()
+	fail := newfailures()
+	var count, total int64
+	for _, us := range c.Args() {
+		bkt, prefix, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		var marker string
+		for {
+			rsp, err := listpage(bkt, prefix, "", marker)
+			if err != nil {
+				fail.add(us, err)
+				break
+			}
+			for _, k := range rsp.Contents {
+				rel := strings.TrimPrefix(k.Key, prefix)
+				if strings.HasSuffix(k.Key, "/") && k.Size == 0 || !pathflt.match(rel) {
+					continue
+				}
+				if keyclass(k) == string(classopt) || !flt.match(k, now) {
+					continue
+				}
+				if archiveclass(keyclass(k)) {
+					if err := checkrestored(bkt, k.Key); err != nil {
+						fail.add("s3://"+bkt.Name+"/"+k.Key, err)
+						continue
+					}
+				}
+				fmt.Printf("transition s3://%s/%s %s => %s %d\n", bkt.Name, k.Key, keyclass(k), classopt, k.Size)
+				count += 1
+				total += k.Size
+				if !c.Bool("dry-run") {
+					fail.add("s3://"+bkt.Name+"/"+k.Key, rewritemeta(bkt, k.Key, false, nil, partsz, false))
+				}
+			}
+			marker = rsp.NextMarker
+			if !rsp.IsTruncated {
+				break
+			}
+		}
+	}
+	log.Println("transition", count, "objects", total, "bytes")
+	return fail.result("transition")
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/urfave/cli"
+)
+
+var versionflags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "version-id",
+		Usage: "version of the source object",
+	},
+}
+
+// --version-id of command source, current version if empty
+var srcversion string
+
+func versionsetup(c *cli.Context) {
+	srcversion = c.String("version-id")
+}
+
+func versionparams(vid string) url.Values {
+	if vid == "" {
+		return nil
+	}
+	return url.Values{"versionId": {vid}}
+}
+
+// GET of version vid, without retry
+func getobject(bkt *s3.Bucket, key, vid string, hdr http.Header) (*http.Response, error) {
+	if vid == "" {
+		return bkt.GetResponseWithHeaders(key, hdr)
+	}
+	return s3do(bkt, "GET", key, versionparams(vid), hdr, nil)
+}
+
+func headobject(bkt *s3.Bucket, key, vid string, hdr http.Header) (*http.Response, error) {
+	if vid == "" {
+		return bkt.Head(key, hdr)
+	}
+	return s3do(bkt, "HEAD", key, versionparams(vid), hdr, nil)
+}
+
+// storage reading version vid of objects. local files have no versions
+func versionstore(st storage, vid string) storage {
+	switch s := st.(type) {
+	case *s3storage:
+		return &s3storage{bkt: s.bkt, vid: vid}
+	case *cryptstorage:
+		return &cryptstorage{versionstore(s.storage, vid)}
+	}
+	return st
+}
+
+// x-amz-copy-source of version vid
+func copysource(source, vid string) string {
+	src := (&url.URL{Path: source}).EscapedPath()
+	if vid != "" {
+		src += "?versionId=" + url.QueryEscape(vid)
+	}
+	return src
+}
+
+// --version-id selects one object
+func checkversion(c *cli.Context, nargs int) error {
+	if srcversion != "" && (len(c.Args()) != nargs || c.Bool("recursive")) {
+		return usageerr("version-id needs single object")
+	}
+	return nil
+}
+
+// entry of ListObjectVersions, Version or DeleteMarker
+type objversion struct {
+	XMLName      xml.Name
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+func (v objversion) deletemarker() bool {
+	return v.XMLName.Local == "DeleteMarker"
+}
+
+type versionsresp struct {
+	Name                string
+	Prefix              string
+	KeyMarker           string
+	VersionIdMarker     string
+	NextKeyMarker       string
+	NextVersionIdMarker string
+	MaxKeys             int
+	Delimiter           string
+	IsTruncated         bool
+	CommonPrefixes      []string `xml:"CommonPrefixes>Prefix"`
+	// Version and DeleteMarker in listing order
+	Entries []objversion `xml:",any"`
+}
+
+// goamz Versions has no delete markers and next markers
+func listversions(bkt *s3.Bucket, prefix, delim, keymarker, vermarker string) (*versionsresp, error) {
+	params := url.Values{"versions": {""}, "prefix": {prefix}, "max-keys": {"1000"}}
+	if delim != "" {
+		params.Set("delimiter", delim)
+	}
+	if keymarker != "" {
+		params.Set("key-marker", keymarker)
+	}
+	if vermarker != "" {
+		params.Set("version-id-marker", vermarker)
+	}
+	rsp, err := s3raw(bkt, "GET", "", params, http.Header{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	res := &versionsresp{}
+	if err := xml.NewDecoder(rsp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	entries := []objversion{}
+	for _, v := range res.Entries {
+		if v.XMLName.Local == "Version" || v.deletemarker() {
+			entries = append(entries, v)
+		}
+	}
+	res.Entries = entries
+	return res, nil
+}
+
+// all versions under prefix, newest first for each key
+func walkversions(bkt *s3.Bucket, prefix string, fn func(v objversion) error) error {
+	var keymarker, vermarker string
+	for {
+		rsp, err := listversions(bkt, prefix, "", keymarker, vermarker)
+		if err != nil {
+			return err
+		}
+		for _, v := range rsp.Entries {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		if !rsp.IsTruncated {
+			return nil
+		}
+		keymarker, vermarker = rsp.NextKeyMarker, rsp.NextVersionIdMarker
+	}
+}
+
+func delversion(bkt *s3.Bucket, key, vid string) error {
+	rsp, err := s3raw(bkt, "DELETE", key, versionparams(vid), http.Header{}, nil)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func versionrecord(bkt *s3.Bucket, v objversion) record {
+	return record{Bucket: bkt.Name, Key: v.Key, Size: v.Size, ETag: strings.Trim(v.ETag, "\""),
+		LastModified: v.LastModified, StorageClass: v.StorageClass, VersionId: v.VersionId,
+		IsLatest: v.IsLatest, DeleteMarker: v.deletemarker()}
+}
+
+func lsversion(bkt *s3.Bucket, v objversion) {
+	size := strconv.FormatInt(v.Size, 10)
+	if v.deletemarker() {
+		size = "DELETED"
+	}
+	latest := ""
+	if v.IsLatest {
+		latest = "latest"
+	}
+	fmt.Printf("%v %10s  %-32s %-6s s3://%s/%s\n", v.LastModified, size, v.VersionId, latest, bkt.Name, v.Key)
+}
+
+// ls --versions
+func lsversions(bkt *s3.Bucket, prefix, delim string, out *output) error {
+	var keymarker, vermarker string
+	for {
+		rsp, err := listversions(bkt, prefix, delim, keymarker, vermarker)
+		if err != nil {
+			return err
+		}
+		for _, k := range rsp.CommonPrefixes {
+			out.emit(prefixrecord(bkt, k), func() { lsshowd(bkt, k, false) })
+		}
+		for _, v := range rsp.Entries {
+			if !pathflt.match(strings.TrimPrefix(v.Key, prefix)) {
+				continue
+			}
+			out.emit(versionrecord(bkt, v), func() { lsversion(bkt, v) })
+		}
+		if !rsp.IsTruncated {
+			return nil
+		}
+		keymarker, vermarker = rsp.NextKeyMarker, rsp.NextVersionIdMarker
+	}
+}
+
+// Enabled, Suspended or empty if never enabled
+func getversioning(bkt *s3.Bucket) (string, error) {
+	rsp, err := s3raw(bkt, "GET", "", url.Values{"versioning": {""}}, http.Header{}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	var res struct {
+		Status string
+	}
+	if err := xml.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.Status, nil
+}
+
+func putversioning(bkt *s3.Bucket, status string) error {
+	body := fmt.Sprintf(`<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Status>%s</Status></VersioningConfiguration>`, status)
+	rsp, err := s3raw(bkt, "PUT", "", url.Values{"versioning": {""}}, http.Header{}, []byte(body))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func versioning(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	args := c.Args()
+	if len(args) < 2 {
+		return usageerr("versioning needs enable|suspend|status and bucket")
+	}
+	action := args[0]
+	switch action {
+	case "enable", "suspend", "status":
+	default:
+		return usageerr("invalid action: %s", action)
+	}
+	fail := newfailures()
+	for _, us := range args[1:] {
+		bkt, _, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		switch action {
+		case "enable":
+			err = putversioning(bkt, "Enabled")
+		case "suspend":
+			err = putversioning(bkt, "Suspended")
+		}
+		if err != nil {
+			fail.add(us, err)
+			continue
+		}
+		st, err := getversioning(bkt)
+		if err == nil {
+			if st == "" {
+				st = "Disabled"
+			}
+			fmt.Printf("s3://%s %s\n", bkt.Name, st)
+		}
+		fail.add(us, err)
+	}
+	return fail.result("versioning")
+}
+
+// remove latest delete marker of key, or keys under prefix with -R
+func undelete(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if len(c.Args()) == 0 {
+		return usageerr("undelete needs url")
+	}
+	fail := newfailures()
+	for _, us := range c.Args() {
+		bkt, prefix, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		markers := []objversion{}
+		err = walkversions(bkt, prefix, func(v objversion) error {
+			if !v.IsLatest || !v.deletemarker() {
+				return nil
+			}
+			if c.Bool("recursive") && pathflt.match(strings.TrimPrefix(v.Key, prefix)) || v.Key == prefix {
+				markers = append(markers, v)
+			}
+			return nil
+		})
+		if err != nil {
+			fail.add(us, err)
+			continue
+		}
+		if len(markers) == 0 && !c.Bool("recursive") {
+			fail.add(us, fmt.Errorf("no delete marker"))
+			continue
+		}
+		for _, v := range markers {
+			ku := "s3://" + bkt.Name + "/" + v.Key
+			fmt.Printf("undelete %s %s\n", ku, v.VersionId)
+			if c.Bool("dry-run") {
+				continue
+			}
+			err := delversion(bkt, v.Key, v.VersionId)
+			log.Println("delete marker", ku, v.VersionId, err)
+			fail.add(ku, err)
+		}
+	}
+	return fail.result("undelete")
+}
+
+// server side copy of version vid onto key
+func copyversion(bkt *s3.Bucket, key, vid string, size, partsz int64) error {
+	_, err := copyobj(bkt, key, bkt, key, vid, size, partsz)
+	return err
+}
+
+// RFC3339, date and time, date, or age before now (30d, 12h)
+func parsetime(s string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	d, err := parseage(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", s)
+	}
+	return now.Add(-d), nil
+}
+
+// current and newest version at the time of a key
+type rollbackentry struct {
+	key     string
+	current *objversion
+	target  *objversion
+}
+
+// make keys under prefix as they were at the time
+func rollback(c *cli.Context) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	if len(c.Args()) == 0 {
+		return usageerr("rollback needs url")
+	}
+	if c.String("at") == "" {
+		return usageerr("rollback needs --at")
+	}
+	at, err := parsetime(c.String("at"), time.Now())
+	if err != nil {
+		return usageerr("at: %v", err)
+	}
+	partsz := int64(c.Int("split"))
+	if partsz < minpartsize {
+		partsz = minpartsize
+	}
+	log.Println("rollback to", at.UTC().Format(time.RFC3339))
+	fail := newfailures()
+	for _, us := range c.Args() {
+		bkt, prefix, err := url2bktpath(s3cl, us)
+		if err != nil {
+			return usageerr("invalid url: %s %v", us, err)
+		}
+		ents := []*rollbackentry{}
+		err = walkversions(bkt, prefix, func(v objversion) error {
+			if !pathflt.match(strings.TrimPrefix(v.Key, prefix)) {
+				return nil
+			}
+			if len(ents) == 0 || ents[len(ents)-1].key != v.Key {
+				ents = append(ents, &rollbackentry{key: v.Key})
+			}
+			ent := ents[len(ents)-1]
+			if v.IsLatest {
+				ent.current = &v
+			}
+			lm, err := time.Parse("2006-01-02T15:04:05.000Z07:00", v.LastModified)
+			if err != nil {
+				return fmt.Errorf("last modified of %s: %v", v.Key, err)
+			}
+			// newest first
+			if ent.target == nil && !lm.After(at) {
+				ent.target = &v
+			}
+			return nil
+		})
+		if err != nil {
+			fail.add(us, err)
+			continue
+		}
+		for _, ent := range ents {
+			ku := "s3://" + bkt.Name + "/" + ent.key
+			live := ent.current != nil && !ent.current.deletemarker()
+			switch {
+			case ent.target == nil || ent.target.deletemarker():
+				if !live {
+					continue
+				}
+				fmt.Printf("delete %s\n", ku)
+				if !c.Bool("dry-run") {
+					fail.add(ku, delobj(bkt, ent.key))
+				}
+			case live && (ent.current.VersionId == ent.target.VersionId ||
+				ent.current.ETag == ent.target.ETag && ent.current.Size == ent.target.Size):
+				log.Println("unchanged", ku)
+			default:
+				fmt.Printf("copy %s %s %s\n", ku, ent.target.VersionId, ent.target.LastModified)
+				if !c.Bool("dry-run") {
+					fail.add(ku, copyversion(bkt, ent.key, ent.target.VersionId, ent.target.Size, partsz))
+				}
+			}
+		}
+	}
+	return fail.result("rollback")
+}